@@ -26,9 +26,199 @@ type CapoConfig struct {
 	//IP Release Period, default 5m
 	IPReleasePeriod metav1.Duration `json:"ipReleasePeriod,omitempty"`
 
+	// Window within which the reservations of deleted pods are written together, default 20ms, 0 writes each on its own
+	// +optional
+	ReserveBatchWindow *metav1.Duration `json:"reserveBatchWindow,omitempty"`
+
+	// Windows in which expired IPs are released, default any time. IPs over ipReserveMaxCount are released any time.
+	// +optional
+	ReleaseWindows []ReleaseWindow `json:"releaseWindows,omitempty"`
+
+	// Most expired IPs released per interval, default no limit. IPs over ipReserveMaxCount are released regardless.
+	// +optional
+	ReleaseRateLimit *ReleaseRateLimit `json:"releaseRateLimit,omitempty"`
+
+	// Release the IPs reserved for pods whose top-level owner is gone, e.g. a deleted StatefulSet, without waiting
+	// for their reserve time, within the release windows and the rate limit, default false
+	// +optional
+	ReleaseWorkloadGone bool `json:"releaseWorkloadGone,omitempty"`
+
 	// A label query over a set of resources, in this case pods.
+	// Deprecated: its requirements are ORed, use podSelectors. Ignored when podSelectors is set.
 	// +optional
 	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+
+	// Pods whose IPs are reserved, a pod is selected by any of the entries.
+	// Default one entry per requirement of labelSelector, in the namespaces labeled ip-reserve=enabled.
+	// +optional
+	PodSelectors []PodSelector `json:"podSelectors,omitempty"`
+
+	//IP ownership history max records, default 2000, 0 disables the history
+	// +optional
+	HistoryMaxRecords *int `json:"historyMaxRecords,omitempty"`
+
+	// Allow every pod deletion, without reserving its IPs, until the keeper is initialized, default false
+	// +optional
+	DegradedMode bool `json:"degradedMode,omitempty"`
+
+	// Compute reservations and releases as usual but record them in the shadow ConfigMaps only, never touching the
+	// Calico IPReservation nor denying a pod deletion, default false
+	// +optional
+	ShadowMode bool `json:"shadowMode,omitempty"`
+
+	// Accept the reservations imported by capo import, default false, only the export is served otherwise
+	// +optional
+	BackupImport bool `json:"backupImport,omitempty"`
+
+	// Period of the consistency check between the pod info ConfigMap and the IPReservation, default 10m, 0 disables the check
+	// +optional
+	DriftCheckPeriod *metav1.Duration `json:"driftCheckPeriod,omitempty"`
+
+	// How to repair IPs reserved without pod info or with pod info but not reserved:
+	// adopt them with a fresh timestamp, or drop them, default adopt
+	// +kubebuilder:validation:Enum=adopt;drop
+	// +optional
+	DriftPolicy string `json:"driftPolicy,omitempty"`
+
+	// Longest duration of an IPHold, default 168h
+	// +optional
+	IPHoldMaxDuration *metav1.Duration `json:"ipHoldMaxDuration,omitempty"`
+
+	// Reservation of the IPs of the secondary interfaces attached by Multus, disabled by default
+	// +optional
+	Multus *MultusConfig `json:"multus,omitempty"`
+
+	// Awareness of the Calico IPAM blocks of the reserved IPs, disabled by default
+	// +optional
+	IPAMBlocks *IPAMBlocksConfig `json:"ipamBlocks,omitempty"`
+
+	// Reservation settings of the IPs of Calico IPPools, enforced within each pool. The IPs of the other pools
+	// use ipReserveTime and ipReserveMaxCount, counted together.
+	// +optional
+	IPPools []IPPoolConfig `json:"ipPools,omitempty"`
+
+	// OpenTelemetry tracing, disabled by default
+	// +optional
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+
+	// Built-in webhook certificate management, disabled by default, cert-manager provides the certificate then
+	// +optional
+	Certs *CertsConfig `json:"certs,omitempty"`
+}
+
+// PodSelector selects pods by all of its set fields
+type PodSelector struct {
+	// Labels of the namespace of the pod, default ip-reserve=enabled, {} selects every namespace
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Labels of the pod, unset selects every pod
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// Kinds of the controller owner of the pod, as Kind or Kind.group, e.g. StatefulSet or RedisCluster.redis.io,
+	// unset selects every owner
+	// +optional
+	OwnerKinds []string `json:"ownerKinds,omitempty"`
+	// Kinds of the top-level owner of the controller owner chain of the pod, e.g. RedisCluster.redis.io for
+	// Pod -> StatefulSet -> RedisCluster, as Kind, Kind.group or Kind.version.group, unset selects every owner
+	// +optional
+	TopOwnerKinds []string `json:"topOwnerKinds,omitempty"`
+}
+
+// ReleaseWindow is a window opened at every fire of a cron schedule
+type ReleaseWindow struct {
+	// Cron schedule of the opening of the window: minute hour day-of-month month day-of-week, in the time zone of capo
+	Schedule string `json:"schedule"`
+	// How long the window stays open, at most 168h
+	Duration metav1.Duration `json:"duration"`
+}
+
+// ReleaseRateLimit bounds the expired IPs released within a sliding interval
+type ReleaseRateLimit struct {
+	// Most expired IPs released per interval
+	// +kubebuilder:validation:Minimum=1
+	MaxReleases int `json:"maxReleases"`
+	// Length of the interval
+	Interval metav1.Duration `json:"interval"`
+}
+
+// MultusConfig configures the reservation of the secondary IPs listed in the Multus network-status annotation
+type MultusConfig struct {
+	// Reserve the secondary IPs in a Calico IPPool, default false
+	Enabled bool `json:"enabled,omitempty"`
+	// Networks whose IPs are reserved, namespace/name as in the network-status annotation, default every network
+	// +optional
+	Networks []string `json:"networks,omitempty"`
+}
+
+// IPAMBlocksConfig configures the reading of the Calico IPAMBlocks and BlockAffinities
+type IPAMBlocksConfig struct {
+	// Record the block and the affine node of the reserved IPs, default false
+	Enabled bool `json:"enabled,omitempty"`
+	// How the reservations are released: ip releases every IP on its own, block releases the reservations of a block
+	// together, and every reservation of a block whose node is gone once none of its IPs is allocated, default ip
+	// +kubebuilder:validation:Enum=ip;block
+	// +optional
+	ReleasePolicy string `json:"releasePolicy,omitempty"`
+}
+
+// IPPoolConfig overrides the reservation settings for the IPs of a Calico IPPool
+type IPPoolConfig struct {
+	// Name of the Calico IPPool
+	Name string `json:"name"`
+	// IP Reserve Time of the IPs of the pool, default ipReserveTime
+	// +optional
+	IPReserveTime *metav1.Duration `json:"ipReserveTime,omitempty"`
+	// IP Reserve Max Count of the pool, default ipReserveMaxCount
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	IPReserveMaxCount *int `json:"ipReserveMaxCount,omitempty"`
+}
+
+// TracingConfig configures the export of OpenTelemetry spans over OTLP/HTTP
+type TracingConfig struct {
+	// Enable tracing, default false
+	Enabled bool `json:"enabled,omitempty"`
+	// OTLP/HTTP collector host:port, default localhost:4318
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// Send spans without TLS
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+	// Service name of the spans, default capo
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+	// Percentage of the traces sampled, default 100
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	SamplingPercentage *int `json:"samplingPercentage,omitempty"`
+}
+
+// CertsConfig configures the CA and the serving certificate capo generates for its webhook
+type CertsConfig struct {
+	// Generate and rotate the webhook certificate, default false
+	Enabled bool `json:"enabled,omitempty"`
+	// Secret in the capo namespace holding the CA and the serving certificate, default webhook-server-cert
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+	// Service of the webhook the serving certificate is issued for, default ip-reserve-webhook-service
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+	// ValidatingWebhookConfiguration whose caBundle is kept up to date, default ip-reserve-validating-webhook-configuration
+	// +optional
+	ValidatingWebhookConfiguration string `json:"validatingWebhookConfiguration,omitempty"`
+	// MutatingWebhookConfiguration whose caBundle is kept up to date, default ip-reserve-mutating-webhook-configuration
+	// +optional
+	MutatingWebhookConfiguration string `json:"mutatingWebhookConfiguration,omitempty"`
+	// Validity of the CA, default 87600h
+	// +optional
+	CAValidity *metav1.Duration `json:"caValidity,omitempty"`
+	// Validity of the serving certificate, default 8760h
+	// +optional
+	CertValidity *metav1.Duration `json:"certValidity,omitempty"`
+	// Certificates are renewed this long before they expire, default 720h
+	// +optional
+	RotateBefore *metav1.Duration `json:"rotateBefore,omitempty"`
 }
 
 func init() {
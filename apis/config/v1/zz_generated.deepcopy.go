@@ -27,11 +27,75 @@ func (in *CapoConfig) DeepCopyInto(out *CapoConfig) {
 		**out = **in
 	}
 	out.IPReleasePeriod = in.IPReleasePeriod
+	if in.ReserveBatchWindow != nil {
+		in, out := &in.ReserveBatchWindow, &out.ReserveBatchWindow
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.ReleaseWindows != nil {
+		in, out := &in.ReleaseWindows, &out.ReleaseWindows
+		*out = make([]ReleaseWindow, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReleaseRateLimit != nil {
+		in, out := &in.ReleaseRateLimit, &out.ReleaseRateLimit
+		*out = new(ReleaseRateLimit)
+		**out = **in
+	}
 	if in.LabelSelector != nil {
 		in, out := &in.LabelSelector, &out.LabelSelector
 		*out = new(metav1.LabelSelector)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PodSelectors != nil {
+		in, out := &in.PodSelectors, &out.PodSelectors
+		*out = make([]PodSelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.HistoryMaxRecords != nil {
+		in, out := &in.HistoryMaxRecords, &out.HistoryMaxRecords
+		*out = new(int)
+		**out = **in
+	}
+	if in.DriftCheckPeriod != nil {
+		in, out := &in.DriftCheckPeriod, &out.DriftCheckPeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.IPHoldMaxDuration != nil {
+		in, out := &in.IPHoldMaxDuration, &out.IPHoldMaxDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.Multus != nil {
+		in, out := &in.Multus, &out.Multus
+		*out = new(MultusConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IPAMBlocks != nil {
+		in, out := &in.IPAMBlocks, &out.IPAMBlocks
+		*out = new(IPAMBlocksConfig)
+		**out = **in
+	}
+	if in.IPPools != nil {
+		in, out := &in.IPPools, &out.IPPools
+		*out = make([]IPPoolConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Tracing != nil {
+		in, out := &in.Tracing, &out.Tracing
+		*out = new(TracingConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Certs != nil {
+		in, out := &in.Certs, &out.Certs
+		*out = new(CertsConfig)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CapoConfig.
@@ -51,3 +115,180 @@ func (in *CapoConfig) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CertsConfig) DeepCopyInto(out *CertsConfig) {
+	*out = *in
+	if in.CAValidity != nil {
+		in, out := &in.CAValidity, &out.CAValidity
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.CertValidity != nil {
+		in, out := &in.CertValidity, &out.CertValidity
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.RotateBefore != nil {
+		in, out := &in.RotateBefore, &out.RotateBefore
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CertsConfig.
+func (in *CertsConfig) DeepCopy() *CertsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(CertsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPAMBlocksConfig) DeepCopyInto(out *IPAMBlocksConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPAMBlocksConfig.
+func (in *IPAMBlocksConfig) DeepCopy() *IPAMBlocksConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(IPAMBlocksConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPPoolConfig) DeepCopyInto(out *IPPoolConfig) {
+	*out = *in
+	if in.IPReserveTime != nil {
+		in, out := &in.IPReserveTime, &out.IPReserveTime
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.IPReserveMaxCount != nil {
+		in, out := &in.IPReserveMaxCount, &out.IPReserveMaxCount
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPPoolConfig.
+func (in *IPPoolConfig) DeepCopy() *IPPoolConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(IPPoolConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MultusConfig) DeepCopyInto(out *MultusConfig) {
+	*out = *in
+	if in.Networks != nil {
+		in, out := &in.Networks, &out.Networks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MultusConfig.
+func (in *MultusConfig) DeepCopy() *MultusConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(MultusConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodSelector) DeepCopyInto(out *PodSelector) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LabelSelector != nil {
+		in, out := &in.LabelSelector, &out.LabelSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.OwnerKinds != nil {
+		in, out := &in.OwnerKinds, &out.OwnerKinds
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TopOwnerKinds != nil {
+		in, out := &in.TopOwnerKinds, &out.TopOwnerKinds
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodSelector.
+func (in *PodSelector) DeepCopy() *PodSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(PodSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReleaseRateLimit) DeepCopyInto(out *ReleaseRateLimit) {
+	*out = *in
+	out.Interval = in.Interval
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReleaseRateLimit.
+func (in *ReleaseRateLimit) DeepCopy() *ReleaseRateLimit {
+	if in == nil {
+		return nil
+	}
+	out := new(ReleaseRateLimit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReleaseWindow) DeepCopyInto(out *ReleaseWindow) {
+	*out = *in
+	out.Duration = in.Duration
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReleaseWindow.
+func (in *ReleaseWindow) DeepCopy() *ReleaseWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(ReleaseWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TracingConfig) DeepCopyInto(out *TracingConfig) {
+	*out = *in
+	if in.SamplingPercentage != nil {
+		in, out := &in.SamplingPercentage, &out.SamplingPercentage
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TracingConfig.
+func (in *TracingConfig) DeepCopy() *TracingConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TracingConfig)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IPClaimSpec binds an IP to a pod of the namespace
+type IPClaimSpec struct {
+	// IP bound to the pod
+	IP string `json:"ip"`
+
+	// Calico IPPool the IP belongs to, any enabled pool if empty
+	// +optional
+	IPPool string `json:"ipPool,omitempty"`
+
+	// Name of the pod the IP is bound to
+	// +optional
+	PodName string `json:"podName,omitempty"`
+
+	// StatefulSet ordinal the IP is bound to, in place of podName
+	// +optional
+	StatefulSet *StatefulSetOrdinal `json:"statefulSet,omitempty"`
+}
+
+// StatefulSetOrdinal is the pod of a StatefulSet with the given ordinal
+type StatefulSetOrdinal struct {
+	Name string `json:"name"`
+	// +kubebuilder:validation:Minimum=0
+	Ordinal int32 `json:"ordinal"`
+}
+
+// TargetPod returns the name of the pod the IP is bound to, empty if the spec names none
+func (s *IPClaimSpec) TargetPod() string {
+	if s.StatefulSet != nil {
+		return fmt.Sprintf("%s-%d", s.StatefulSet.Name, s.StatefulSet.Ordinal)
+	}
+	return s.PodName
+}
+
+// IPClaim phases
+const (
+	// the IP is reserved until its pod is created
+	IPClaimAvailable = "Available"
+	// the IP is assigned to its pod
+	IPClaimBound = "Bound"
+	// the claim is invalid or claims the IP of an older claim
+	IPClaimPending = "Pending"
+)
+
+// IPClaimStatus reports whether the IP is reserved or bound
+type IPClaimStatus struct {
+	// Available, Bound or Pending
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// IP reserved or bound by the claim
+	// +optional
+	IP string `json:"ip,omitempty"`
+
+	// Pod the IP is bound to
+	// +optional
+	BoundPod string `json:"boundPod,omitempty"`
+
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Ready reports whether the claim is valid and its IP is reserved or bound, and why not
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="IP",type=string,JSONPath=`.spec.ip`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Pod",type=string,JSONPath=`.status.boundPod`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// IPClaim binds a fixed IP to a pod, the IP stays reserved while the pod does not exist
+type IPClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPClaimSpec   `json:"spec,omitempty"`
+	Status IPClaimStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// IPClaimList contains a list of IPClaim
+type IPClaimList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPClaim `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IPClaim{}, &IPClaimList{})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IPHoldSpec names the pods of the namespace whose IPs are held
+type IPHoldSpec struct {
+	// Names of the pods of the namespace whose IPs are held
+	// +optional
+	PodNames []string `json:"podNames,omitempty"`
+
+	// A label query over the pods of the namespace whose IPs are held
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// How long the IPs are held from the creation of the IPHold, at most ipHoldMaxDuration of the capo config
+	Duration metav1.Duration `json:"duration"`
+}
+
+// HeldIP is an IP held for a pod
+type HeldIP struct {
+	IP string `json:"ip"`
+	// Pod the IP belonged to when it was held
+	Pod string `json:"pod"`
+	// Node of the pod when the IP was held
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+}
+
+// IPHoldStatus reports the IPs held and the state of the hold
+type IPHoldStatus struct {
+	// IPs reserved by the hold, kept after their pods are gone
+	// +optional
+	HeldIPs []HeldIP `json:"heldIPs,omitempty"`
+
+	// Time after which the held IPs are released
+	// +optional
+	ExpireTime *metav1.Time `json:"expireTime,omitempty"`
+
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Held reports whether the IPs of every pod are held, and why not
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Held",type=string,JSONPath=`.status.conditions[?(@.type=="Held")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Held")].reason`
+//+kubebuilder:printcolumn:name="Expire",type=string,JSONPath=`.status.expireTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// IPHold reserves the IPs of pods of its namespace for a while, e.g. ahead of a planned maintenance
+type IPHold struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPHoldSpec   `json:"spec,omitempty"`
+	Status IPHoldStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// IPHoldList contains a list of IPHold
+type IPHoldList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPHold `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IPHold{}, &IPHoldList{})
+}
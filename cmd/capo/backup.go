@@ -0,0 +1,131 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	"sigs.k8s.io/yaml"
+)
+
+func runExport(args []string) error {
+	var (
+		flags  serverFlags
+		file   string
+		format string
+	)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.register(fs)
+	fs.StringVar(&file, "f", "", "File the backup is written to, standard output if unset.")
+	fs.StringVar(&format, "format", "yaml", "Format of the backup, yaml or json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if format != "yaml" && format != "json" {
+		return fmt.Errorf("unknown format %q, expected yaml or json", format)
+	}
+
+	backup := &handler.Backup{}
+	if err := flags.do(http.MethodGet, cons.BackupPath, nil, nil, backup); err != nil {
+		return err
+	}
+	var (
+		out []byte
+		err error
+	)
+	if format == "json" {
+		out, err = json.MarshalIndent(backup, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, err = yaml.Marshal(backup)
+	}
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if err = ioutil.WriteFile(file, out, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d reservations exported to %s\n", len(backup.Reservations), file)
+	return nil
+}
+
+func runImport(args []string) error {
+	var (
+		flags  serverFlags
+		file   string
+		dryRun bool
+		output string
+	)
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.register(fs)
+	fs.StringVar(&file, "f", "", "Backup written by capo export, yaml or json, standard input if unset or -.")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only report the reservations that would be imported.")
+	fs.StringVar(&output, "o", "table", "Output format, table or json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		in  []byte
+		err error
+	)
+	if file == "" || file == "-" {
+		in, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		in, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	body, err := yaml.YAMLToJSON(in)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %v", err)
+	}
+
+	report := &handler.ImportReport{}
+	query := url.Values{cons.BackupDryRunParam: []string{strconv.FormatBool(dryRun)}}
+	if err = flags.do(http.MethodPost, cons.BackupPath, query, bytes.NewReader(body), report); err != nil {
+		return err
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tRESULT")
+	result := "imported"
+	if report.DryRun {
+		result = "would be imported"
+	}
+	for _, ip := range report.Imported {
+		fmt.Fprintf(w, "%s\t%s\n", ip, result)
+	}
+	for _, skip := range report.Skipped {
+		fmt.Fprintf(w, "%s\tskipped: %s\n", skip.IP, skip.Reason)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d imported, %d skipped\n", len(report.Imported), len(report.Skipped))
+	return nil
+}
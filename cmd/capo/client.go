@@ -0,0 +1,91 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// serverFlags locates the metrics endpoint of a capo manager, either directly or through kube-rbac-proxy
+type serverFlags struct {
+	server   string
+	token    string
+	insecure bool
+	timeout  time.Duration
+}
+
+func (s *serverFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.server, "server", "http://127.0.0.1:8080", "The address of the capo manager metrics endpoint.")
+	fs.StringVar(&s.token, "token", "", "Bearer token sent to the server, required behind kube-rbac-proxy.")
+	fs.BoolVar(&s.insecure, "insecure-skip-tls-verify", false, "Skip verifying the server certificate.")
+	fs.DurationVar(&s.timeout, "timeout", 30*time.Second, "Timeout of the request.")
+}
+
+// do sends a request to path and decodes the JSON response into out when it is not nil
+func (s *serverFlags) do(method, path string, query url.Values, body io.Reader, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	u := strings.TrimSuffix(s.server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: s.insecure},
+		},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseTime accepts either an RFC3339 time or a duration relative to now, e.g. 2h meaning two hours ago
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC3339 time", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/history"
+)
+
+func runHistory(args []string) error {
+	var (
+		query  history.Query
+		flags  serverFlags
+		since  string
+		until  string
+		at     string
+		output string
+	)
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.register(fs)
+	fs.StringVar(&query.IP, "ip", "", "Only show the owners of this IP.")
+	fs.StringVar(&query.Pod, "pod", "", "Only show the IPs of this pod, either name or namespace/name.")
+	fs.StringVar(&query.Owner, "owner", "", "Only show the IPs of the pods of this top-level owner, Kind.group/name such as StatefulSet.apps/redis.")
+	fs.StringVar(&since, "since", "", "Only show ownerships after this time, RFC3339 or a duration ago such as 2h.")
+	fs.StringVar(&until, "until", "", "Only show ownerships before this time, RFC3339 or a duration ago such as 2h.")
+	fs.StringVar(&at, "at", "", "Only show ownerships at this time, shorthand for equal --since and --until.")
+	fs.StringVar(&output, "o", "table", "Output format, table or json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var err error
+	if at != "" {
+		since, until = at, at
+	}
+	if query.Since, err = parseTime(since, now); err != nil {
+		return err
+	}
+	if query.Until, err = parseTime(until, now); err != nil {
+		return err
+	}
+
+	resp := &history.Response{}
+	if err = flags.do(http.MethodGet, cons.HistoryPath, query.Values(), nil, resp); err != nil {
+		return err
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(resp)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tNAMESPACE\tPOD\tOWNER\tNODE\tASSIGNED\tDELETED\tRESERVED\tRELEASED")
+	for _, r := range resp.Records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.IP, r.Namespace, r.Pod, formatOwner(r.Owner), r.Node,
+			formatTime(r.AssignedAt), formatTime(r.DeletedAt), formatTime(r.ReservedAt), formatTime(r.ReleasedAt))
+	}
+	return w.Flush()
+}
+
+func formatOwner(owner string) string {
+	if owner == "" {
+		return "-"
+	}
+	return owner
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
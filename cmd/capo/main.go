@@ -0,0 +1,51 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+// capo is the command line client of the capo manager endpoints
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: capo <command> [flags]
+
+Commands:
+  history    Query the IP ownership history
+  export     Export the reservations to a backup file
+  import     Restore the reservations of a backup file
+  simulate   Replay a trace of pod deletions with settings of ipReserveTime and ipReserveMaxCount
+
+Run 'capo <command> -h' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "history":
+		err = runHistory(os.Args[2:])
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "simulate":
+		err = runSimulate(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/history"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	sourceTrace   = "trace"
+	sourceHistory = "history"
+	sourceAudit   = "audit"
+)
+
+func runSimulate(args []string) error {
+	var (
+		flags        serverFlags
+		file         string
+		source       string
+		configFile   string
+		reserveTimes string
+		maxCounts    string
+		period       time.Duration
+		namespaces   string
+		output       string
+	)
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	flags.register(fs)
+	fs.StringVar(&file, "f", "", "Trace file, the history is fetched from --server if unset and --source is history.")
+	fs.StringVar(&source, "source", sourceHistory, "Format of the trace: history, the output of capo history -o json; "+
+		"audit, Kubernetes audit events as JSON lines; trace, JSON events with time, type (assign or delete), ip, namespace, pod and node.")
+	fs.StringVar(&configFile, "config", "", "CapoConfig file whose ipReserveTime, ipReserveMaxCount, ipReleasePeriod, "+
+		"releaseWindows and releaseRateLimit are simulated.")
+	fs.StringVar(&reserveTimes, "reserve-times", "", "Comma separated ipReserveTime values to simulate, default the one of --config or 30m.")
+	fs.StringVar(&maxCounts, "max-counts", "", "Comma separated ipReserveMaxCount values to simulate, default the one of --config or 200.")
+	fs.DurationVar(&period, "release-period", 0, "Period of the simulated releases, default the ipReleasePeriod of --config or 5m.")
+	fs.StringVar(&namespaces, "namespaces", "", "Comma separated namespaces whose pod deletions reserve IPs, default every namespace.")
+	fs.StringVar(&output, "o", "table", "Output format, table or json.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// the defaults of the manager
+	config := configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: intPtr(200),
+		IPReleasePeriod:   metav1.Duration{Duration: 5 * time.Minute},
+	}
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+		if err = yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("invalid config %s: %v", configFile, err)
+		}
+	}
+	if period == 0 {
+		period = config.IPReleasePeriod.Duration
+	}
+	times, err := parseDurations(reserveTimes, config.IPReserveTime.Duration)
+	if err != nil {
+		return err
+	}
+	counts, err := parseCounts(maxCounts, *config.IPReserveMaxCount)
+	if err != nil {
+		return err
+	}
+
+	events, err := readTrace(&flags, file, source)
+	if err != nil {
+		return err
+	}
+	events = filterDeletes(events, namespaces)
+
+	var results []*handler.SimulationResult
+	for _, reserveTime := range times {
+		for _, maxCount := range counts {
+			setting := config
+			setting.IPReserveTime = metav1.Duration{Duration: reserveTime}
+			setting.IPReserveMaxCount = intPtr(maxCount)
+			result, err := handler.Simulate(events, setting, period)
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d events replayed, released every %s\n", len(events), period)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESERVE TIME\tMAX COUNT\tRESERVED\tPEAK\tPEAK AT\tTTL RELEASES\tEARLY EVICTIONS\tREUSE INCIDENTS\tPREVENTED")
+	for _, r := range results {
+		peakAt := "-"
+		if r.Peak > 0 {
+			peakAt = r.PeakAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%d\t%d\t%d\t%d\n", r.IPReserveTime.Duration, r.IPReserveMaxCount, r.Reserved,
+			r.Peak, peakAt, r.ReleasedTTL, r.EarlyEvictions, r.ReuseIncidents, r.Prevented)
+	}
+	return w.Flush()
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func parseDurations(value string, defaultValue time.Duration) ([]time.Duration, error) {
+	if value == "" {
+		return []time.Duration{defaultValue}, nil
+	}
+	var durations []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ipReserveTime %q", item)
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
+
+func parseCounts(value string, defaultValue int) ([]int, error) {
+	if value == "" {
+		return []int{defaultValue}, nil
+	}
+	var counts []int
+	for _, item := range strings.Split(value, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid ipReserveMaxCount %q", item)
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// filterDeletes keeps the deletions of the pods of namespaces, every assignment is kept to detect the reuses
+func filterDeletes(events []handler.TraceEvent, namespaces string) []handler.TraceEvent {
+	if namespaces == "" {
+		return events
+	}
+	selected := map[string]bool{}
+	for _, namespace := range strings.Split(namespaces, ",") {
+		selected[strings.TrimSpace(namespace)] = true
+	}
+	var filtered []handler.TraceEvent
+	for _, event := range events {
+		if event.Type == cons.TraceEventAssign || selected[event.Namespace] {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
+
+func readTrace(flags *serverFlags, file, source string) ([]handler.TraceEvent, error) {
+	if file == "" && source == sourceHistory {
+		resp := &history.Response{}
+		if err := flags.do(http.MethodGet, cons.HistoryPath, nil, nil, resp); err != nil {
+			return nil, err
+		}
+		return historyEvents(resp), nil
+	}
+	if file == "" {
+		return nil, fmt.Errorf("-f is required for the %s source", source)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch source {
+	case sourceHistory:
+		resp := &history.Response{}
+		if err = json.NewDecoder(f).Decode(resp); err != nil {
+			return nil, fmt.Errorf("invalid history %s: %v", file, err)
+		}
+		return historyEvents(resp), nil
+	case sourceAudit:
+		return auditEvents(f)
+	case sourceTrace:
+		var events []handler.TraceEvent
+		err = decodeStream(f, func(decoder *json.Decoder) error {
+			event := handler.TraceEvent{}
+			if err := decoder.Decode(&event); err != nil {
+				return err
+			}
+			events = append(events, event)
+			return nil
+		})
+		return events, err
+	default:
+		return nil, fmt.Errorf("unknown source %q, expected history, audit or trace", source)
+	}
+}
+
+// decodeStream calls decode for every JSON value of r, either JSON lines or a JSON array
+func decodeStream(r io.Reader, decode func(decoder *json.Decoder) error) error {
+	reader := bufio.NewReader(r)
+	decoder := json.NewDecoder(reader)
+	first, err := peekNonSpace(reader)
+	if err != nil {
+		return err
+	}
+	if first == '[' {
+		if _, err = decoder.Token(); err != nil {
+			return err
+		}
+	}
+	for decoder.More() {
+		if err = decode(decoder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		if _, err = reader.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// historyEvents turns the IP ownerships into the assignment and the deletion of their pods
+func historyEvents(resp *history.Response) []handler.TraceEvent {
+	var events []handler.TraceEvent
+	for _, r := range resp.Records {
+		event := handler.TraceEvent{IP: r.IP, Namespace: r.Namespace, Pod: r.Pod, Node: r.Node}
+		if r.AssignedAt != nil {
+			event.Type, event.Time = cons.TraceEventAssign, *r.AssignedAt
+			events = append(events, event)
+		}
+		deleted := r.DeletedAt
+		if deleted == nil {
+			deleted = r.ReservedAt
+		}
+		if deleted != nil {
+			event.Type, event.Time = cons.TraceEventDelete, *deleted
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// auditEvent holds the fields of an audit.k8s.io/v1 Event the simulation needs
+type auditEvent struct {
+	Stage     string `json:"stage"`
+	Verb      string `json:"verb"`
+	ObjectRef *struct {
+		Resource    string `json:"resource"`
+		Subresource string `json:"subresource"`
+		Namespace   string `json:"namespace"`
+		Name        string `json:"name"`
+	} `json:"objectRef"`
+	ResponseStatus *struct {
+		Code int `json:"code"`
+	} `json:"responseStatus"`
+	RequestObject  json.RawMessage  `json:"requestObject"`
+	ResponseObject json.RawMessage  `json:"responseObject"`
+	StageTimestamp metav1.MicroTime `json:"stageTimestamp"`
+}
+
+// podState is what the audit events tell about a pod so far
+type podState struct {
+	ips  []string
+	node string
+}
+
+// auditEvents turns the audit events of pods into trace events: the IPs set by a status update are assigned,
+// the IPs of a pod deleted or evicted are reserved. The status updates need the Request level at least,
+// the deletions the RequestResponse level for the IPs of the pods whose status updates are not audited.
+func auditEvents(r io.Reader) ([]handler.TraceEvent, error) {
+	var events []handler.TraceEvent
+	pods := map[string]*podState{}
+	err := decodeStream(r, func(decoder *json.Decoder) error {
+		e := auditEvent{}
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		if e.Stage != "ResponseComplete" || e.ObjectRef == nil || e.ObjectRef.Resource != "pods" ||
+			(e.ResponseStatus != nil && e.ResponseStatus.Code >= 300) {
+			return nil
+		}
+		key := e.ObjectRef.Namespace + "/" + e.ObjectRef.Name
+		state := pods[key]
+		if state == nil {
+			state = &podState{}
+			pods[key] = state
+		}
+		// the response is the whole pod, the request of a patch only a part of it
+		pod := decodePod(e.ResponseObject)
+		if pod == nil {
+			pod = decodePod(e.RequestObject)
+		}
+		if pod != nil && pod.Spec.NodeName != "" {
+			state.node = pod.Spec.NodeName
+		}
+		event := handler.TraceEvent{Time: e.StageTimestamp.Time, Namespace: e.ObjectRef.Namespace, Pod: e.ObjectRef.Name}
+
+		switch {
+		case e.Verb == "create" && e.ObjectRef.Subresource == "":
+			// a new pod, with IPs of its own
+			pods[key] = &podState{node: state.node}
+		case (e.Verb == "update" || e.Verb == "patch") && e.ObjectRef.Subresource == "status":
+			ips := podIPs(pod)
+			for _, ip := range ips {
+				if !contains(state.ips, ip) {
+					event.Type, event.IP, event.Node = cons.TraceEventAssign, ip, state.node
+					events = append(events, event)
+				}
+			}
+			if len(ips) > 0 {
+				state.ips = ips
+			}
+		case e.Verb == "delete" && e.ObjectRef.Subresource == "",
+			e.Verb == "create" && e.ObjectRef.Subresource == cons.PodSubResourceEviction:
+			ips := state.ips
+			if e.Verb == "delete" && len(podIPs(pod)) > 0 {
+				ips = podIPs(pod)
+			}
+			for _, ip := range ips {
+				event.Type, event.IP, event.Node = cons.TraceEventDelete, ip, state.node
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+func decodePod(raw json.RawMessage) *v1.Pod {
+	if len(raw) == 0 {
+		return nil
+	}
+	pod := &v1.Pod{}
+	// a JSON patch is an array, it says nothing usable
+	if err := json.Unmarshal(raw, pod); err != nil || (pod.Kind != "" && pod.Kind != "Pod") {
+		return nil
+	}
+	return pod
+}
+
+func podIPs(pod *v1.Pod) []string {
+	if pod == nil {
+		return nil
+	}
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
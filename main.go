@@ -5,18 +5,31 @@ Copyright 2022 xdfdotcn
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/xdfdotcn/capo/pkg/certs"
 	cons "github.com/xdfdotcn/capo/pkg/constants"
+	ipclaimctrl "github.com/xdfdotcn/capo/pkg/controllers/ipclaim"
+	ipholdctrl "github.com/xdfdotcn/capo/pkg/controllers/iphold"
 	ipreservationctrl "github.com/xdfdotcn/capo/pkg/controllers/ipreservation"
+	podhistoryctrl "github.com/xdfdotcn/capo/pkg/controllers/podhistory"
 	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/health"
+	"github.com/xdfdotcn/capo/pkg/history"
+	"github.com/xdfdotcn/capo/pkg/tracing"
 	"github.com/xdfdotcn/capo/pkg/utils"
 	wh "github.com/xdfdotcn/capo/pkg/webhook"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
 	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	_ "github.com/xdfdotcn/capo/pkg/metrics"
@@ -26,6 +39,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -43,6 +57,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(v3.AddToScheme(scheme))
 	utilruntime.Must(configv1.AddToScheme(scheme))
+	utilruntime.Must(ipamv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -64,7 +79,7 @@ func main() {
 		"The controller will load its initial configuration from this file. "+
 			"Omit this flag to use the default configuration values. "+
 			"Command-line flags override configuration from this file.")
-	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&metricsAddr, "metrics-bind-address", "127.0.0.1:8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
@@ -97,9 +112,14 @@ func main() {
 	var err error
 	// default CapoConfig
 	ctrlConfig := configv1.CapoConfig{
-		IPReserveMaxCount: pointer.Int(200),
-		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
-		IPReleasePeriod:   metav1.Duration{Duration: 5 * time.Minute},
+		IPReserveMaxCount:  pointer.Int(200),
+		IPReserveTime:      metav1.Duration{Duration: 30 * time.Minute},
+		IPReleasePeriod:    metav1.Duration{Duration: 5 * time.Minute},
+		HistoryMaxRecords:  pointer.Int(cons.HistoryMaxRecords),
+		DriftCheckPeriod:   &metav1.Duration{Duration: cons.DriftCheckPeriod},
+		DriftPolicy:        cons.DriftPolicyAdopt,
+		IPHoldMaxDuration:  &metav1.Duration{Duration: cons.IPHoldMaxDuration},
+		ReserveBatchWindow: &metav1.Duration{Duration: cons.ReserveBatchWindow},
 	}
 	if configFile != "" {
 		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&ctrlConfig))
@@ -109,20 +129,62 @@ func main() {
 		}
 	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
+	shutdownTracing, err := tracing.Setup(context.Background(), ctrlConfig.Tracing)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	restConfig := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(restConfig, options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	keeper, err := handler.NewIPKeeper(mgr.GetClient(), &ctrlConfig)
+	if webhookEnable && ctrlConfig.Certs != nil && ctrlConfig.Certs.Enabled {
+		certDir := options.CertDir
+		if certDir == "" {
+			certDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+		}
+		// the cache is not started yet, and the webhook server needs the certificate as soon as the manager starts
+		directClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		certManager := certs.NewCertManager(directClient, *ctrlConfig.Certs, certDir)
+		if err = certManager.Bootstrap(ctx); err != nil {
+			setupLog.Error(err, "unable to bootstrap webhook certificate")
+			os.Exit(1)
+		}
+		if err = mgr.Add(certManager.Rotator()); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate rotator")
+			os.Exit(1)
+		}
+		if err = mgr.Add(certManager.Syncer()); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate syncer")
+			os.Exit(1)
+		}
+	}
+
+	// the keeper initializes its resources once the manager starts, retrying until its dependencies are up
+	keeper, err := handler.NewLazyIPKeeper(mgr.GetClient(), &ctrlConfig)
 	if err != nil {
 		setupLog.Error(err, "unable to new IPKeeper")
+		os.Exit(1)
+	}
+	if err = mgr.Add(keeper); err != nil {
+		setupLog.Error(err, "unable to add IPKeeper")
+		os.Exit(1)
 	}
 
 	if webhookEnable {
 		podValidate := wh.NewPodValidator(mgr.GetClient(), keeper)
 		mgr.GetWebhookServer().Register("/pod-ip-reservation", &webhook.Admission{Handler: podValidate})
+		mgr.GetWebhookServer().Register("/capo-state", &webhook.Admission{Handler: wh.NewStateValidator(mgr.GetClient())})
+		mgr.GetWebhookServer().Register("/pod-ip-claim", &webhook.Admission{Handler: wh.NewClaimMutator(mgr.GetClient())})
 	}
 
 	if err = ipreservationctrl.NewIPReservationReconciler(mgr.GetClient(), &ctrlConfig, keeper).SetupWithManager(mgr); err != nil {
@@ -130,24 +192,112 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err = ipholdctrl.NewIPHoldReconciler(mgr.GetClient(), &ctrlConfig, keeper).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IPHold")
+		os.Exit(1)
+	}
+
+	if err = ipclaimctrl.NewIPClaimReconciler(mgr.GetClient(), keeper).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IPClaim")
+		os.Exit(1)
+	}
+
+	if ctrlConfig.HistoryMaxRecords != nil && *ctrlConfig.HistoryMaxRecords > 0 {
+		ledger := history.NewLedger(mgr.GetClient(), *ctrlConfig.HistoryMaxRecords)
+		keeper.SetHistory(ledger)
+		if err = mgr.Add(ledger); err != nil {
+			setupLog.Error(err, "unable to add ip history")
+			os.Exit(1)
+		}
+		if err = mgr.AddMetricsExtraHandler(cons.HistoryPath, history.NewHandler(ledger)); err != nil {
+			setupLog.Error(err, "unable to set up ip history endpoint")
+			os.Exit(1)
+		}
+		if err = podhistoryctrl.NewPodHistoryReconciler(mgr.GetClient(), keeper, ledger).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PodHistory")
+			os.Exit(1)
+		}
+	}
+
+	if err = mgr.AddMetricsExtraHandler(cons.BackupPath, handler.NewBackupHandler(keeper)); err != nil {
+		setupLog.Error(err, "unable to set up reservation backup endpoint")
+		os.Exit(1)
+	}
+
+	if ctrlConfig.DriftCheckPeriod != nil && ctrlConfig.DriftCheckPeriod.Duration > 0 {
+		if ctrlConfig.DriftPolicy != cons.DriftPolicyAdopt && ctrlConfig.DriftPolicy != cons.DriftPolicyDrop {
+			setupLog.Error(fmt.Errorf("unknown drift policy %q", ctrlConfig.DriftPolicy), "invalid config")
+			os.Exit(1)
+		}
+		driftChecker := handler.NewDriftChecker(keeper, mgr.GetEventRecorderFor(cons.IPReserveKey),
+			ctrlConfig.DriftCheckPeriod.Duration, ctrlConfig.DriftPolicy)
+		if err = mgr.Add(driftChecker); err != nil {
+			setupLog.Error(err, "unable to add drift checker")
+			os.Exit(1)
+		}
+	}
+
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up ready check")
+	releaseLoopTimeout := cons.ReleaseLoopTimeoutPeriods * ctrlConfig.IPReleasePeriod.Duration
+	if releaseLoopTimeout < cons.MinReleaseLoopTimeout {
+		releaseLoopTimeout = cons.MinReleaseLoopTimeout
+	}
+	if err := mgr.AddHealthzCheck("release-loop", health.ReleaseLoopAlive(keeper, health.ElectedAt(mgr.Elected()), releaseLoopTimeout)); err != nil {
+		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
 
+	// every check is named on its own, /readyz?verbose tells which one fails
+	podIPMapKey, ipReservationKey := handler.PodIPMapKey(), handler.IPReservationKey()
+	newIPReservation := func() client.Object { return &v3.IPReservation{} }
+	if ctrlConfig.ShadowMode {
+		podIPMapKey, ipReservationKey = handler.ShadowPodIPMapKey(), handler.ShadowReservationKey()
+		newIPReservation = func() client.Object { return &corev1.ConfigMap{} }
+	}
+	dependencyChecks := map[string]healthz.Checker{
+		"keeper": health.Initialized("IPKeeper", keeper.Initialized),
+		"pod-ip-map": health.Readable(mgr.GetAPIReader(), podIPMapKey, func() client.Object {
+			return &corev1.ConfigMap{}
+		}),
+		"ip-reservation": health.Readable(mgr.GetAPIReader(), ipReservationKey, newIPReservation),
+		"calico-api": health.APIServed(discovery.NewDiscoveryClientForConfigOrDie(mgr.GetConfig()),
+			v3.GroupVersionCurrent, "ipreservations"),
+	}
+	readyzChecks := map[string]healthz.Checker{
+		"readyz": healthz.Ping,
+	}
+	for name, check := range dependencyChecks {
+		// in degraded mode the replica serves the webhook, allowing every deletion, until the keeper is initialized
+		readyzChecks[name] = health.Unless(keeper.Degraded, check)
+	}
+	if webhookEnable {
+		// fails until the serving certificate is loaded and the webhook server accepts TLS connections
+		readyzChecks["webhook-cert"] = mgr.GetWebhookServer().StartedChecker()
+	}
+	for name, check := range readyzChecks {
+		if err := mgr.AddReadyzCheck(name, check); err != nil {
+			setupLog.Error(err, "unable to set up ready check", "check", name)
+			os.Exit(1)
+		}
+	}
+
 	//// start cron job
 	//go func() {
 	//	handler.NewHousekeepingJob("0/5 * * * * ?", mgr.GetClient()).ExecCronJob()
 	//}()
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctx)
+	// flush the pending spans
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "unable to shut down tracing")
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,216 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Secret data keys, ca.crt holds the CA signing the serving certificate first, then the
+// previous CAs that are still valid, so that clients trusting any of them keep working during a rotation
+const (
+	CACertKey = "ca.crt"
+	CAKeyKey  = "ca.key"
+	CertKey   = v1.TLSCertKey
+	KeyKey    = v1.TLSPrivateKeyKey
+)
+
+// keyPair is a parsed certificate and its private key
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// validFor reports whether the certificate is valid from now until now + d
+func (p *keyPair) validFor(now time.Time, d time.Duration) bool {
+	return p != nil && !now.Before(p.cert.NotBefore) && now.Add(d).Before(p.cert.NotAfter)
+}
+
+// newKeyPair creates a certificate for template signed by parent, self-signed if parent is nil
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key}, nil
+}
+
+func newCA(now time.Time, validity time.Duration) (*keyPair, error) {
+	return newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("capo-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+}
+
+func newServingCert(ca *keyPair, dnsNames []string, now time.Time, validity time.Duration) (*keyPair, error) {
+	notAfter := now.Add(validity)
+	// a certificate never outlives its CA
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	return newKeyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func encodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseCerts decodes every certificate of a PEM bundle
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// parseKeyPair decodes the first certificate of certPEM and the key of keyPEM, nil if any is missing or invalid
+func parseKeyPair(certPEM, keyPEM []byte) *keyPair {
+	certs, err := parseCerts(certPEM)
+	if err != nil || len(certs) == 0 {
+		return nil
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil || !key.PublicKey.Equal(certs[0].PublicKey) {
+		return nil
+	}
+	return &keyPair{cert: certs[0], key: key}
+}
+
+// policy decides when the CA and the serving certificate are renewed
+type policy struct {
+	dnsNames     []string
+	caValidity   time.Duration
+	certValidity time.Duration
+	rotateBefore time.Duration
+}
+
+// renew returns the Secret data holding a CA and a serving certificate valid for at least rotateBefore,
+// reusing those of data when possible, and whether it differs from data
+func (p *policy) renew(data map[string][]byte, now time.Time) (map[string][]byte, bool, error) {
+	renewed := map[string][]byte{}
+	for k, v := range data {
+		renewed[k] = v
+	}
+
+	ca := parseKeyPair(data[CACertKey], data[CAKeyKey])
+	previousCAs, _ := parseCerts(data[CACertKey])
+	if !ca.validFor(now, p.rotateBefore) {
+		next, err := newCA(now, p.caValidity)
+		if err != nil {
+			return nil, false, err
+		}
+		ca = next
+		// the replaced CA is still trusted until it expires, it may sign the certificate some replicas serve
+		previousCAs = append([]*x509.Certificate{ca.cert}, previousCAs...)
+	}
+	var bundle []byte
+	for i, cert := range previousCAs {
+		if i == 0 || now.Before(cert.NotAfter) {
+			bundle = append(bundle, encodeCert(cert)...)
+		}
+	}
+	caKey, err := encodeKey(ca.key)
+	if err != nil {
+		return nil, false, err
+	}
+	renewed[CACertKey], renewed[CAKeyKey] = bundle, caKey
+
+	serving := parseKeyPair(data[CertKey], data[KeyKey])
+	if !serving.validFor(now, p.rotateBefore) || serving.cert.CheckSignatureFrom(ca.cert) != nil ||
+		!sameNames(serving.cert.DNSNames, p.dnsNames) {
+		if serving, err = newServingCert(ca, p.dnsNames, now, p.certValidity); err != nil {
+			return nil, false, err
+		}
+		key, err := encodeKey(serving.key)
+		if err != nil {
+			return nil, false, err
+		}
+		renewed[CertKey], renewed[KeyKey] = encodeCert(serving.cert), key
+	}
+
+	changed := false
+	for _, k := range []string{CACertKey, CAKeyKey, CertKey, KeyKey} {
+		if !bytes.Equal(data[k], renewed[k]) {
+			changed = true
+		}
+	}
+	return renewed, changed, nil
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func testPolicy() *policy {
+	return &policy{
+		dnsNames:     []string{"capo-webhook-service.capo.svc"},
+		caValidity:   10 * time.Hour,
+		certValidity: 8 * time.Hour,
+		rotateBefore: time.Hour,
+	}
+}
+
+// verify checks that the serving certificate of data is trusted by its CA bundle
+func verify(t *testing.T, data map[string][]byte, now time.Time) {
+	pair, err := tls.X509KeyPair(data[CertKey], data[KeyKey])
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(data[CACertKey]))
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:     "capo-webhook-service.capo.svc",
+		Roots:       roots,
+		CurrentTime: now,
+	})
+	assert.NoError(t, err)
+}
+
+func TestRenew(t *testing.T) {
+	p := testPolicy()
+	now := time.Now()
+
+	data, changed, err := p.renew(nil, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	verify(t, data, now)
+
+	again, changed, err := p.renew(data, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, changed, "valid certificates are kept")
+	assert.Equal(t, data, again)
+
+	// the serving certificate expires within rotateBefore, the CA does not
+	renewed, changed, err := p.renew(data, now.Add(7*time.Hour+time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, data[CACertKey], renewed[CACertKey])
+	assert.NotEqual(t, data[CertKey], renewed[CertKey])
+	verify(t, renewed, now.Add(7*time.Hour+time.Minute))
+
+	// the CA expires within rotateBefore, the old one stays in the bundle until it expires
+	at := now.Add(9*time.Hour + time.Minute)
+	rotated, changed, err := p.renew(renewed, at)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	cas, err := parseCerts(rotated[CACertKey])
+	assert.NoError(t, err)
+	assert.Len(t, cas, 2)
+	verify(t, rotated, at)
+	// replicas still serving the previous certificate, which never outlives its CA, stay trusted
+	verify(t, map[string][]byte{CACertKey: rotated[CACertKey], CertKey: renewed[CertKey], KeyKey: renewed[KeyKey]}, at)
+
+	// the old CA is dropped once expired
+	dropped, _, err := p.renew(rotated, now.Add(10*time.Hour+time.Minute))
+	assert.NoError(t, err)
+	cas, err = parseCerts(dropped[CACertKey])
+	assert.NoError(t, err)
+	assert.Len(t, cas, 1)
+
+	// the serving certificate is reissued for new names
+	p.dnsNames = []string{"capo-webhook-service.capo.svc", "capo-webhook-service.capo"}
+	_, changed, err = p.renew(dropped, now.Add(10*time.Hour+time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, changed)
+}
+
+func TestCertManagerBootstrap(t *testing.T) {
+	vwc := &admissionv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: cons.CertValidatingWebhookConfiguration},
+		Webhooks:   []admissionv1.ValidatingWebhook{{Name: "pod.ip.io"}},
+	}
+	mwc := &admissionv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: cons.CertMutatingWebhookConfiguration},
+		Webhooks:   []admissionv1.MutatingWebhook{{Name: "claim.ip.io"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(vwc, mwc).Build()
+	certDir := t.TempDir()
+	m := NewCertManager(c, configv1.CertsConfig{Enabled: true}, certDir)
+	assert.NoError(t, m.Bootstrap(context.Background()))
+
+	secret := &v1.Secret{}
+	assert.NoError(t, c.Get(context.Background(), m.secret, secret))
+	assert.Equal(t, v1.SecretTypeTLS, secret.Type)
+
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(vwc), vwc))
+	assert.Equal(t, secret.Data[CACertKey], vwc.Webhooks[0].ClientConfig.CABundle)
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(mwc), mwc))
+	assert.Equal(t, secret.Data[CACertKey], mwc.Webhooks[0].ClientConfig.CABundle)
+
+	cert, err := os.ReadFile(filepath.Join(certDir, CertKey))
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data[CertKey], cert)
+
+	// another replica reuses the certificate
+	other := NewCertManager(c, configv1.CertsConfig{Enabled: true}, t.TempDir())
+	assert.NoError(t, other.Bootstrap(context.Background()))
+	reread := &v1.Secret{}
+	assert.NoError(t, c.Get(context.Background(), m.secret, reread))
+	assert.Equal(t, secret.Data, reread.Data)
+}
+
+func TestCertManagerWithoutWebhookConfiguration(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+	m := NewCertManager(c, configv1.CertsConfig{Enabled: true}, t.TempDir())
+	assert.NoError(t, m.Bootstrap(context.Background()))
+	assert.Error(t, m.rotate(context.Background()))
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;create;update
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;update
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;update
+
+// CertManager generates the CA and the serving certificate of the webhook, stores them in a Secret shared
+// by the replicas, writes the serving certificate into the webhook cert dir and injects the CA into the
+// caBundle of the webhook configurations.
+type CertManager struct {
+	client  client.Client
+	config  configv1.CertsConfig
+	secret  types.NamespacedName
+	certDir string
+	policy  policy
+}
+
+// NewCertManager fills the defaults of config, client must not read from the cache as the Secret
+// is needed before the manager starts.
+func NewCertManager(client client.Client, config configv1.CertsConfig, certDir string) *CertManager {
+	if config.SecretName == "" {
+		config.SecretName = cons.CertSecretName
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = cons.CertServiceName
+	}
+	if config.ValidatingWebhookConfiguration == "" {
+		config.ValidatingWebhookConfiguration = cons.CertValidatingWebhookConfiguration
+	}
+	if config.MutatingWebhookConfiguration == "" {
+		config.MutatingWebhookConfiguration = cons.CertMutatingWebhookConfiguration
+	}
+	namespace := utils.GetNamespace()
+	return &CertManager{
+		client:  client,
+		config:  config,
+		secret:  types.NamespacedName{Namespace: namespace, Name: config.SecretName},
+		certDir: certDir,
+		policy: policy{
+			dnsNames: []string{
+				fmt.Sprintf("%s.%s.svc", config.ServiceName, namespace),
+				fmt.Sprintf("%s.%s.svc.cluster.local", config.ServiceName, namespace),
+				fmt.Sprintf("%s.%s", config.ServiceName, namespace),
+			},
+			caValidity:   durationOr(config.CAValidity, cons.CertCAValidity),
+			certValidity: durationOr(config.CertValidity, cons.CertValidity),
+			rotateBefore: durationOr(config.RotateBefore, cons.CertRotateBefore),
+		},
+	}
+}
+
+func durationOr(d *metav1.Duration, def time.Duration) time.Duration {
+	if d == nil || d.Duration <= 0 {
+		return def
+	}
+	return d.Duration
+}
+
+// Bootstrap makes sure a valid serving certificate is on disk before the webhook server starts,
+// generating it if no replica did yet
+func (m *CertManager) Bootstrap(ctx context.Context) error {
+	data, err := m.Ensure(ctx)
+	if err != nil {
+		return err
+	}
+	// the webhook configuration may be installed after capo, the rotator injects the caBundle later then
+	if err = m.InjectCABundle(ctx, data[CACertKey]); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return m.WriteFiles(data)
+}
+
+// Ensure renews the CA and the serving certificate of the Secret when needed, and returns its data
+func (m *CertManager) Ensure(ctx context.Context) (map[string][]byte, error) {
+	var data map[string][]byte
+	err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		// another replica created or renewed the Secret in the meantime
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		secret := &v1.Secret{}
+		err := m.client.Get(ctx, m.secret, secret)
+		notFound := errors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+
+		var changed bool
+		data, changed, err = m.policy.renew(secret.Data, time.Now())
+		if err != nil || !changed {
+			return err
+		}
+
+		log.FromContext(ctx).Info("renew webhook certificate", "secret", m.secret.String())
+		secret.Data = data
+		if notFound {
+			secret.ObjectMeta = metav1.ObjectMeta{Namespace: m.secret.Namespace, Name: m.secret.Name}
+			secret.Type = v1.SecretTypeTLS
+			return m.client.Create(ctx, secret)
+		}
+		return m.client.Update(ctx, secret)
+	})
+	return data, err
+}
+
+// InjectCABundle sets the caBundle of every webhook of the webhook configurations
+func (m *CertManager) InjectCABundle(ctx context.Context, caBundle []byte) error {
+	vwc := &admissionv1.ValidatingWebhookConfiguration{}
+	err := m.inject(ctx, vwc, m.config.ValidatingWebhookConfiguration, caBundle, func() []*admissionv1.WebhookClientConfig {
+		clientConfigs := make([]*admissionv1.WebhookClientConfig, len(vwc.Webhooks))
+		for i := range vwc.Webhooks {
+			clientConfigs[i] = &vwc.Webhooks[i].ClientConfig
+		}
+		return clientConfigs
+	})
+	if err != nil {
+		return err
+	}
+
+	mwc := &admissionv1.MutatingWebhookConfiguration{}
+	err = m.inject(ctx, mwc, m.config.MutatingWebhookConfiguration, caBundle, func() []*admissionv1.WebhookClientConfig {
+		clientConfigs := make([]*admissionv1.WebhookClientConfig, len(mwc.Webhooks))
+		for i := range mwc.Webhooks {
+			clientConfigs[i] = &mwc.Webhooks[i].ClientConfig
+		}
+		return clientConfigs
+	})
+	// the mutating webhook configuration is only needed by the IPClaim webhook
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// inject updates the webhook configuration named name when a client config returned by clientConfigs,
+// once it is read into obj, lacks caBundle
+func (m *CertManager) inject(ctx context.Context, obj client.Object, name string, caBundle []byte,
+	clientConfigs func() []*admissionv1.WebhookClientConfig) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := m.client.Get(ctx, types.NamespacedName{Name: name}, obj); err != nil {
+			return err
+		}
+		changed := false
+		for _, clientConfig := range clientConfigs() {
+			if !bytes.Equal(clientConfig.CABundle, caBundle) {
+				clientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		log.FromContext(ctx).Info("inject webhook caBundle", "webhookConfiguration", name)
+		return m.client.Update(ctx, obj)
+	})
+}
+
+// WriteFiles writes the serving certificate into the cert dir when it changed, the webhook server reloads it
+func (m *CertManager) WriteFiles(data map[string][]byte) error {
+	if err := os.MkdirAll(m.certDir, 0700); err != nil {
+		return err
+	}
+	// the key first, the watcher of the webhook server reloads the pair on every change
+	for _, name := range []string{KeyKey, CertKey} {
+		path := filepath.Join(m.certDir, name)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data[name]) {
+			continue
+		}
+		// replaced by a rename so that the webhook server never reads a partial file
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data[name], 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync writes the serving certificate renewed by the leader into the cert dir
+func (m *CertManager) sync(ctx context.Context) error {
+	secret := &v1.Secret{}
+	if err := m.client.Get(ctx, m.secret, secret); err != nil {
+		return err
+	}
+	return m.WriteFiles(secret.Data)
+}
+
+// rotate renews the certificates before they expire and keeps the caBundle up to date
+func (m *CertManager) rotate(ctx context.Context) error {
+	data, err := m.Ensure(ctx)
+	if err != nil {
+		return err
+	}
+	if err = m.InjectCABundle(ctx, data[CACertKey]); err != nil {
+		return err
+	}
+	return m.WriteFiles(data)
+}
+
+// Rotator returns the runnable renewing the certificates, only the leader renews them
+func (m *CertManager) Rotator() *Runnable {
+	return &Runnable{name: "rotate", period: cons.CertCheckPeriod, run: m.rotate, leaderElection: true}
+}
+
+// Syncer returns the runnable writing the certificates renewed by the leader on every replica
+func (m *CertManager) Syncer() *Runnable {
+	return &Runnable{name: "sync", period: cons.CertSyncPeriod, run: m.sync}
+}
+
+// Runnable runs a CertManager task every period
+type Runnable struct {
+	name           string
+	period         time.Duration
+	run            func(ctx context.Context) error
+	leaderElection bool
+}
+
+func (r *Runnable) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("certs")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.run(log.IntoContext(ctx, logger)); err != nil {
+			logger.Error(err, r.name+" webhook certificate failed")
+		}
+	}, r.period)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (r *Runnable) NeedLeaderElection() bool {
+	return r.leaderElection
+}
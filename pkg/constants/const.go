@@ -1,22 +1,153 @@
 package cons
 
+import "time"
+
 const (
 	IPReserveMetricNamespace = "ip_reserve"
 	IPReserveKey             = "ip-reserve"
 	IPReserveValue           = "enabled"
 	IPReservationName        = "ip-reserve-delay-release"
 	EnvNamespace             = "POD_NAMESPACE"
-	TimeLayout               = "2006-01-02-15:04:05"
-	SeparatorUnderscore      = "_"
-	LabelPodIP               = "pod_ip"
-	LabelPodNamespace        = "pod_ip_owner_namespace"
-	LabelPodName             = "pod_ip_owner_name"
-	LabelNodeName            = "pod_ip_owner_node_name"
-	LabelKeptTime            = "pod_ip_kept_time"
-	IPInfoPlaceholder        = "%s%s%s%s%s%s%s"
+	EnvServiceAccount        = "POD_SERVICE_ACCOUNT"
+	// time layout and separator of the legacy pod info namespace_name_node_time[_owner], the time in the local time zone
+	TimeLayout          = "2006-01-02-15:04:05"
+	SeparatorUnderscore = "_"
+	LabelPodIP          = "pod_ip"
+	LabelPodNamespace   = "pod_ip_owner_namespace"
+	LabelPodName        = "pod_ip_owner_name"
+	LabelNodeName       = "pod_ip_owner_node_name"
+	LabelKeptTime       = "pod_ip_kept_time"
 	//LabelSelectorStatefulSetPodKey = v1.StatefulSetPodNameLabel
 	LabelSelectorStatefulSetPodKey = "statefulset.kubernetes.io/pod-name"
 	LabelSelectorKafkaPodKey       = "brokerId"
 	PodSubResourceEviction         = "eviction"
 	SystemReserveIP                = "1.1.1.1"
+	HistoryConfigMapName           = "ip-reserve-history"
+	HistoryPath                    = "/history"
+	HistoryFlushPeriod             = 10 * time.Second
+	HistoryMaxRecords              = 2000
+	LabelNamespace                 = "namespace"
+	LabelNode                      = "node"
+	LabelReason                    = "reason"
+	LabelOutcome                   = "outcome"
+	LabelOperation                 = "operation"
+	// reasons an IP reservation is released
+	ReleaseReasonTTL          = "ttl"
+	ReleaseReasonCount        = "count"
+	ReleaseReasonManual       = "manual"
+	ReleaseReasonWorkloadGone = "workload-gone"
+	ReleaseReasonPressure     = "pressure"
+	// operations of the calico-apiserver calls
+	OperationGet    = "get"
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationPatch  = "patch"
+	// outcomes of the pod webhook
+	WebhookOutcomeIgnored = "ignored"
+	WebhookOutcomeAllowed = "allowed"
+	WebhookOutcomeDenied  = "denied"
+	// allowed without reserving the IPs while the keeper is not initialized
+	WebhookOutcomeDegraded = "degraded"
+	// backoff of the keeper initialization retries
+	KeeperInitBackoff    = time.Second
+	KeeperInitMaxBackoff = 2 * time.Minute
+	// drift between the pod info ConfigMap and the IPReservation
+	DriftCheckPeriod         = 10 * time.Minute
+	DriftGracePeriod         = time.Minute
+	DriftPolicyAdopt         = "adopt"
+	DriftPolicyDrop          = "drop"
+	DriftKindUnrecorded      = "unrecorded"
+	DriftKindUnreserved      = "unreserved"
+	DriftUnknownOwner        = "unknown"
+	EventReasonDriftRepaired = "DriftRepaired"
+	LabelKind                = "kind"
+	LabelAction              = "action"
+	// built-in webhook certificate management, the names match the kustomize deployment
+	CertSecretName                     = "webhook-server-cert"
+	CertServiceName                    = "ip-reserve-webhook-service"
+	CertValidatingWebhookConfiguration = "ip-reserve-validating-webhook-configuration"
+	CertMutatingWebhookConfiguration   = "ip-reserve-mutating-webhook-configuration"
+	CertCAValidity                     = 10 * 365 * 24 * time.Hour
+	CertValidity                       = 365 * 24 * time.Hour
+	CertRotateBefore                   = 30 * 24 * time.Hour
+	CertCheckPeriod                    = time.Hour
+	CertSyncPeriod                     = time.Minute
+	// guarding of the state capo manages
+	ServiceAccountName       = "ip-reserve-controller-manager"
+	LabelManagedBy           = "app.kubernetes.io/managed-by"
+	ManagedByValue           = "capo"
+	BreakGlassAnnotation     = "capo.io/break-glass"
+	WebhookOutcomeBreakGlass = "break-glass"
+	// IPHold, the hold condition and its reasons
+	IPHoldMaxDuration       = 7 * 24 * time.Hour
+	IPHoldFinalizer         = "ipam.capo.io/hold"
+	IPHoldConditionHeld     = "Held"
+	IPHoldReasonHeld        = "Held"
+	IPHoldReasonInvalid     = "Invalid"
+	IPHoldReasonPodsPending = "PodsPending"
+	IPHoldReasonConflict    = "Conflict"
+	IPHoldReasonFailed      = "Failed"
+	IPHoldReasonExpired     = "Expired"
+	// IPClaim, the IPReservation of the claimed IPs is separate from the delay-release one
+	IPClaimReservationName  = "ip-reserve-static-claims"
+	IPClaimAnnotation       = "capo.io/ip-claim"
+	CalicoIPAddrsAnnotation = "cni.projectcalico.org/ipAddrs"
+	IPClaimFinalizer        = "ipam.capo.io/claim"
+	IPClaimConditionReady   = "Ready"
+	IPClaimReasonAvailable  = "Available"
+	IPClaimReasonBound      = "Bound"
+	IPClaimReasonInvalid    = "Invalid"
+	IPClaimReasonConflict   = "Conflict"
+	IPClaimReasonFailed     = "Failed"
+	WebhookOutcomeBound     = "bound"
+	// the release loop is considered wedged after ReleaseLoopTimeoutPeriods release periods, at least MinReleaseLoopTimeout
+	ReleaseLoopTimeoutPeriods = 10
+	MinReleaseLoopTimeout     = 5 * time.Minute
+	// longest controller owner chain resolved, Pod -> StatefulSet -> custom resource -> ...
+	OwnerChainMaxDepth = 5
+	// the networks attached by Multus, with their interfaces and IPs
+	MultusNetworkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+	// the reason of the freeze of the releases, set on the IPReservation
+	FreezeAnnotation = "capo.io/freeze"
+	// expired IPs held back outside the release windows or over the release rate limit
+	ReleasePendingWindow    = "window"
+	ReleasePendingRateLimit = "rate-limit"
+	// longest release window, bounding the look back for its start
+	ReleaseWindowMaxDuration = 7 * 24 * time.Hour
+	// Calico IPAM blocks and their affinities
+	IPAMBlockRefreshPeriod  = time.Minute
+	BlockAffinityConfirmed  = "confirmed"
+	BlockAffinityHostPrefix = "host:"
+	BlockReleasePolicyIP    = "ip"
+	BlockReleasePolicyBlock = "block"
+	ReleaseReasonBlock      = "block"
+	LabelBlock              = "block"
+	// the aggregates of consecutive reserved IPs capo wrote into the IPReservation, comma separated
+	CompactedAnnotation = "capo.io/compacted"
+	// largest aggregate expanded back into its IPs
+	CompactMaxSize = 1 << 16
+	// Calico IPPools of the reserved IPs
+	IPPoolRefreshPeriod = time.Minute
+	LabelPool           = "pool"
+	// reservations arriving within ReserveBatchWindow are written together, at most ReserveBatchMaxSize pods per batch
+	ReserveBatchWindow  = 20 * time.Millisecond
+	ReserveBatchMaxSize = 100
+	ReserveBatchTimeout = 10 * time.Second
+	// the reservations exported and imported by capo export and capo import
+	BackupPath        = "/reservations"
+	BackupAPIVersion  = "capo.io/v1"
+	BackupMaxBytes    = 32 << 20
+	BackupDryRunParam = "dryRun"
+	// shadow mode records the pod infos and the reserved CIDRs in ConfigMaps of the capo namespace,
+	// the reserved CIDRs comma separated under ShadowReservedCIDRsKey
+	ShadowPodIPMapName     = "ip-reserve-shadow"
+	ShadowReservationName  = "ip-reserve-shadow-reservation"
+	ShadowReservedCIDRsKey = "reservedCIDRs"
+	// a pod deletion that would be denied, allowed in shadow mode
+	WebhookOutcomeShadow = "shadow"
+	// events of the traces replayed by capo simulate
+	TraceEventAssign = "assign"
+	TraceEventDelete = "delete"
+	// an IPClaim of an IP owned by another pod is checked again every IPClaimConflictRequeue
+	IPClaimConflictRequeue = time.Minute
 )
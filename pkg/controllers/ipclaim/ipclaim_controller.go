@@ -0,0 +1,282 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package ipclaimctrl
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	crhandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// IPClaimReconciler keeps the IP of an IPClaim reserved while its pod does not exist
+type IPClaimReconciler struct {
+	client.Client
+	keeper *handler.IPKeeper
+}
+
+func NewIPClaimReconciler(client client.Client, keeper *handler.IPKeeper) *IPClaimReconciler {
+	return &IPClaimReconciler{
+		Client: client,
+		keeper: keeper,
+	}
+}
+
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipclaims,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipclaims/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipclaims/finalizers,verbs=update
+//+kubebuilder:rbac:groups=projectcalico.org,resources=ippools,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile reserves the IP of the claim while its pod does not exist or is terminating, and lifts the
+// reservation once the pod bound by the claim webhook is created, so that Calico assigns it the IP.
+func (r *IPClaimReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	claim := &ipamv1alpha1.IPClaim{}
+	if err := r.Get(ctx, req.NamespacedName, claim); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !claim.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(claim, cons.IPClaimFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if err := r.unreserve(ctx, claim, claim.Status.IP); err != nil {
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(claim, cons.IPClaimFinalizer)
+		return ctrl.Result{}, r.Update(ctx, claim)
+	}
+
+	pools := &v3.IPPoolList{}
+	if err := r.List(ctx, pools); err != nil {
+		return ctrl.Result{}, err
+	}
+	// a pending claim reserves no IP
+	reason, invalid := cons.IPClaimReasonInvalid, validate(claim, pools)
+	if invalid == nil {
+		older, err := r.olderClaim(ctx, claim)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if older != "" {
+			reason, invalid = cons.IPClaimReasonConflict, fmt.Errorf("IPClaim %s claims the IP or the pod first", older)
+		}
+	}
+	// an IP the claim does not hold yet may belong to a pod of another namespace, until it is released
+	var result ctrl.Result
+	if invalid == nil && claim.Status.IP != claim.Spec.IP {
+		owner, err := r.keeper.ClaimOwner(ctx, claim.Namespace, claim.Spec.TargetPod(), claim.Spec.IP)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if owner != "" {
+			reason, invalid = cons.IPClaimReasonConflict, fmt.Errorf("%s is reserved for or assigned to pod %s", claim.Spec.IP, owner)
+			result.RequeueAfter = cons.IPClaimConflictRequeue
+		}
+	}
+	if invalid != nil {
+		if err := r.unreserve(ctx, claim, claim.Status.IP); err != nil {
+			return ctrl.Result{}, err
+		}
+		return result, r.setStatus(ctx, claim, ipamv1alpha1.IPClaimPending, "", metav1.ConditionFalse,
+			reason, invalid.Error())
+	}
+
+	if !controllerutil.ContainsFinalizer(claim, cons.IPClaimFinalizer) {
+		controllerutil.AddFinalizer(claim, cons.IPClaimFinalizer)
+		if err := r.Update(ctx, claim); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// the IP of the claim changed
+	if claim.Status.IP != "" && claim.Status.IP != claim.Spec.IP {
+		if err := r.unreserve(ctx, claim, claim.Status.IP); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	podName := claim.Spec.TargetPod()
+	pod := &v1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: claim.Namespace, Name: podName}, pod)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	running := err == nil && pod.DeletionTimestamp.IsZero()
+	if running && pod.Annotations[cons.IPClaimAnnotation] == claim.Name {
+		if err = r.keeper.UnreserveClaimed(ctx, claim.Spec.IP); err != nil {
+			return ctrl.Result{}, r.failed(ctx, claim, err)
+		}
+		return ctrl.Result{}, r.setStatus(ctx, claim, ipamv1alpha1.IPClaimBound, podName, metav1.ConditionTrue,
+			cons.IPClaimReasonBound, "the IP is assigned to pod "+podName)
+	}
+
+	logger.V(1).Info("reserve claimed IP", "ip", claim.Spec.IP)
+	if err = r.keeper.ReserveClaimed(ctx, claim.Spec.IP); err != nil {
+		return ctrl.Result{}, r.failed(ctx, claim, err)
+	}
+	message := "the IP is reserved until pod " + podName + " is created"
+	if running {
+		message = "pod " + podName + " was created before the claim, recreate it to assign the IP"
+	}
+	return ctrl.Result{}, r.setStatus(ctx, claim, ipamv1alpha1.IPClaimAvailable, "", metav1.ConditionTrue,
+		cons.IPClaimReasonAvailable, message)
+}
+
+// validate checks that the claim names a single pod and an IP of an enabled Calico IPPool
+func validate(claim *ipamv1alpha1.IPClaim, pools *v3.IPPoolList) error {
+	if (claim.Spec.PodName == "") == (claim.Spec.StatefulSet == nil) {
+		return fmt.Errorf("exactly one of podName and statefulSet must be set")
+	}
+	ip := net.ParseIP(claim.Spec.IP)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP", claim.Spec.IP)
+	}
+
+	for _, pool := range pools.Items {
+		if claim.Spec.IPPool != "" && pool.Name != claim.Spec.IPPool {
+			continue
+		}
+		if ipNet := utils.ParseCidr(pool.Spec.CIDR); ipNet != nil && ipNet.Contains(ip) && !pool.Spec.Disabled {
+			return nil
+		}
+	}
+	if claim.Spec.IPPool != "" {
+		return fmt.Errorf("%s is not in the enabled IPPool %s", claim.Spec.IP, claim.Spec.IPPool)
+	}
+	return fmt.Errorf("%s is not in any enabled IPPool", claim.Spec.IP)
+}
+
+// olderClaim returns the name of an older claim of the same IP, or of the same pod, empty if there is none
+func (r *IPClaimReconciler) olderClaim(ctx context.Context, claim *ipamv1alpha1.IPClaim) (string, error) {
+	claims := &ipamv1alpha1.IPClaimList{}
+	if err := r.List(ctx, claims); err != nil {
+		return "", err
+	}
+	for i := range claims.Items {
+		other := &claims.Items[i]
+		if other.UID == claim.UID || !other.DeletionTimestamp.IsZero() {
+			continue
+		}
+		samePod := other.Namespace == claim.Namespace && other.Spec.TargetPod() == claim.Spec.TargetPod()
+		if (other.Spec.IP == claim.Spec.IP || samePod) && older(other, claim) {
+			return other.Namespace + "/" + other.Name, nil
+		}
+	}
+	return "", nil
+}
+
+func older(a, b *ipamv1alpha1.IPClaim) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+}
+
+// unreserve lifts the reservation of an IP of the claim, unless another claim holds it
+func (r *IPClaimReconciler) unreserve(ctx context.Context, claim *ipamv1alpha1.IPClaim, ip string) error {
+	if ip == "" || claim.Status.Phase == ipamv1alpha1.IPClaimPending {
+		return nil
+	}
+	claims := &ipamv1alpha1.IPClaimList{}
+	if err := r.List(ctx, claims); err != nil {
+		return err
+	}
+	for _, other := range claims.Items {
+		if other.UID != claim.UID && other.DeletionTimestamp.IsZero() && other.Spec.IP == ip {
+			return nil
+		}
+	}
+	return r.keeper.UnreserveClaimed(ctx, ip)
+}
+
+func (r *IPClaimReconciler) failed(ctx context.Context, claim *ipamv1alpha1.IPClaim, err error) error {
+	log.FromContext(ctx).Error(err, "update the reservation of the claimed IP failed")
+	if statusErr := r.setStatus(ctx, claim, claim.Status.Phase, claim.Status.BoundPod, metav1.ConditionFalse,
+		cons.IPClaimReasonFailed, err.Error()); statusErr != nil {
+		return statusErr
+	}
+	return err
+}
+
+func (r *IPClaimReconciler) setStatus(ctx context.Context, claim *ipamv1alpha1.IPClaim, phase, boundPod string,
+	status metav1.ConditionStatus, reason, message string) error {
+	claim.Status.Phase = phase
+	claim.Status.BoundPod = boundPod
+	claim.Status.IP = ""
+	if phase != ipamv1alpha1.IPClaimPending {
+		claim.Status.IP = claim.Spec.IP
+	}
+	claim.Status.ObservedGeneration = claim.Generation
+	meta.SetStatusCondition(&claim.Status.Conditions, metav1.Condition{
+		Type:               cons.IPClaimConditionReady,
+		Status:             status,
+		ObservedGeneration: claim.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	return r.Status().Update(ctx, claim)
+}
+
+// claimsOfPod maps a pod to the claims of its namespace targeting it
+func (r *IPClaimReconciler) claimsOfPod(object client.Object) []reconcile.Request {
+	claims := &ipamv1alpha1.IPClaimList{}
+	if err := r.List(context.TODO(), claims, client.InNamespace(object.GetNamespace())); err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, claim := range claims.Items {
+		if claim.Spec.TargetPod() == object.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&claim)})
+		}
+	}
+	return requests
+}
+
+// claimsOfIP maps a claim to the other claims of its IP, which may own the IP once it is deleted
+func (r *IPClaimReconciler) claimsOfIP(object client.Object) []reconcile.Request {
+	claim, ok := object.(*ipamv1alpha1.IPClaim)
+	if !ok {
+		return nil
+	}
+	claims := &ipamv1alpha1.IPClaimList{}
+	if err := r.List(context.TODO(), claims); err != nil {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, other := range claims.Items {
+		if other.UID != claim.UID && other.Spec.IP == claim.Spec.IP {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&other)})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *IPClaimReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ipamv1alpha1.IPClaim{}).
+		Watches(&source.Kind{Type: &ipamv1alpha1.IPClaim{}}, crhandler.EnqueueRequestsFromMapFunc(r.claimsOfIP)).
+		Watches(&source.Kind{Type: &v1.Pod{}}, crhandler.EnqueueRequestsFromMapFunc(r.claimsOfPod)).
+		Complete(r)
+}
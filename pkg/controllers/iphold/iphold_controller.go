@@ -0,0 +1,242 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package ipholdctrl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// IPHoldReconciler reserves the IPs of the pods named by an IPHold until it expires
+type IPHoldReconciler struct {
+	client.Client
+	config *configv1.CapoConfig
+	keeper *handler.IPKeeper
+}
+
+func NewIPHoldReconciler(client client.Client,
+	config *configv1.CapoConfig,
+	keeper *handler.IPKeeper) *IPHoldReconciler {
+	return &IPHoldReconciler{
+		Client: client,
+		config: config,
+		keeper: keeper,
+	}
+}
+
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipholds,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipholds/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=ipam.capo.io,resources=ipholds/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile holds the IPs of the pods of the IPHold until it expires, and releases them when the IPHold is
+// deleted before. The held IPs are asserted again every release period, as the deletion of a pod
+// reserves its IPs for ipReserveTime only.
+func (r *IPHoldReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	hold := &ipamv1alpha1.IPHold{}
+	if err := r.Get(ctx, req.NamespacedName, hold); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	expireTime := hold.CreationTimestamp.Add(hold.Spec.Duration.Duration)
+	// the deadline is compared on the clock the keeper encodes it with
+	now := r.keeper.Clock().Now()
+
+	if !hold.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(hold, cons.IPHoldFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if hold.Status.ExpireTime != nil && now.Before(hold.Status.ExpireTime.Time) {
+			logger.Info("release held IPs", "ips", hold.Status.HeldIPs)
+			if err := r.keeper.Unhold(ctx, hold.Namespace, hold.Status.HeldIPs, hold.Status.ExpireTime.Time); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		controllerutil.RemoveFinalizer(hold, cons.IPHoldFinalizer)
+		return ctrl.Result{}, r.Update(ctx, hold)
+	}
+
+	if err := r.validate(hold); err != nil {
+		return ctrl.Result{}, r.setStatus(ctx, hold, nil, metav1.ConditionFalse, cons.IPHoldReasonInvalid, err.Error())
+	}
+
+	if !now.Before(expireTime) {
+		// the release loop frees the held IPs, nothing is left to release on deletion
+		if controllerutil.ContainsFinalizer(hold, cons.IPHoldFinalizer) {
+			controllerutil.RemoveFinalizer(hold, cons.IPHoldFinalizer)
+			if err := r.Update(ctx, hold); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, r.setStatus(ctx, hold, &expireTime, metav1.ConditionFalse, cons.IPHoldReasonExpired,
+			"the held IPs are released by the release loop")
+	}
+
+	if !controllerutil.ContainsFinalizer(hold, cons.IPHoldFinalizer) {
+		controllerutil.AddFinalizer(hold, cons.IPHoldFinalizer)
+		if err := r.Update(ctx, hold); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	ips, pending, err := r.heldIPs(ctx, hold)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	conflicts, err := r.keeper.Hold(ctx, hold.Namespace, ips, expireTime)
+	if err != nil {
+		logger.Error(err, "hold IPs failed")
+		if statusErr := r.setStatus(ctx, hold, &expireTime, metav1.ConditionFalse, cons.IPHoldReasonFailed, err.Error()); statusErr != nil {
+			return ctrl.Result{}, statusErr
+		}
+		return ctrl.Result{}, err
+	}
+
+	// IPs reserved for other pods are not held by this IPHold
+	hold.Status.HeldIPs = nil
+	for _, ip := range ips {
+		if !contains(conflicts, ip.IP) {
+			hold.Status.HeldIPs = append(hold.Status.HeldIPs, ip)
+		}
+	}
+	status, reason, message := metav1.ConditionTrue, cons.IPHoldReasonHeld, fmt.Sprintf("%d IPs held", len(hold.Status.HeldIPs))
+	if len(conflicts) > 0 {
+		status, reason = metav1.ConditionFalse, cons.IPHoldReasonConflict
+		message = "IPs reserved for other pods: " + strings.Join(conflicts, ",")
+	} else if len(pending) > 0 {
+		status, reason = metav1.ConditionFalse, cons.IPHoldReasonPodsPending
+		message = "pods not found or without IP: " + strings.Join(pending, ",")
+	}
+	if err = r.setStatus(ctx, hold, &expireTime, status, reason, message); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	requeueAfter := expireTime.Sub(now)
+	if requeueAfter > r.config.IPReleasePeriod.Duration {
+		requeueAfter = r.config.IPReleasePeriod.Duration
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+func (r *IPHoldReconciler) validate(hold *ipamv1alpha1.IPHold) error {
+	if len(hold.Spec.PodNames) == 0 && hold.Spec.Selector == nil {
+		return fmt.Errorf("neither podNames nor selector is set")
+	}
+	if hold.Spec.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(hold.Spec.Selector); err != nil {
+			return err
+		}
+	}
+	maxDuration := cons.IPHoldMaxDuration
+	if r.config.IPHoldMaxDuration != nil {
+		maxDuration = r.config.IPHoldMaxDuration.Duration
+	}
+	if hold.Spec.Duration.Duration <= 0 || hold.Spec.Duration.Duration > maxDuration {
+		return fmt.Errorf("duration %s is not in (0, %s]", hold.Spec.Duration.Duration, maxDuration)
+	}
+	return nil
+}
+
+// heldIPs returns the IPs of the pods of the IPHold, along with the IPs held before whose pods are gone,
+// and the named pods not found or without IP
+func (r *IPHoldReconciler) heldIPs(ctx context.Context, hold *ipamv1alpha1.IPHold) ([]ipamv1alpha1.HeldIP, []string, error) {
+	var pods []v1.Pod
+	var pending []string
+	for _, name := range hold.Spec.PodNames {
+		pod := v1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: hold.Namespace, Name: name}, &pod)
+		if errors.IsNotFound(err) {
+			pending = append(pending, name)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(pod.Status.PodIPs) == 0 {
+			pending = append(pending, name)
+		}
+		pods = append(pods, pod)
+	}
+	if hold.Spec.Selector != nil {
+		selector, _ := metav1.LabelSelectorAsSelector(hold.Spec.Selector)
+		podList := &v1.PodList{}
+		if err := r.List(ctx, podList, client.InNamespace(hold.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, nil, err
+		}
+		pods = append(pods, podList.Items...)
+	}
+
+	// only the pods of the namespace of the IPHold are looked up, so the IPs belong to that namespace
+	byIP := map[string]ipamv1alpha1.HeldIP{}
+	for _, held := range hold.Status.HeldIPs {
+		byIP[held.IP] = held
+	}
+	for _, pod := range pods {
+		for _, ip := range pod.Status.PodIPs {
+			byIP[ip.IP] = ipamv1alpha1.HeldIP{IP: ip.IP, Pod: pod.Name, NodeName: pod.Spec.NodeName}
+		}
+	}
+	ips := make([]ipamv1alpha1.HeldIP, 0, len(byIP))
+	for _, held := range byIP {
+		ips = append(ips, held)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].IP < ips[j].IP
+	})
+	return ips, pending, nil
+}
+
+func (r *IPHoldReconciler) setStatus(ctx context.Context, hold *ipamv1alpha1.IPHold, expireTime *time.Time,
+	status metav1.ConditionStatus, reason, message string) error {
+	if expireTime != nil {
+		hold.Status.ExpireTime = &metav1.Time{Time: *expireTime}
+	}
+	hold.Status.ObservedGeneration = hold.Generation
+	meta.SetStatusCondition(&hold.Status.Conditions, metav1.Condition{
+		Type:               cons.IPHoldConditionHeld,
+		Status:             status,
+		ObservedGeneration: hold.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	return r.Status().Update(ctx, hold)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *IPHoldReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// the status updates of the reconciler do not trigger it again, held IPs are asserted on requeue
+		For(&ipamv1alpha1.IPHold{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
@@ -12,6 +12,7 @@ import (
 	cons "github.com/xdfdotcn/capo/pkg/constants"
 	"github.com/xdfdotcn/capo/pkg/handler"
 	"github.com/xdfdotcn/capo/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -67,12 +68,18 @@ func (r *IPReservationReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *IPReservationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	var reservation client.Object = &v3.IPReservation{}
+	name := cons.IPReservationName
+	if r.config.ShadowMode {
+		// the shadow reservation is a ConfigMap, the IPReservation may not exist
+		reservation, name = &v1.ConfigMap{}, cons.ShadowReservationName
+	}
 	predicate := predicate.Funcs{
 		// The synchronization process is performed only once at startup and is triggered
 		// by scheduled tasks thereafter, avoiding the triggering of update events
 		CreateFunc: func(e event.CreateEvent) bool {
 			//  that only handles one IPReservation reconciler
-			return cons.IPReservationName == e.Object.GetName()
+			return name == e.Object.GetName()
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			return false
@@ -83,7 +90,7 @@ func (r *IPReservationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}
 	return ctrl.NewControllerManagedBy(mgr).
 		// Uncomment the following line adding a pointer to an instance of the controlled resource as an argument
-		For(&v3.IPReservation{}).
+		For(reservation).
 		WithEventFilter(predicate).
 		Complete(r)
 }
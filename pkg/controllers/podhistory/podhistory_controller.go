@@ -0,0 +1,76 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package podhistoryctrl
+
+import (
+	"context"
+
+	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/history"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// PodHistoryReconciler records the IP assignments and deletions of pods in the ownership history
+type PodHistoryReconciler struct {
+	client.Client
+	keeper *handler.IPKeeper
+	ledger *history.Ledger
+}
+
+func NewPodHistoryReconciler(client client.Client,
+	keeper *handler.IPKeeper,
+	ledger *history.Ledger) *PodHistoryReconciler {
+	return &PodHistoryReconciler{
+		Client: client,
+		keeper: keeper,
+		ledger: ledger,
+	}
+}
+
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile records the IPs of an existing pod as assigned, and a gone or terminating pod as deleted.
+// The times are taken from the keeper clock, the one the reservations and releases are recorded at.
+func (r *PodHistoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	pod := &v1.Pod{}
+	err := r.Get(ctx, req.NamespacedName, pod)
+	if errors.IsNotFound(err) {
+		logger.V(1).Info("pod deleted", "req", req.String())
+		r.ledger.Deleted(req.Namespace, req.Name, r.keeper.Clock().Now())
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(pod.Status.PodIPs) > 0 {
+		r.ledger.Assigned(pod, r.keeper.Clock().Now())
+	}
+	if pod.DeletionTimestamp != nil {
+		r.ledger.Deleted(pod.Namespace, pod.Name, pod.DeletionTimestamp.Time)
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodHistoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// only the pods capo may reserve IPs for are worth a place in the bounded history
+	selected := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		pod, ok := object.(*v1.Pod)
+		return ok && r.keeper.Selects(pod)
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("podhistory").
+		For(&v1.Pod{}).
+		WithEventFilter(selected).
+		Complete(r)
+}
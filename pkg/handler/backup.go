@@ -0,0 +1,229 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// Backup is the reservation state written by capo export and restored by capo import
+type Backup struct {
+	// APIVersion is the version of the format, BackupAPIVersion
+	APIVersion string    `json:"apiVersion"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// Reservations are the reserved IPs with their pod info, sorted by IP
+	Reservations []Reservation `json:"reservations"`
+}
+
+// Reservation is a reserved IP with the pod it was reserved for
+type Reservation struct {
+	IP        string `json:"ip"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Node      string `json:"node"`
+	// Owner is the top-level owner of the pod, Kind.group/name
+	Owner string `json:"owner,omitempty"`
+	// ReservedAt is kept by the import, so that the IP is released when it would have been
+	ReservedAt time.Time `json:"reservedAt"`
+}
+
+// ImportReport lists the reservations imported and those skipped with the reason
+type ImportReport struct {
+	DryRun   bool         `json:"dryRun,omitempty"`
+	Imported []string     `json:"imported"`
+	Skipped  []ImportSkip `json:"skipped"`
+}
+
+// ImportSkip is a reservation left out of an import
+type ImportSkip struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// Export returns every IP reserved with a pod info. The IPs reserved without pod info are left to the drift check.
+func (r *IPKeeper) Export(ctx context.Context) (*Backup, error) {
+	if !r.Initialized() {
+		return nil, errNotInitialized
+	}
+	ipReservation, podIPMap, err := r.getResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &Backup{APIVersion: cons.BackupAPIVersion, ExportedAt: r.clock.Now().UTC(), Reservations: []Reservation{}}
+	for podIP, value := range podIPMap.Data {
+		ip := net.ParseIP(podIP)
+		info, _, err := parsePodInfo(value)
+		if ip == nil || err != nil || !reservationCovers(ipReservation, ip) {
+			continue
+		}
+		reservedAt, _ := info.reservedTime()
+		backup.Reservations = append(backup.Reservations, Reservation{
+			IP:         podIP,
+			Namespace:  info.Namespace,
+			Pod:        info.Name,
+			Node:       info.Node,
+			Owner:      info.Owner,
+			ReservedAt: reservedAt,
+		})
+	}
+	sort.Slice(backup.Reservations, func(i, j int) bool {
+		return cidrLess(backup.Reservations[i].IP, backup.Reservations[j].IP)
+	})
+	return backup, nil
+}
+
+// Import reserves the IPs of the backup again with their pod info. An IP is skipped when it is malformed, outside
+// of every Calico IPPool, used by a live pod, or reserved already. dryRun only reports what would be imported.
+func (r *IPKeeper) Import(ctx context.Context, backup *Backup, dryRun bool) (*ImportReport, error) {
+	if !r.Initialized() {
+		return nil, errNotInitialized
+	}
+	if backup.APIVersion != cons.BackupAPIVersion {
+		return nil, fmt.Errorf("unsupported backup apiVersion %q, expected %q", backup.APIVersion, cons.BackupAPIVersion)
+	}
+
+	pools := &v3.IPPoolList{}
+	if err := kubeCall(ctx, "IPPool list", func(ctx context.Context) error {
+		return r.client.List(ctx, pools)
+	}); err != nil {
+		return nil, err
+	}
+	pods := &v1.PodList{}
+	if err := kubeCall(ctx, "Pod list", func(ctx context.Context) error {
+		return r.client.List(ctx, pods)
+	}); err != nil {
+		return nil, err
+	}
+	inUse := map[string]string{}
+	for _, pod := range pods.Items {
+		for _, ip := range pod.Status.PodIPs {
+			inUse[ip.IP] = pod.Namespace + "/" + pod.Name
+		}
+	}
+	_, podIPMap, err := r.getResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: dryRun, Imported: []string{}, Skipped: []ImportSkip{}}
+	podInfos := map[string]string{}
+	var ips []string
+	for _, reservation := range backup.Reservations {
+		ip := net.ParseIP(reservation.IP)
+		reason := ""
+		switch {
+		case ip == nil:
+			reason = "not an IP"
+		case reservation.Namespace == "" || reservation.Pod == "":
+			reason = "no pod"
+		case !inPoolCIDRs(pools, ip):
+			reason = "in no IPPool"
+		case inUse[ip.String()] != "":
+			reason = "in use by pod " + inUse[ip.String()]
+		case podIPMap.Data[ip.String()] != "":
+			reason = "reserved already"
+		case podInfos[ip.String()] != "":
+			reason = "duplicated"
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, ImportSkip{IP: reservation.IP, Reason: reason})
+			continue
+		}
+		podInfos[ip.String()] = withOwner(buildPodInfo(reservation.Namespace, reservation.Pod, reservation.Node,
+			reservation.ReservedAt), reservation.Owner)
+		ips = append(ips, ip.String())
+		report.Imported = append(report.Imported, ip.String())
+	}
+	if dryRun || len(ips) == 0 {
+		return report, nil
+	}
+	if err = r.writeReservation(ctx, podInfos, ips); err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("reservations imported", "imported", len(report.Imported), "skipped", len(report.Skipped))
+	return report, nil
+}
+
+// inPoolCIDRs reports whether ip is in the CIDR of any IPPool, disabled or not
+func inPoolCIDRs(pools *v3.IPPoolList, ip net.IP) bool {
+	for _, pool := range pools.Items {
+		if ipNet := utils.ParseCidr(pool.Spec.CIDR); ipNet != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type backupHandler struct {
+	keeper *IPKeeper
+}
+
+// NewBackupHandler serves the export of the reservations on GET, and imports the JSON or YAML backup
+// posted, with the dryRun query parameter for a dry run, when backupImport is set
+func NewBackupHandler(keeper *IPKeeper) http.Handler {
+	return &backupHandler{keeper: keeper}
+}
+
+func (h *backupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var (
+		out interface{}
+		err error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		out, err = h.keeper.Export(req.Context())
+	case http.MethodPost:
+		if !h.keeper.config.BackupImport {
+			http.Error(w, "import is disabled, set backupImport in the capo config", http.StatusForbidden)
+			return
+		}
+		var body []byte
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, cons.BackupMaxBytes)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		backup := &Backup{}
+		// YAML is a superset of JSON
+		if err = yaml.Unmarshal(body, backup); err != nil {
+			http.Error(w, fmt.Sprintf("invalid backup: %v", err), http.StatusBadRequest)
+			return
+		}
+		if backup.APIVersion != cons.BackupAPIVersion {
+			http.Error(w, fmt.Sprintf("unsupported backup apiVersion %q", backup.APIVersion), http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(req.URL.Query().Get(cons.BackupDryRunParam))
+		out, err = h.keeper.Import(req.Context(), backup, dryRun)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == errNotInitialized {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+func newBackupKeeper(t *testing.T, objs ...client.Object) (*IPKeeper, client.Client) {
+	return newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		BackupImport:      true,
+	}, objs...)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	reserved := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	source, _ := newBackupKeeper(t)
+	assert.NoError(t, source.writeReservation(ctx, map[string]string{
+		"10.0.1.2": withOwner(buildPodInfo("redis", "redis-1", "node01", reserved), "StatefulSet.apps/redis"),
+		"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", reserved),
+		"10.0.2.1": buildPodInfo("redis", "redis-2", "node02", reserved),
+		"10.0.1.3": buildPodInfo("redis", "redis-3", "node02", reserved),
+		"10.0.1.4": buildPodInfo("redis", "redis-4", "node02", reserved),
+	}, []string{"10.0.1.2", "10.0.1.1", "10.0.2.1", "10.0.1.3", "10.0.1.4"}))
+
+	backup, err := source.Export(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, cons.BackupAPIVersion, backup.APIVersion)
+	assert.Len(t, backup.Reservations, 5)
+	assert.Equal(t, Reservation{IP: "10.0.1.1", Namespace: "redis", Pod: "redis-0", Node: "node01", ReservedAt: reserved},
+		backup.Reservations[0])
+	assert.Equal(t, "StatefulSet.apps/redis", backup.Reservations[1].Owner)
+
+	// the backup survives a round trip through YAML
+	out, err := yaml.Marshal(backup)
+	assert.NoError(t, err)
+	restored := &Backup{}
+	assert.NoError(t, yaml.Unmarshal(out, restored))
+	assert.Equal(t, backup.Reservations, restored.Reservations)
+
+	target, c := newBackupKeeper(t,
+		&v3.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "redis"}, Spec: v3.IPPoolSpec{CIDR: "10.0.1.0/24"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: "kafka-0"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.3"}}},
+		})
+	assert.NoError(t, target.writeReservation(ctx, map[string]string{
+		"10.0.1.4": buildPodInfo("redis", "redis-4", "node02", time.Now()),
+	}, []string{"10.0.1.4"}))
+
+	report, err := target.Import(ctx, restored, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, report.Imported)
+	assert.Equal(t, []ImportSkip{
+		{IP: "10.0.1.3", Reason: "in use by pod kafka/kafka-0"},
+		{IP: "10.0.1.4", Reason: "reserved already"},
+		{IP: "10.0.2.1", Reason: "in no IPPool"},
+	}, report.Skipped)
+	// a dry run writes nothing
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.NotContains(t, podIPMap.Data, "10.0.1.1")
+
+	report, err = target.Import(ctx, restored, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, report.Imported)
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	info, _, err := parsePodInfo(podIPMap.Data["10.0.1.2"])
+	assert.NoError(t, err)
+	assert.Equal(t, "StatefulSet.apps/redis", info.Owner)
+	assert.Equal(t, reserved.Format(time.RFC3339), info.Reserved)
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.4"} {
+		assert.True(t, reservationCovers(ipReservation, net.ParseIP(ip)), ip)
+	}
+
+	_, err = target.Import(ctx, &Backup{APIVersion: "capo.io/v0"}, false)
+	assert.Error(t, err)
+}
+
+func TestBackupHandler(t *testing.T) {
+	keeper, _ := newBackupKeeper(t,
+		&v3.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "redis"}, Spec: v3.IPPoolSpec{CIDR: "10.0.1.0/24"}})
+	h := NewBackupHandler(keeper)
+
+	body := "apiVersion: " + cons.BackupAPIVersion + "\nreservations:\n- ip: 10.0.1.1\n  namespace: redis\n  pod: redis-0\n" +
+		"  node: node01\n  reservedAt: \"2022-06-01T00:00:00Z\"\n"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, cons.BackupPath+"?dryRun=true", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	report := &ImportReport{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), report))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []string{"10.0.1.1"}, report.Imported)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, cons.BackupPath, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	backup := &Backup{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), backup))
+	assert.Empty(t, backup.Reservations)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, cons.BackupPath, bytes.NewBufferString("{")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, cons.BackupPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// only the export is served unless backupImport is set
+	keeper.config.BackupImport = false
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, cons.BackupPath, bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
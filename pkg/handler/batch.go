@@ -0,0 +1,137 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// reserveWrite is a reservation waiting for its batch to be written
+type reserveWrite struct {
+	podInfos map[string]string
+	ips      []string
+	done     chan error
+	// the logger and the span of the webhook request
+	logger logr.Logger
+	span   trace.SpanContext
+}
+
+// reserveBatcher coalesces the reservations arriving within a window into a single ConfigMap update and a single
+// IPReservation update, so that the mass deletions of a dead node or a deleted StatefulSet do not issue two
+// conflicting updates per pod. Every reservation is answered once its batch is written.
+type reserveBatcher struct {
+	window  time.Duration
+	maxSize int
+	write   func(ctx context.Context, podInfos map[string]string, ips []string) error
+
+	mu      sync.Mutex
+	pending []*reserveWrite
+	timer   *time.Timer
+}
+
+func newReserveBatcher(window *metav1.Duration, write func(ctx context.Context, podInfos map[string]string, ips []string) error) *reserveBatcher {
+	if window == nil || window.Duration <= 0 {
+		return nil
+	}
+	return &reserveBatcher{window: window.Duration, maxSize: cons.ReserveBatchMaxSize, write: write}
+}
+
+// submit queues the pod info of the IPs and waits until they are written, or ctx is done
+func (b *reserveBatcher) submit(ctx context.Context, podInfos map[string]string, ips []string) error {
+	w := &reserveWrite{podInfos: podInfos, ips: ips, done: make(chan error, 1),
+		logger: log.FromContext(ctx), span: trace.SpanContextFromContext(ctx)}
+	b.mu.Lock()
+	b.pending = append(b.pending, w)
+	if len(b.pending) >= b.maxSize {
+		batch := b.take()
+		b.mu.Unlock()
+		go b.flush(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flushPending)
+		}
+		b.mu.Unlock()
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take returns the pending reservations as a batch, mu must be held
+func (b *reserveBatcher) take() []*reserveWrite {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+func (b *reserveBatcher) flushPending() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.flush(batch)
+}
+
+// flush writes the batch and answers its reservations. The write does not depend on the context of any
+// reservation, a reservation given up still completes the batch of the others. It is traced and logged
+// within the request of the first reservation, and its span links the requests of the others.
+func (b *reserveBatcher) flush(batch []*reserveWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	podInfos := map[string]string{}
+	var ips []string
+	seen := map[string]bool{}
+	for _, w := range batch {
+		for ip, podInfo := range w.podInfos {
+			podInfos[ip] = podInfo
+		}
+		for _, ip := range w.ips {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	metrics.ReserveBatchSize.Observe(float64(len(batch)))
+
+	first := batch[0]
+	links := make([]trace.Link, 0, len(batch)-1)
+	for _, w := range batch[1:] {
+		if w.span.IsValid() {
+			links = append(links, trace.Link{SpanContext: w.span})
+		}
+	}
+	ctx := log.IntoContext(context.Background(), first.logger.WithValues("batch", len(batch)))
+	ctx = trace.ContextWithSpanContext(ctx, first.span)
+	ctx, span := tracing.Tracer().Start(ctx, "reserveBatcher.flush", trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("batch", len(batch)), tracing.AttrIP.StringSlice(ips)))
+	ctx, cancel := context.WithTimeout(ctx, cons.ReserveBatchTimeout)
+	defer cancel()
+	err := b.write(ctx, podInfos, ips)
+	tracing.RecordError(span, err)
+	span.End()
+	for _, w := range batch {
+		w.done <- err
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// recordingWriter records the batches written
+type recordingWriter struct {
+	mu      sync.Mutex
+	err     error
+	batches []map[string]string
+	ips     [][]string
+}
+
+func (w *recordingWriter) write(_ context.Context, podInfos map[string]string, ips []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, podInfos)
+	w.ips = append(w.ips, ips)
+	return w.err
+}
+
+func submitAll(b *reserveBatcher, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			errs[i] = b.submit(context.Background(), map[string]string{ip: "info"}, []string{ip})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestReserveBatcher(t *testing.T) {
+	assert.Nil(t, newReserveBatcher(nil, nil))
+	assert.Nil(t, newReserveBatcher(&metav1.Duration{}, nil))
+
+	w := &recordingWriter{}
+	b := newReserveBatcher(&metav1.Duration{Duration: 50 * time.Millisecond}, w.write)
+	for _, err := range submitAll(b, 20) {
+		assert.NoError(t, err)
+	}
+	// one write for the whole batch
+	assert.Len(t, w.batches, 1)
+	assert.Len(t, w.batches[0], 20)
+	assert.Len(t, w.ips[0], 20)
+
+	// every reservation of the batch gets the error
+	w = &recordingWriter{err: fmt.Errorf("conflict")}
+	b = newReserveBatcher(&metav1.Duration{Duration: 50 * time.Millisecond}, w.write)
+	for _, err := range submitAll(b, 3) {
+		assert.EqualError(t, err, "conflict")
+	}
+
+	// a full batch is written at once
+	w = &recordingWriter{}
+	b = newReserveBatcher(&metav1.Duration{Duration: time.Hour}, w.write)
+	b.maxSize = 5
+	for _, err := range submitAll(b, 10) {
+		assert.NoError(t, err)
+	}
+	assert.Len(t, w.batches, 2)
+
+	// a reservation given up leaves the batch to the others
+	w = &recordingWriter{}
+	b = newReserveBatcher(&metav1.Duration{Duration: 50 * time.Millisecond}, w.write)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, b.submit(ctx, map[string]string{"10.0.1.1": "info"}, []string{"10.0.1.1"}), context.Canceled)
+	assert.NoError(t, b.submit(context.Background(), map[string]string{"10.0.1.2": "info"}, []string{"10.0.1.2"}))
+	assert.Len(t, w.batches, 1)
+	assert.Len(t, w.batches[0], 2)
+}
+
+func TestReserveBatcherContext(t *testing.T) {
+	first := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}, TraceFlags: trace.FlagsSampled})
+	var (
+		span   trace.SpanContext
+		logged []string
+	)
+	b := newReserveBatcher(&metav1.Duration{Duration: time.Hour}, func(ctx context.Context, _ map[string]string, _ []string) error {
+		span = trace.SpanContextFromContext(ctx)
+		log.FromContext(ctx).Info("write")
+		return nil
+	})
+	b.maxSize = 1
+
+	// the batch is written within the trace and with the logger of the request
+	logger := funcr.New(func(prefix, args string) { logged = append(logged, args) }, funcr.Options{})
+	ctx := log.IntoContext(trace.ContextWithSpanContext(context.Background(), first), logger.WithValues("pod", "redis-0"))
+	assert.NoError(t, b.submit(ctx, map[string]string{"10.0.1.1": "info"}, []string{"10.0.1.1"}))
+	assert.Equal(t, first.TraceID(), span.TraceID())
+	assert.Equal(t, []string{`"level"=0 "msg"="write" "pod"="redis-0" "batch"=1`}, logged)
+}
+
+func TestIpReserveBatched(t *testing.T) {
+	objs := []client.Object{
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "redis", Labels: map[string]string{"ip-reserve": "enabled"}}},
+	}
+	for i := 0; i < 10; i++ {
+		objs = append(objs, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: fmt.Sprintf("redis-%d", i), Labels: map[string]string{"app": "redis"}},
+			Spec:       v1.PodSpec{NodeName: "node01"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: fmt.Sprintf("10.0.3.%d", i)}}},
+		})
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:      metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount:  pointer.Int(200),
+		ReserveBatchWindow: &metav1.Duration{Duration: 20 * time.Millisecond},
+		PodSelectors:       []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}}},
+	}, objs...)
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, keeper.IpReserve(ctx, utils.CreateLogger(true, true), "redis", fmt.Sprintf("redis-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	for i := 0; i < 10; i++ {
+		ip := fmt.Sprintf("10.0.3.%d", i)
+		assert.Contains(t, podIPMap.Data, ip)
+		assert.Contains(t, ipReservation.Spec.ReservedCIDRs, ip)
+	}
+}
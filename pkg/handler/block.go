@@ -0,0 +1,243 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+//+kubebuilder:rbac:groups=crd.projectcalico.org,resources=ipamblocks;blockaffinities,verbs=list
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+
+var (
+	ipamBlockListGVK     = schema.GroupVersionKind{Group: "crd.projectcalico.org", Version: "v1", Kind: "IPAMBlockList"}
+	blockAffinityListGVK = schema.GroupVersionKind{Group: "crd.projectcalico.org", Version: "v1", Kind: "BlockAffinityList"}
+)
+
+// ipamBlock is a Calico IPAM block with the node it is affine to
+type ipamBlock struct {
+	cidr *net.IPNet
+	// affine node, empty for a block without affinity
+	node string
+	// the node is not in the cluster anymore
+	nodeGone bool
+	// IPs allocated to workloads, the reserved IPs are not allocated
+	allocated int
+}
+
+// blockCache keeps the IPAM blocks, listed at most every IPAMBlockRefreshPeriod
+type blockCache struct {
+	mu        sync.RWMutex
+	refreshed time.Time
+	blocks    []ipamBlock
+}
+
+func (r *IPKeeper) blocksEnabled() bool {
+	return r.config.IPAMBlocks != nil && r.config.IPAMBlocks.Enabled
+}
+
+// blockPolicy reports whether the reservations are released block by block
+func (r *IPKeeper) blockPolicy() bool {
+	return r.blocksEnabled() && r.config.IPAMBlocks.ReleasePolicy == cons.BlockReleasePolicyBlock
+}
+
+// refreshBlocks lists the IPAM blocks, their affinities and the nodes again once the cache is stale.
+// The stale blocks are kept when the listing fails.
+func (r *IPKeeper) refreshBlocks(ctx context.Context) error {
+	if !r.blocksEnabled() {
+		return nil
+	}
+	r.blocks.mu.RLock()
+	fresh := r.clock.Since(r.blocks.refreshed) < cons.IPAMBlockRefreshPeriod
+	r.blocks.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	blockList := &unstructured.UnstructuredList{}
+	blockList.SetGroupVersionKind(ipamBlockListGVK)
+	if err := kubeCall(ctx, "IPAMBlock list", func(ctx context.Context) error {
+		return r.client.List(ctx, blockList)
+	}); err != nil {
+		return err
+	}
+	affinityList := &unstructured.UnstructuredList{}
+	affinityList.SetGroupVersionKind(blockAffinityListGVK)
+	if err := kubeCall(ctx, "BlockAffinity list", func(ctx context.Context) error {
+		return r.client.List(ctx, affinityList)
+	}); err != nil {
+		return err
+	}
+	nodeList := &metav1.PartialObjectMetadataList{}
+	nodeList.SetGroupVersionKind(v1.SchemeGroupVersion.WithKind("NodeList"))
+	if err := kubeCall(ctx, "Node list", func(ctx context.Context) error {
+		return r.client.List(ctx, nodeList)
+	}); err != nil {
+		return err
+	}
+
+	blocks := parseBlocks(blockList, affinityList, nodeList)
+	r.blocks.mu.Lock()
+	r.blocks.blocks = blocks
+	r.blocks.refreshed = r.clock.Now()
+	r.blocks.mu.Unlock()
+	return nil
+}
+
+// parseBlocks returns the blocks with their affine node: the node of the confirmed BlockAffinity of
+// the block, else the affinity recorded in the block
+func parseBlocks(blockList, affinityList *unstructured.UnstructuredList, nodeList *metav1.PartialObjectMetadataList) []ipamBlock {
+	nodes := map[string]bool{}
+	for _, node := range nodeList.Items {
+		nodes[node.Name] = true
+	}
+	affinities := map[string]string{}
+	for _, affinity := range affinityList.Items {
+		cidr, _, _ := unstructured.NestedString(affinity.Object, "spec", "cidr")
+		node, _, _ := unstructured.NestedString(affinity.Object, "spec", "node")
+		state, _, _ := unstructured.NestedString(affinity.Object, "spec", "state")
+		deleted, _, _ := unstructured.NestedString(affinity.Object, "spec", "deleted")
+		if state == cons.BlockAffinityConfirmed && deleted != "true" {
+			affinities[cidr] = node
+		}
+	}
+
+	var blocks []ipamBlock
+	for _, item := range blockList.Items {
+		cidr, _, _ := unstructured.NestedString(item.Object, "spec", "cidr")
+		ipNet := utils.ParseCidr(cidr)
+		if ipNet == nil {
+			continue
+		}
+		block := ipamBlock{cidr: ipNet, node: affinities[cidr]}
+		if block.node == "" {
+			affinity, _, _ := unstructured.NestedString(item.Object, "spec", "affinity")
+			block.node = strings.TrimPrefix(affinity, cons.BlockAffinityHostPrefix)
+			if block.node == affinity {
+				block.node = ""
+			}
+		}
+		block.nodeGone = block.node != "" && !nodes[block.node]
+		allocations, _, _ := unstructured.NestedSlice(item.Object, "spec", "allocations")
+		for _, allocation := range allocations {
+			if allocation != nil {
+				block.allocated++
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// blockOf returns the cached block of the IP, nil when it is in no known block
+func (r *IPKeeper) blockOf(ip string) *ipamBlock {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	r.blocks.mu.RLock()
+	defer r.blocks.mu.RUnlock()
+	for i := range r.blocks.blocks {
+		if r.blocks.blocks[i].cidr.Contains(parsed) {
+			block := r.blocks.blocks[i]
+			return &block
+		}
+	}
+	return nil
+}
+
+// recordBlocks records the block and the affine node of the IPs in their pod infos
+func (r *IPKeeper) recordBlocks(ctx context.Context, podInfos map[string]string, logger logr.Logger) {
+	if !r.blocksEnabled() {
+		return
+	}
+	if err := r.refreshBlocks(ctx); err != nil {
+		logger.V(1).Info("refresh IPAM blocks failed", "err", err.Error())
+	}
+	for ip, value := range podInfos {
+		block := r.blockOf(ip)
+		if block == nil {
+			continue
+		}
+		info, _, err := parsePodInfo(value)
+		if err != nil {
+			continue
+		}
+		info.Block, info.BlockNode = block.cidr.String(), block.node
+		podInfos[ip] = info.String()
+		logger.Info("Pod", "msg", "ip reserved in block", "ip", ip, "block", info.Block, "blockNode", info.BlockNode)
+	}
+}
+
+// applyBlockPolicy releases the reservations block by block. Every reservation of a block whose affine node
+// is gone and with no IP allocated anymore is released at once, so that Calico may free the block and affine
+// it to another node. An expired IP waits for the other reservations of its block to expire too, at most
+// another reserve time of its pool. It returns the reservations of the orphaned blocks, and the expired and remaining
+// reservations left.
+func (r *IPKeeper) applyBlockPolicy(expiredIPs, remainingIPs []podIPDuration) (orphaned, expired, remaining []podIPDuration) {
+	if !r.blockPolicy() {
+		return nil, expiredIPs, remainingIPs
+	}
+	// blocks with reservations not expired yet
+	pendingBlocks := map[string]bool{}
+	for _, item := range remainingIPs {
+		block := r.blockOf(item.podIP)
+		switch {
+		case block == nil:
+			remaining = append(remaining, item)
+		case block.nodeGone && block.allocated == 0:
+			orphaned = append(orphaned, item)
+		default:
+			pendingBlocks[block.cidr.String()] = true
+			remaining = append(remaining, item)
+		}
+	}
+	for _, item := range expiredIPs {
+		maxDelay := 2 * r.reserveTime(item.podIP)
+		block := r.blockOf(item.podIP)
+		switch {
+		case block == nil:
+			expired = append(expired, item)
+		case block.nodeGone && block.allocated == 0:
+			orphaned = append(orphaned, item)
+		case pendingBlocks[block.cidr.String()] && item.duration < maxDelay:
+			remaining = append(remaining, item)
+		default:
+			expired = append(expired, item)
+		}
+	}
+	return orphaned, expired, remaining
+}
+
+// setBlockMetrics counts the reserved IPs by block and affine node
+func (r *IPKeeper) setBlockMetrics(podIPMap *v1.ConfigMap) {
+	metrics.IPReserveHeldByBlock.Reset()
+	if !r.blocksEnabled() {
+		return
+	}
+	type blockKey struct{ cidr, node string }
+	byBlock := map[blockKey]int{}
+	for podIP := range podIPMap.Data {
+		if block := r.blockOf(podIP); block != nil {
+			byBlock[blockKey{block.cidr.String(), block.node}]++
+		}
+	}
+	for key, count := range byBlock {
+		metrics.IPReserveHeldByBlock.WithLabelValues(key.cidr, key.node).Set(float64(count))
+	}
+}
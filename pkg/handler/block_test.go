@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/pointer"
+)
+
+func newIPAMBlock(name, cidr, affinity string, allocations ...interface{}) *unstructured.Unstructured {
+	block := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"cidr":        cidr,
+			"affinity":    affinity,
+			"allocations": allocations,
+		},
+	}}
+	block.SetGroupVersionKind(ipamBlockListGVK.GroupVersion().WithKind("IPAMBlock"))
+	return block
+}
+
+func newBlockAffinity(name, cidr, node, state string) *unstructured.Unstructured {
+	affinity := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"cidr":    cidr,
+			"node":    node,
+			"state":   state,
+			"deleted": "false",
+		},
+	}}
+	affinity.SetGroupVersionKind(blockAffinityListGVK.GroupVersion().WithKind("BlockAffinity"))
+	return affinity
+}
+
+func TestIpReleaseBlockPolicy(t *testing.T) {
+	keeper, _ := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(10),
+		IPAMBlocks:        &configv1.IPAMBlocksConfig{Enabled: true, ReleasePolicy: cons.BlockReleasePolicyBlock},
+		ReleaseRateLimit:  &configv1.ReleaseRateLimit{MaxReleases: 3, Interval: metav1.Duration{Duration: 10 * time.Minute}},
+	},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node01"}},
+		// node01 holds its block, node02 is gone and its block has no IP allocated anymore
+		newIPAMBlock("10-0-1-0-26", "10.0.1.0/26", "host:node01", nil, int64(1)),
+		newBlockAffinity("node01-10-0-1-0-26", "10.0.1.0/26", "node01", cons.BlockAffinityConfirmed),
+		newIPAMBlock("10-0-2-0-26", "10.0.2.0/26", "host:node02", nil, nil),
+		// the affinity of the block of node03 is pending, the block records node01
+		newIPAMBlock("10-0-3-0-26", "10.0.3.0/26", "host:node01", int64(0)),
+		newBlockAffinity("node03-10-0-3-0-26", "10.0.3.0/26", "node03", "pending"),
+	)
+	assert.NoError(t, keeper.refreshBlocks(context.Background()))
+
+	block := keeper.blockOf("10.0.1.5")
+	assert.Equal(t, "10.0.1.0/26", block.cidr.String())
+	assert.Equal(t, "node01", block.node)
+	assert.False(t, block.nodeGone)
+	assert.Equal(t, 1, block.allocated)
+	block = keeper.blockOf("10.0.2.5")
+	assert.Equal(t, "node02", block.node)
+	assert.True(t, block.nodeGone)
+	assert.Equal(t, "node01", keeper.blockOf("10.0.3.5").node)
+	assert.Nil(t, keeper.blockOf("10.0.9.5"))
+
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		// an expired IP waits for the other reservation of its block
+		"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", now.Add(-45*time.Minute)),
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", now),
+		// at most another ipReserveTime
+		"10.0.3.1": buildPodInfo("redis", "redis-2", "node01", now.Add(-2*time.Hour)),
+		"10.0.3.2": buildPodInfo("redis", "redis-3", "node01", now),
+		// the block of a gone node is released first, within the windows and the rate limit
+		"10.0.2.1": buildPodInfo("redis", "redis-4", "node02", now),
+		"10.0.2.2": buildPodInfo("redis", "redis-5", "node02", now),
+		// outside of the known blocks every IP is on its own
+		"10.0.9.1": buildPodInfo("redis", "redis-6", "node01", now.Add(-time.Hour)),
+	}}
+	releaseIPs, expired := getReleaseIPs(podIPMap, utils.CreateLogger(true, true), keeper, now)
+	assert.ElementsMatch(t, []string{"10.0.2.1", "10.0.2.2", "10.0.3.1"}, releaseIPs)
+	assert.Equal(t, 3, expired)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReleasePending.WithLabelValues(cons.ReleasePendingRateLimit)))
+
+	keeper.setBlockMetrics(podIPMap)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.IPReserveHeldByBlock.WithLabelValues("10.0.1.0/26", "node01")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveHeldByBlock.WithLabelValues("10.0.3.0/26", "node01")))
+}
+
+func TestIpReserveRecordsBlock(t *testing.T) {
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(10),
+		IPAMBlocks:        &configv1.IPAMBlocksConfig{Enabled: true},
+		PodSelectors:      []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}}},
+	},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node01"}},
+		newIPAMBlock("10-0-1-0-26", "10.0.1.0/26", "host:node01", int64(0)),
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "redis", Labels: map[string]string{"ip-reserve": "enabled"}}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: "redis-0", Labels: map[string]string{"app": "redis"}},
+			Spec:       v1.PodSpec{NodeName: "node02"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.1"}, {IP: "10.0.9.1"}}},
+		},
+	)
+	ctx := context.Background()
+	assert.NoError(t, keeper.IpReserve(ctx, utils.CreateLogger(true, true), "redis", "redis-0"))
+
+	// the block affine to node01, whatever the node of the pod
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	info, _, err := parsePodInfo(podIPMap.Data["10.0.1.1"])
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.0/26", info.Block)
+	assert.Equal(t, "node01", info.BlockNode)
+	info, _, err = parsePodInfo(podIPMap.Data["10.0.9.1"])
+	assert.NoError(t, err)
+	assert.Empty(t, info.Block)
+}
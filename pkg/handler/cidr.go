@@ -0,0 +1,209 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+)
+
+// compactedCIDRs returns the aggregates capo wrote into the IPReservation, recorded in its compacted annotation
+func compactedCIDRs(ipReservation *v3.IPReservation) map[string]bool {
+	compacted := map[string]bool{}
+	for _, cidr := range strings.Split(ipReservation.Annotations[cons.CompactedAnnotation], ",") {
+		if ipNet := utils.ParseCidr(strings.TrimSpace(cidr)); ipNet != nil {
+			compacted[ipNet.String()] = true
+		}
+	}
+	return compacted
+}
+
+// compactCIDRs removes releaseIPs from the reserved CIDRs and merges the capo-owned entries, the single IPs and the
+// compacted aggregates, into the smallest set of CIDRs. Other entries, such as ranges reserved by hand, are kept
+// as they are and only removed when released as a whole. It returns the CIDRs sorted numerically, the aggregates
+// of more than one IP among them, and the number of reserved IPs, the system reserved IP aside.
+func compactCIDRs(cidrs []string, compacted map[string]bool, releaseIPs []string) ([]string, []string, int64) {
+	released := make(map[string]bool, len(releaseIPs))
+	for _, ip := range releaseIPs {
+		released[ip] = true
+	}
+
+	owned := map[string]net.IP{}
+	var others []string
+	seen := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		if seen[cidr] {
+			continue
+		}
+		seen[cidr] = true
+		ipNet := utils.ParseCidr(cidr)
+		switch {
+		case cidr == cons.SystemReserveIP:
+			// added back below
+		case ipNet == nil:
+			others = append(others, cidr)
+		case utils.IPRangeSize(ipNet).Int64() == 1:
+			if ip := ipNet.IP.String(); !released[cidr] && !released[ip] {
+				owned[ip] = ipNet.IP
+			}
+		case compacted[ipNet.String()] && utils.IPRangeSize(ipNet).Cmp(big.NewInt(cons.CompactMaxSize)) <= 0:
+			for _, ip := range rangeIPs(ipNet) {
+				if !released[ip.String()] {
+					owned[ip.String()] = ip
+				}
+			}
+		case !released[cidr]:
+			others = append(others, cidr)
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range owned {
+		ips = append(ips, ip)
+	}
+	aggregated := aggregateIPs(ips)
+
+	var aggregates []string
+	for _, cidr := range aggregated {
+		if strings.Contains(cidr, "/") {
+			aggregates = append(aggregates, cidr)
+		}
+	}
+	reserved := append(aggregated, others...)
+	var total int64
+	for _, cidr := range reserved {
+		total += utils.IPRangeSize(utils.ParseCidr(cidr)).Int64()
+	}
+	//The Kubernetes API server does not recursively create nested objects for JSON patch inputs, so when spec.reservedCIDRs is nil,
+	//JSONPatch will fail, so keep a permanent system reserved IP: 1.1.1.1 in reservedCIDRs
+	reserved = append(reserved, cons.SystemReserveIP)
+	sort.Stable(byIp(reserved))
+	return reserved, aggregates, total
+}
+
+// compactReservation compacts the reserved CIDRs of the IPReservation, see compactCIDRs, and records the aggregates
+// in its compacted annotation. It reports whether the IPReservation changed, and the number of reserved IPs.
+func compactReservation(ipReservation *v3.IPReservation, releaseIPs []string) (bool, int64) {
+	reserved, aggregates, total := compactCIDRs(ipReservation.Spec.ReservedCIDRs, compactedCIDRs(ipReservation), releaseIPs)
+	annotation := strings.Join(aggregates, ",")
+
+	changed := annotation != ipReservation.Annotations[cons.CompactedAnnotation] ||
+		len(reserved) != len(ipReservation.Spec.ReservedCIDRs)
+	for i := 0; !changed && i < len(reserved); i++ {
+		changed = reserved[i] != ipReservation.Spec.ReservedCIDRs[i]
+	}
+	if !changed {
+		return false, total
+	}
+	ipReservation.Spec.ReservedCIDRs = reserved
+	if annotation == "" {
+		delete(ipReservation.Annotations, cons.CompactedAnnotation)
+	} else {
+		if ipReservation.Annotations == nil {
+			ipReservation.Annotations = map[string]string{}
+		}
+		ipReservation.Annotations[cons.CompactedAnnotation] = annotation
+	}
+	return true, total
+}
+
+// aggregateIPs merges the IPs into the smallest set of CIDRs covering exactly them, a single IP is written without
+// prefix length. The CIDRs are sorted numerically, IPv4 first.
+func aggregateIPs(ips []net.IP) []string {
+	var v4, v6 []*big.Int
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, new(big.Int).SetBytes(ip4))
+		} else if ip16 := ip.To16(); ip16 != nil {
+			v6 = append(v6, new(big.Int).SetBytes(ip16))
+		}
+	}
+	return append(aggregateInts(v4, net.IPv4len*8), aggregateInts(v6, net.IPv6len*8)...)
+}
+
+// aggregateInts covers the addresses of bits bits with the largest aligned blocks starting at the lowest address
+// not covered yet, which gives the smallest cover of every run of consecutive addresses
+func aggregateInts(addrs []*big.Int, bits int) []string {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Cmp(addrs[j]) < 0 })
+	// deduplicate
+	unique := addrs[:0]
+	for i, addr := range addrs {
+		if i == 0 || addr.Cmp(addrs[i-1]) != 0 {
+			unique = append(unique, addr)
+		}
+	}
+	addrs = unique
+
+	var cidrs []string
+	one := big.NewInt(1)
+	for i := 0; i < len(addrs); {
+		// length of the run of consecutive addresses starting at i
+		run := 1
+		for i+run < len(addrs) && new(big.Int).Sub(addrs[i+run], addrs[i+run-1]).Cmp(one) == 0 {
+			run++
+		}
+		for run > 0 {
+			start := addrs[i]
+			// the largest block aligned on start within the run
+			host := 0
+			for host < bits && start.Bit(host) == 0 && 1<<uint(host+1) <= run {
+				host++
+			}
+			cidrs = append(cidrs, formatBlock(start, bits, host))
+			i += 1 << uint(host)
+			run -= 1 << uint(host)
+		}
+	}
+	return cidrs
+}
+
+func formatBlock(start *big.Int, bits, host int) string {
+	raw := start.FillBytes(make([]byte, bits/8))
+	ip := net.IP(raw)
+	if host == 0 {
+		return ip.String()
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits-host, bits)}).String()
+}
+
+// rangeIPs returns the IPs of the network
+func rangeIPs(ipNet *net.IPNet) []net.IP {
+	size := utils.IPRangeSize(ipNet).Int64()
+	start := new(big.Int).SetBytes(ipNet.IP)
+	ips := make([]net.IP, 0, size)
+	for i := int64(0); i < size; i++ {
+		addr := new(big.Int).Add(start, big.NewInt(i))
+		ips = append(ips, net.IP(addr.FillBytes(make([]byte, len(ipNet.IP)))))
+	}
+	return ips
+}
+
+// cidrLess orders CIDRs numerically by their first IP, IPv4 first, then by their prefix length.
+// Entries which do not parse come last, in string order.
+func cidrLess(a, b string) bool {
+	netA, netB := utils.ParseCidr(a), utils.ParseCidr(b)
+	switch {
+	case netA == nil || netB == nil:
+		if (netA == nil) != (netB == nil) {
+			return netB == nil
+		}
+		return a < b
+	case (netA.IP.To4() == nil) != (netB.IP.To4() == nil):
+		return netA.IP.To4() != nil
+	}
+	if c := bytes.Compare(netA.IP.To16(), netB.IP.To16()); c != 0 {
+		return c < 0
+	}
+	onesA, _ := netA.Mask.Size()
+	onesB, _ := netB.Mask.Size()
+	return onesA < onesB
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+)
+
+// ipSet is a random set of IPs in 10.0.0.0/24 and fd00::/120, dense enough to be aggregated
+type ipSet map[string]bool
+
+func (ipSet) Generate(rand *rand.Rand, size int) reflect.Value {
+	set := ipSet{}
+	for i := rand.Intn(256); i > 0; i-- {
+		if rand.Intn(4) == 0 {
+			set[net.IP{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(rand.Intn(256))}.String()] = true
+		} else {
+			set[net.IPv4(10, 0, 0, byte(rand.Intn(256))).String()] = true
+		}
+	}
+	return reflect.ValueOf(set)
+}
+
+func (s ipSet) ips() []net.IP {
+	var ips []net.IP
+	for ip := range s {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips
+}
+
+func (s ipSet) strings() []string {
+	var ips []string
+	for ip := range s {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// expand returns the IPs of the CIDRs, the system reserved IP aside
+func expand(cidrs []string) ipSet {
+	set := ipSet{}
+	for _, cidr := range cidrs {
+		if cidr == cons.SystemReserveIP {
+			continue
+		}
+		for _, ip := range rangeIPs(utils.ParseCidr(cidr)) {
+			set[ip.String()] = true
+		}
+	}
+	return set
+}
+
+// minimalCount merges sibling blocks until none is left, which gives the smallest number of CIDRs covering s
+func minimalCount(s ipSet) int {
+	type block struct {
+		start string
+		ones  int
+	}
+	blocks := map[block]bool{}
+	for ip := range s {
+		parsed := net.ParseIP(ip)
+		bits := 128
+		if parsed.To4() != nil {
+			parsed, bits = parsed.To4(), 32
+		}
+		blocks[block{parsed.String(), bits}] = true
+	}
+	for merged := true; merged; {
+		merged = false
+		for b := range blocks {
+			ip := net.ParseIP(b.start)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			parent := ip.Mask(net.CIDRMask(b.ones-1, bits))
+			sibling := make(net.IP, len(ip))
+			copy(sibling, parent)
+			// the upper half of the parent
+			host := bits - b.ones
+			sibling[len(sibling)-1-host/8] |= 1 << uint(host%8)
+			low, high := block{parent.String(), b.ones}, block{sibling.String(), b.ones}
+			if blocks[low] && blocks[high] {
+				delete(blocks, low)
+				delete(blocks, high)
+				blocks[block{parent.String(), b.ones - 1}] = true
+				merged = true
+				break
+			}
+		}
+	}
+	return len(blocks)
+}
+
+func isSorted(cidrs []string) bool {
+	return sort.SliceIsSorted(cidrs, func(i, j int) bool { return cidrLess(cidrs[i], cidrs[j]) })
+}
+
+func TestAggregateIPsProperties(t *testing.T) {
+	property := func(s ipSet) bool {
+		aggregated := aggregateIPs(s.ips())
+		return reflect.DeepEqual(expand(aggregated), s) && len(aggregated) == minimalCount(s) && isSorted(aggregated)
+	}
+	assert.NoError(t, quick.Check(property, nil))
+}
+
+func TestCompactCIDRsReleaseProperties(t *testing.T) {
+	property := func(s ipSet, seed int64) bool {
+		// a range reserved by hand is kept as it is
+		foreign := "192.168.0.0/30"
+		cidrs, aggregates, total := compactCIDRs(append(s.strings(), foreign, cons.SystemReserveIP), nil, nil)
+		if total != int64(len(s)+4) || !isSorted(cidrs) {
+			return false
+		}
+		compacted := map[string]bool{}
+		for _, cidr := range aggregates {
+			compacted[cidr] = true
+		}
+
+		// compacting again changes nothing
+		again, _, _ := compactCIDRs(cidrs, compacted, nil)
+		if !reflect.DeepEqual(again, cidrs) {
+			return false
+		}
+
+		// releasing members splits the aggregates holding them
+		random := rand.New(rand.NewSource(seed))
+		var released []string
+		left := ipSet{}
+		for ip := range s {
+			if random.Intn(3) == 0 {
+				released = append(released, ip)
+			} else {
+				left[ip] = true
+			}
+		}
+		cidrs, _, total = compactCIDRs(cidrs, compacted, released)
+		left["192.168.0.0"], left["192.168.0.1"], left["192.168.0.2"], left["192.168.0.3"] = true, true, true, true
+		return reflect.DeepEqual(expand(cidrs), left) && total == int64(len(left)) &&
+			contains(cidrs, foreign) && contains(cidrs, cons.SystemReserveIP)
+	}
+	assert.NoError(t, quick.Check(property, nil))
+}
+
+func TestCompactReservation(t *testing.T) {
+	ipReservation := &v3.IPReservation{Spec: v3.IPReservationSpec{ReservedCIDRs: []string{
+		"10.0.0.10", "10.0.0.9", cons.SystemReserveIP, "10.0.0.8", "10.0.0.11", "10.0.2.0/24", "10.0.0.12",
+	}}}
+	changed, total := compactReservation(ipReservation, nil)
+	assert.True(t, changed)
+	assert.Equal(t, int64(261), total)
+	assert.Equal(t, []string{cons.SystemReserveIP, "10.0.0.8/30", "10.0.0.12", "10.0.2.0/24"}, ipReservation.Spec.ReservedCIDRs)
+	assert.Equal(t, "10.0.0.8/30", ipReservation.Annotations[cons.CompactedAnnotation])
+
+	changed, _ = compactReservation(ipReservation, nil)
+	assert.False(t, changed)
+
+	// the aggregate is split, the range reserved by hand stays whole
+	changed, total = compactReservation(ipReservation, []string{"10.0.0.9", "10.0.2.1"})
+	assert.True(t, changed)
+	assert.Equal(t, int64(260), total)
+	assert.Equal(t, []string{cons.SystemReserveIP, "10.0.0.8", "10.0.0.10/31", "10.0.0.12", "10.0.2.0/24"}, ipReservation.Spec.ReservedCIDRs)
+	assert.Equal(t, "10.0.0.10/31", ipReservation.Annotations[cons.CompactedAnnotation])
+
+	changed, _ = compactReservation(ipReservation, []string{"10.0.0.10", "10.0.0.11"})
+	assert.True(t, changed)
+	assert.NotContains(t, ipReservation.Annotations, cons.CompactedAnnotation)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"sort"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The claimed IPs live in their own IPReservation, so that the release loop and the drift check
+// of the delay-release reservation never touch them.
+var ipClaimReservationNsName = types.NamespacedName{
+	Name: cons.IPClaimReservationName,
+}
+
+// IPClaimReservationKey is the key of the Calico IPReservation holding the claimed IPs while unbound
+func IPClaimReservationKey() types.NamespacedName {
+	return ipClaimReservationNsName
+}
+
+// ReserveClaimed adds the IPs to the IPReservation of the claimed IPs, creating it if needed
+func (r *IPKeeper) ReserveClaimed(ctx context.Context, ips ...string) error {
+	return r.updateClaimed(ctx, func(reserved map[string]bool) {
+		for _, ip := range ips {
+			reserved[ip] = true
+		}
+	})
+}
+
+// UnreserveClaimed removes the IPs from the IPReservation of the claimed IPs, so that Calico assigns them
+func (r *IPKeeper) UnreserveClaimed(ctx context.Context, ips ...string) error {
+	return r.updateClaimed(ctx, func(reserved map[string]bool) {
+		for _, ip := range ips {
+			delete(reserved, ip)
+		}
+	})
+}
+
+// ClaimOwner returns the pod, namespace/name, other than the pod of namespace the IP belongs to: the pod it is
+// reserved for in the pod info ConfigMap, as Hold checks, or a pod it is assigned to. It is empty if there is none.
+func (r *IPKeeper) ClaimOwner(ctx context.Context, namespace, podName, ip string) (string, error) {
+	if !r.Initialized() {
+		return "", errNotInitialized
+	}
+	_, podIPMap, err := r.getResources(ctx)
+	if err != nil {
+		return "", err
+	}
+	if podInfoTime, ok := podIPMap.Data[ip]; ok {
+		_, podNamespace, name, _, err := getPodInfo(ip, podInfoTime)
+		if err == nil && podNamespace != cons.DriftUnknownOwner && (podNamespace != namespace || name != podName) {
+			return podNamespace + "/" + name, nil
+		}
+	}
+
+	pods := &v1.PodList{}
+	if err = kubeCall(ctx, "Pod list", func(ctx context.Context) error {
+		return r.client.List(ctx, pods)
+	}); err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Namespace == namespace && pod.Name == podName {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if podIP.IP == ip {
+				return pod.Namespace + "/" + pod.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (r *IPKeeper) updateClaimed(ctx context.Context, update func(reserved map[string]bool)) error {
+	if r.config.ShadowMode {
+		// the claimed IPs are reserved in an IPReservation of their own, left alone as well
+		log.FromContext(ctx).Info("shadow mode, IPClaim reservation not updated")
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipReservation := &v3.IPReservation{}
+		err := calicoCall(ctx, cons.OperationGet, func(ctx context.Context) error {
+			return r.client.Get(ctx, ipClaimReservationNsName, ipReservation)
+		})
+		notFound := errors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+
+		reserved := make(map[string]bool, len(ipReservation.Spec.ReservedCIDRs))
+		for _, cidr := range ipReservation.Spec.ReservedCIDRs {
+			reserved[cidr] = true
+		}
+		update(reserved)
+		reservedCIDRs := make([]string, 0, len(reserved))
+		for cidr := range reserved {
+			reservedCIDRs = append(reservedCIDRs, cidr)
+		}
+		sort.Strings(reservedCIDRs)
+
+		if notFound && len(reservedCIDRs) == 0 {
+			return nil
+		}
+		if notFound {
+			ipReservation.ObjectMeta = metav1.ObjectMeta{
+				Name:   ipClaimReservationNsName.Name,
+				Labels: map[string]string{cons.LabelManagedBy: cons.ManagedByValue},
+			}
+			ipReservation.Spec.ReservedCIDRs = reservedCIDRs
+			return calicoCall(ctx, cons.OperationCreate, func(ctx context.Context) error {
+				return r.client.Create(ctx, ipReservation)
+			})
+		}
+		if sameCIDRs(ipReservation.Spec.ReservedCIDRs, reservedCIDRs) {
+			return nil
+		}
+		ipReservation.Spec.ReservedCIDRs = reservedCIDRs
+		return calicoCall(ctx, cons.OperationUpdate, func(ctx context.Context) error {
+			return r.client.Update(ctx, ipReservation)
+		})
+	})
+}
+
+// sameCIDRs reports whether current holds the sorted CIDRs, in any order
+func sameCIDRs(current, sorted []string) bool {
+	if len(current) != len(sorted) {
+		return false
+	}
+	current = append([]string(nil), current...)
+	sort.Strings(current)
+	for i := range current {
+		if current[i] != sorted[i] {
+			return false
+		}
+	}
+	return true
+}
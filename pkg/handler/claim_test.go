@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestReserveClaimed(t *testing.T) {
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+	})
+	ctx := context.Background()
+
+	// nothing to lift, the reservation is not created
+	assert.NoError(t, keeper.UnreserveClaimed(ctx, "10.0.1.1"))
+	ipReservation := &v3.IPReservation{}
+	assert.True(t, errors.IsNotFound(c.Get(ctx, IPClaimReservationKey(), ipReservation)))
+
+	assert.NoError(t, keeper.ReserveClaimed(ctx, "10.0.1.2", "10.0.1.1"))
+	assert.NoError(t, c.Get(ctx, IPClaimReservationKey(), ipReservation))
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, ipReservation.Spec.ReservedCIDRs)
+	assert.Equal(t, cons.ManagedByValue, ipReservation.Labels[cons.LabelManagedBy])
+
+	// the delay-release reservation is untouched
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+
+	assert.NoError(t, keeper.ReserveClaimed(ctx, "10.0.1.1"))
+	assert.NoError(t, keeper.UnreserveClaimed(ctx, "10.0.1.1"))
+	assert.NoError(t, c.Get(ctx, IPClaimReservationKey(), ipReservation))
+	assert.Equal(t, []string{"10.0.1.2"}, ipReservation.Spec.ReservedCIDRs)
+}
+
+func TestIpReserveClaimedPod(t *testing.T) {
+	claimedPod := func(name, ip string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: name, Labels: map[string]string{"app": "kafka"},
+				Annotations: map[string]string{cons.IPClaimAnnotation: name}},
+			Spec:   v1.PodSpec{NodeName: "node01"},
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: ip}}},
+		}
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		PodSelectors:      []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "kafka"}}}},
+	},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kafka", Labels: map[string]string{"ip-reserve": "enabled"}}},
+		&ipamv1alpha1.IPClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: "kafka-0"},
+			Spec: ipamv1alpha1.IPClaimSpec{IP: "10.0.1.1", PodName: "kafka-0"}},
+		claimedPod("kafka-0", "10.0.1.1"),
+		// the claim was deleted since the pod was created
+		claimedPod("kafka-1", "10.0.1.2"),
+	)
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+
+	// the claimed IP is reserved before the deletion is admitted, without delay release
+	assert.NoError(t, keeper.IpReserve(ctx, logger, "kafka", "kafka-0"))
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, IPClaimReservationKey(), ipReservation))
+	assert.Equal(t, []string{"10.0.1.1"}, ipReservation.Spec.ReservedCIDRs)
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, PodIPMapKey(), podIPMap))
+	assert.NotContains(t, podIPMap.Data, "10.0.1.1")
+
+	assert.NoError(t, keeper.IpReserve(ctx, logger, "kafka", "kafka-1"))
+	assert.NoError(t, c.Get(ctx, PodIPMapKey(), podIPMap))
+	assert.Contains(t, podIPMap.Data, "10.0.1.2")
+}
+
+func TestClaimOwner(t *testing.T) {
+	keeper, _ := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+	},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: "kafka-0"},
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.1"}}}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: "redis-0"},
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.2"}}}},
+	)
+	ctx := context.Background()
+	reserved := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, keeper.writeReservation(ctx, map[string]string{
+		"10.0.1.3": buildPodInfo("redis", "redis-1", "node01", reserved),
+		"10.0.1.4": buildPodInfo("kafka", "kafka-1", "node01", reserved),
+	}, []string{"10.0.1.3", "10.0.1.4"}))
+
+	cases := []struct {
+		pod, ip, owner string
+	}{
+		// assigned to the claimed pod, or to another pod
+		{pod: "kafka-0", ip: "10.0.1.1"},
+		{pod: "kafka-0", ip: "10.0.1.2", owner: "redis/redis-0"},
+		// reserved for another namespace, or for the claimed pod
+		{pod: "kafka-0", ip: "10.0.1.3", owner: "redis/redis-1"},
+		{pod: "kafka-1", ip: "10.0.1.4"},
+		{pod: "kafka-0", ip: "10.0.1.5"},
+	}
+	for _, tc := range cases {
+		owner, err := keeper.ClaimOwner(ctx, "kafka", tc.pod, tc.ip)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.owner, owner, tc.ip)
+	}
+}
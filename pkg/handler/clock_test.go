@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReleaseUnderFakeClock(t *testing.T) {
+	objs := []client.Object{
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "redis", Labels: map[string]string{"ip-reserve": "enabled"}}},
+	}
+	for i := 0; i < 4; i++ {
+		objs = append(objs, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: fmt.Sprintf("redis-%d", i), Labels: map[string]string{"app": "redis"}},
+			Spec:       v1.PodSpec{NodeName: "node01"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: fmt.Sprintf("10.0.1.%d", i+1)}}},
+		})
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(3),
+		PodSelectors:      []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}}},
+	}, objs...)
+	start := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	clock := clocktesting.NewFakeClock(start)
+	keeper.SetClock(clock)
+
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+	reserved := func() []string {
+		podIPMap := &v1.ConfigMap{}
+		assert.NoError(t, c.Get(ctx, PodIPMapKey(), podIPMap))
+		ips := make([]string, 0, len(podIPMap.Data))
+		for ip := range podIPMap.Data {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		return ips
+	}
+
+	// a pod deleted every minute
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, keeper.IpReserve(ctx, logger, "redis", fmt.Sprintf("redis-%d", i)))
+		clock.Step(time.Minute)
+	}
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, PodIPMapKey(), podIPMap))
+	assert.Equal(t, buildPodInfo("redis", "redis-2", "node01", start.Add(2*time.Minute)), podIPMap.Data["10.0.1.3"])
+
+	// over the max count, the longest held IP is evicted
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.Equal(t, []string{"10.0.1.2", "10.0.1.3", "10.0.1.4"}, reserved())
+
+	// held a second less than the reserve time
+	clock.SetTime(start.Add(time.Minute + 30*time.Minute - time.Second))
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.Equal(t, []string{"10.0.1.2", "10.0.1.3", "10.0.1.4"}, reserved())
+
+	// released once held exactly the reserve time
+	clock.Step(time.Second)
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.Equal(t, []string{"10.0.1.3", "10.0.1.4"}, reserved())
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, IPReservationKey(), ipReservation))
+	assert.ElementsMatch(t, []string{cons.SystemReserveIP, "10.0.1.3", "10.0.1.4"}, ipReservation.Spec.ReservedCIDRs)
+}
+
+func TestCountEvictionOrder(t *testing.T) {
+	keeper, err := NewLazyIPKeeper(nil, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: time.Hour},
+		IPReserveMaxCount: pointer.Int(2),
+	})
+	assert.NoError(t, err)
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", now.Add(-10*time.Minute)),
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", now.Add(-50*time.Minute)),
+		"10.0.1.3": buildPodInfo("redis", "redis-2", "node01", now.Add(-time.Minute)),
+		"10.0.1.4": buildPodInfo("redis", "redis-3", "node01", now.Add(-30*time.Minute)),
+		"10.0.1.5": buildPodInfo("redis", "redis-4", "node01", now),
+	}}
+
+	// none expired, the longest held IPs are evicted first
+	releaseIPs, expired := getReleaseIPs(podIPMap, utils.CreateLogger(true, true), keeper, now)
+	assert.Equal(t, []string{"10.0.1.2", "10.0.1.4", "10.0.1.1"}, releaseIPs)
+	assert.Equal(t, 0, expired)
+	assert.Len(t, podIPMap.Data, 2)
+
+	// the expired IPs come before the evictions
+	podIPMap.Data["10.0.1.6"] = buildPodInfo("redis", "redis-5", "node01", now.Add(-2*time.Hour))
+	podIPMap.Data["10.0.1.7"] = buildPodInfo("redis", "redis-6", "node01", now.Add(-time.Second))
+	releaseIPs, expired = getReleaseIPs(podIPMap, utils.CreateLogger(true, true), keeper, now)
+	assert.Equal(t, []string{"10.0.1.6", "10.0.1.3"}, releaseIPs)
+	assert.Equal(t, 1, expired)
+	assert.Contains(t, podIPMap.Data, "10.0.1.5")
+	assert.Contains(t, podIPMap.Data, "10.0.1.7")
+}
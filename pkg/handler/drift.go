@@ -0,0 +1,234 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DriftReport lists the IPs on which the pod info ConfigMap and the IPReservation disagree
+type DriftReport struct {
+	// Unrecorded IPs are reserved in Calico without pod info, so they are never released
+	Unrecorded []string
+	// Unreserved IPs have pod info without a Calico reservation, so they are not protected
+	Unreserved []string
+}
+
+// Empty reports whether both sides agree
+func (d DriftReport) Empty() bool {
+	return len(d.Unrecorded) == 0 && len(d.Unreserved) == 0
+}
+
+// findDrift compares the reserved IPs with their pod info. Ranges other than the aggregates capo compacted,
+// and the system reserved IP are not orphans. Pod info younger than grace at now is skipped, because
+// IpReserve writes the ConfigMap before the IPReservation.
+func findDrift(ipReservation *v3.IPReservation, podIPMap *v1.ConfigMap, grace time.Duration, now time.Time) DriftReport {
+	var report DriftReport
+	var reserved []*net.IPNet
+	compacted := compactedCIDRs(ipReservation)
+	for _, cidr := range ipReservation.Spec.ReservedCIDRs {
+		ipNet := utils.ParseCidr(cidr)
+		if ipNet == nil {
+			continue
+		}
+		reserved = append(reserved, ipNet)
+		if compacted[ipNet.String()] && utils.IPRangeSize(ipNet).Int64() <= cons.CompactMaxSize {
+			for _, ip := range rangeIPs(ipNet) {
+				if _, ok := podIPMap.Data[ip.String()]; !ok {
+					report.Unrecorded = append(report.Unrecorded, ip.String())
+				}
+			}
+			continue
+		}
+		if cidr == cons.SystemReserveIP || utils.IPRangeSize(ipNet).Int64() != 1 {
+			continue
+		}
+		if _, ok := podIPMap.Data[ipNet.IP.String()]; !ok {
+			if _, ok = podIPMap.Data[cidr]; !ok {
+				report.Unrecorded = append(report.Unrecorded, cidr)
+			}
+		}
+	}
+
+	for podIP, podInfoTime := range podIPMap.Data {
+		ip := net.ParseIP(podIP)
+		if ip == nil {
+			continue
+		}
+		// an IPHold records its deadline less the reserve time, which can be in the future
+		if _, _, _, reserved, err := getPodInfo(podIP, podInfoTime); err == nil {
+			if d := now.Sub(reserved); d >= 0 && d < grace {
+				continue
+			}
+		}
+		covered := false
+		for _, ipNet := range reserved {
+			if ipNet.Contains(ip) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			report.Unreserved = append(report.Unreserved, podIP)
+		}
+	}
+	sort.Strings(report.Unrecorded)
+	sort.Strings(report.Unreserved)
+	return report
+}
+
+// repairDrift applies the policy to the orphans in report:
+// adopt records unrecorded IPs with an unknown owner and reserves unreserved ones, both with a fresh
+// timestamp so that they are released after IPReserveTime; drop releases unrecorded IPs and forgets
+// the pod info of unreserved ones.
+func repairDrift(ipReservation *v3.IPReservation, podIPMap *v1.ConfigMap, report DriftReport, policy string, now time.Time) {
+	if podIPMap.Data == nil {
+		podIPMap.Data = map[string]string{}
+	}
+	switch policy {
+	case cons.DriftPolicyDrop:
+		compactReservation(ipReservation, report.Unrecorded)
+		for _, podIP := range report.Unreserved {
+			delete(podIPMap.Data, podIP)
+		}
+	default:
+		for _, cidr := range report.Unrecorded {
+			podIPMap.Data[utils.ParseCidr(cidr).IP.String()] = buildPodInfo(cons.DriftUnknownOwner,
+				cons.DriftUnknownOwner, cons.DriftUnknownOwner, now)
+		}
+		for _, podIP := range report.Unreserved {
+			nodeName, podNamespace, podName, _, err := getPodInfo(podIP, podIPMap.Data[podIP])
+			if err != nil {
+				nodeName, podNamespace, podName = cons.DriftUnknownOwner, cons.DriftUnknownOwner, cons.DriftUnknownOwner
+			}
+			podIPMap.Data[podIP] = withOwner(buildPodInfo(podNamespace, podName, nodeName, now), podInfoOwner(podIPMap.Data[podIP]))
+			ipReservation.Spec.ReservedCIDRs = append(ipReservation.Spec.ReservedCIDRs, podIP)
+		}
+	}
+}
+
+// ReconcileDrift finds the IPs on which the pod info ConfigMap and the IPReservation disagree and repairs them
+// according to policy, and returns the policy applied: adopt unless dropping, which is downgraded to adopt while releases
+// are frozen. It is serialized with IpRelease, which updates both objects one after the other.
+func (r *IPKeeper) ReconcileDrift(ctx context.Context, logger logr.Logger, policy string) (report DriftReport, applied string, podIPMap *v1.ConfigMap, err error) {
+	if !r.Initialized() {
+		return report, "", nil, errNotInitialized
+	}
+	r.releaseMu.Lock()
+	defer r.releaseMu.Unlock()
+
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		var ipReservation *v3.IPReservation
+		ipReservation, podIPMap, err = r.getResources(ctx)
+		if err != nil {
+			return err
+		}
+		now := r.clock.Now()
+		report = findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now)
+		if report.Empty() {
+			return nil
+		}
+
+		applied = cons.DriftPolicyAdopt
+		// dropping while frozen would release the unrecorded IPs
+		if policy == cons.DriftPolicyDrop && frozen(ipReservation) == "" {
+			applied = cons.DriftPolicyDrop
+		}
+		logger.Info("ip reservation drift", "policy", applied, "unrecorded", report.Unrecorded, "unreserved", report.Unreserved)
+		repairDrift(ipReservation, podIPMap, report, applied, now)
+		// updates, not patches, so that any concurrent write makes the repair start over
+		err = r.updateReservation(ctx, ipReservation)
+		if err != nil {
+			return err
+		}
+		return kubeCall(ctx, "ConfigMap update", func(ctx context.Context) error {
+			return r.client.Update(ctx, podIPMap)
+		})
+	})
+	return report, applied, podIPMap, err
+}
+
+// DriftChecker periodically reconciles the drift between the pod info ConfigMap and the IPReservation
+type DriftChecker struct {
+	keeper   *IPKeeper
+	recorder record.EventRecorder
+	period   time.Duration
+	policy   string
+}
+
+func NewDriftChecker(keeper *IPKeeper, recorder record.EventRecorder, period time.Duration, policy string) *DriftChecker {
+	return &DriftChecker{
+		keeper:   keeper,
+		recorder: recorder,
+		period:   period,
+		policy:   policy,
+	}
+}
+
+// Start checks every period until ctx is done
+func (d *DriftChecker) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("drift")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if !d.keeper.Initialized() {
+			return
+		}
+		d.check(ctx, logger)
+	}, d.period)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the repairs race with the leader's IpRelease otherwise
+func (d *DriftChecker) NeedLeaderElection() bool {
+	return true
+}
+
+func (d *DriftChecker) check(ctx context.Context, logger logr.Logger) {
+	report, action, podIPMap, err := d.keeper.ReconcileDrift(ctx, logger, d.policy)
+	if err != nil {
+		logger.Error(err, "reconcile ip reservation drift failed")
+		return
+	}
+	metrics.IPReserveDriftOrphans.WithLabelValues(cons.DriftKindUnrecorded).Set(float64(len(report.Unrecorded)))
+	metrics.IPReserveDriftOrphans.WithLabelValues(cons.DriftKindUnreserved).Set(float64(len(report.Unreserved)))
+	if report.Empty() {
+		return
+	}
+
+	metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnrecorded, action).Add(float64(len(report.Unrecorded)))
+	metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnreserved, action).Add(float64(len(report.Unreserved)))
+	if len(report.Unrecorded) > 0 {
+		d.recorder.Eventf(podIPMap, v1.EventTypeWarning, cons.EventReasonDriftRepaired,
+			"%s %d IPs reserved in Calico without pod info: %s", action, len(report.Unrecorded), summarize(report.Unrecorded))
+	}
+	if len(report.Unreserved) > 0 {
+		d.recorder.Eventf(podIPMap, v1.EventTypeWarning, cons.EventReasonDriftRepaired,
+			"%s %d IPs with pod info but not reserved in Calico: %s", action, len(report.Unreserved), summarize(report.Unreserved))
+	}
+}
+
+// summarize keeps event messages short when many IPs drifted
+func summarize(ips []string) string {
+	const max = 10
+	if len(ips) <= max {
+		return strings.Join(ips, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(ips[:max], ", "), len(ips)-max)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func driftResources(now time.Time) (*v3.IPReservation, *v1.ConfigMap) {
+	ipReservation := &v3.IPReservation{
+		ObjectMeta: metav1.ObjectMeta{Name: ipReservationNsName.Name,
+			Annotations: map[string]string{cons.CompactedAnnotation: "10.0.4.0/31"}},
+		Spec: v3.IPReservationSpec{
+			ReservedCIDRs: []string{cons.SystemReserveIP, "10.0.1.1", "10.0.1.2", "10.0.2.0/24", "10.0.4.0/31"},
+		},
+	}
+	podIPMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: podIPMapNsName.Name, Namespace: podIPMapNsName.Namespace},
+		Data: map[string]string{
+			// consistent
+			"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", now.Add(-time.Hour)),
+			// covered by a manually reserved range
+			"10.0.2.7": buildPodInfo("redis", "redis-1", "node01", now.Add(-time.Hour)),
+			// not reserved
+			"10.0.3.1": buildPodInfo("kafka", "kafka-0", "node02", now.Add(-time.Hour)),
+			// being reserved by IpReserve
+			"10.0.3.2": buildPodInfo("kafka", "kafka-1", "node02", now),
+			// in an aggregate compacted by capo, with 10.0.4.1 unrecorded
+			"10.0.4.0": buildPodInfo("kafka", "kafka-2", "node02", now.Add(-time.Hour)),
+		},
+	}
+	return ipReservation, podIPMap
+}
+
+func TestFindDrift(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	ipReservation, podIPMap := driftResources(now)
+	// held by an IPHold beyond the reserve time, recorded with a reserved time in the future
+	podIPMap.Data["10.0.3.3"] = buildPodInfo("kafka", "kafka-3", "node02", now.Add(time.Hour))
+	report := findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now)
+	assert.Equal(t, []string{"10.0.1.2", "10.0.4.1"}, report.Unrecorded)
+	assert.Equal(t, []string{"10.0.3.1", "10.0.3.3"}, report.Unreserved)
+
+	// the IP being reserved is an orphan once the grace period is over
+	report = findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now.Add(cons.DriftGracePeriod))
+	assert.Equal(t, []string{"10.0.3.1", "10.0.3.2", "10.0.3.3"}, report.Unreserved)
+}
+
+func TestRepairDrift(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	ipReservation, podIPMap := driftResources(now)
+	report := findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now)
+	repairDrift(ipReservation, podIPMap, report, cons.DriftPolicyAdopt, now)
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.3.1")
+	assert.Equal(t, buildPodInfo("kafka", "kafka-0", "node02", now), podIPMap.Data["10.0.3.1"])
+	assert.Equal(t, buildPodInfo(cons.DriftUnknownOwner, cons.DriftUnknownOwner, cons.DriftUnknownOwner, now), podIPMap.Data["10.0.1.2"])
+	assert.True(t, findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now).Empty())
+
+	ipReservation, podIPMap = driftResources(now)
+	repairDrift(ipReservation, podIPMap, report, cons.DriftPolicyDrop, now)
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.2")
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.2.0/24")
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.4.0")
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "10.0.4.0/31")
+	assert.NotContains(t, podIPMap.Data, "10.0.3.1")
+	assert.True(t, findDrift(ipReservation, podIPMap, cons.DriftGracePeriod, now).Empty())
+}
+
+func TestDriftChecker(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	ipReservation, podIPMap := driftResources(now)
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{}, ipReservation, podIPMap)
+	keeper.SetClock(clocktesting.NewFakeClock(now))
+	recorder := record.NewFakeRecorder(10)
+	checker := NewDriftChecker(keeper, recorder, time.Minute, cons.DriftPolicyAdopt)
+	repairedBefore := testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnreserved, cons.DriftPolicyAdopt))
+
+	checker.check(context.Background(), utils.CreateLogger(true, true))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.IPReserveDriftOrphans.WithLabelValues(cons.DriftKindUnrecorded)))
+	assert.Equal(t, repairedBefore+1, testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnreserved, cons.DriftPolicyAdopt)))
+	assert.Len(t, recorder.Events, 2)
+
+	stored := &v3.IPReservation{}
+	assert.NoError(t, c.Get(context.Background(), ipReservationNsName, stored))
+	assert.Contains(t, stored.Spec.ReservedCIDRs, "10.0.3.1")
+
+	checker.check(context.Background(), utils.CreateLogger(true, true))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReserveDriftOrphans.WithLabelValues(cons.DriftKindUnrecorded)))
+	assert.Len(t, recorder.Events, 2)
+}
+
+func TestDriftCheckerFrozenDrop(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	ipReservation, podIPMap := driftResources(now)
+	ipReservation.Annotations[cons.FreezeAnnotation] = "migration"
+	keeper, _ := newTestKeeper(t, &configv1.CapoConfig{}, ipReservation, podIPMap)
+	keeper.SetClock(clocktesting.NewFakeClock(now))
+	recorder := record.NewFakeRecorder(10)
+	checker := NewDriftChecker(keeper, recorder, time.Minute, cons.DriftPolicyDrop)
+	adoptedBefore := testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnrecorded, cons.DriftPolicyAdopt))
+	droppedBefore := testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnrecorded, cons.DriftPolicyDrop))
+
+	// frozen releases downgrade drop to adopt, and adopt is reported
+	checker.check(context.Background(), utils.CreateLogger(true, true))
+	assert.Equal(t, adoptedBefore+2, testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnrecorded, cons.DriftPolicyAdopt)))
+	assert.Equal(t, droppedBefore, testutil.ToFloat64(metrics.IPReserveDriftRepairedTotal.WithLabelValues(cons.DriftKindUnrecorded, cons.DriftPolicyDrop)))
+	assert.Contains(t, <-recorder.Events, cons.DriftPolicyAdopt+" 2 IPs")
+}
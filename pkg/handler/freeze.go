@@ -0,0 +1,43 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
+)
+
+// frozen returns the reason of the freeze of the releases, set as the freeze annotation of the IPReservation,
+// empty while the releases are not frozen. New IPs are reserved even so.
+func frozen(ipReservation *v3.IPReservation) string {
+	reason := ipReservation.Annotations[cons.FreezeAnnotation]
+	if reason == "false" {
+		return ""
+	}
+	return reason
+}
+
+// setFrozenMetrics exports whether the releases are frozen, and how many reserved IPs exceed the max counts then
+func (r *IPKeeper) setFrozenMetrics(reason string, podIPMap *v1.ConfigMap) {
+	if reason == "" {
+		metrics.IPReserveFrozen.Set(0)
+		metrics.IPReserveFrozenExcess.Set(0)
+		return
+	}
+	metrics.IPReserveFrozen.Set(1)
+	byGroup := map[string]int{}
+	for podIP := range podIPMap.Data {
+		byGroup[r.limitGroup(podIP)]++
+	}
+	excess := 0
+	for group, count := range byGroup {
+		if count > r.maxCount(group) {
+			excess += count - r.maxCount(group)
+		}
+	}
+	metrics.IPReserveFrozenExcess.Set(float64(excess))
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+)
+
+func TestIpReleaseFrozen(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: podIPMapNsName.Name, Namespace: podIPMapNsName.Namespace},
+		Data: map[string]string{
+			"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", now.Add(-time.Hour)),
+			"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", now),
+			"10.0.1.3": buildPodInfo("redis", "redis-2", "node01", now),
+		},
+	}
+	ipReservation := &v3.IPReservation{
+		ObjectMeta: metav1.ObjectMeta{Name: ipReservationNsName.Name,
+			Annotations: map[string]string{cons.FreezeAnnotation: "network incident"}},
+		Spec: v3.IPReservationSpec{ReservedCIDRs: []string{cons.SystemReserveIP, "10.0.1.1", "10.0.1.2", "10.0.1.3"}},
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(1),
+	}, podIPMap, ipReservation)
+	keeper.SetClock(clocktesting.NewFakeClock(now))
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+
+	// neither the expired IP nor the IPs over the max count are released
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Len(t, podIPMap.Data, 3)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveFrozen))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.IPReserveFrozenExcess))
+
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	ipReservation.Annotations[cons.FreezeAnnotation] = "false"
+	assert.NoError(t, c.Update(ctx, ipReservation))
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Len(t, podIPMap.Data, 1)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReserveFrozen))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReserveFrozenExcess))
+}
+
+func TestUnholdFrozen(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	ipReservation := &v3.IPReservation{
+		ObjectMeta: metav1.ObjectMeta{Name: ipReservationNsName.Name,
+			Annotations: map[string]string{cons.FreezeAnnotation: "network incident"}},
+		Spec: v3.IPReservationSpec{ReservedCIDRs: []string{cons.SystemReserveIP}},
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+	}, ipReservation)
+	clock := clocktesting.NewFakeClock(now)
+	keeper.SetClock(clock)
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+
+	until := now.Add(2 * time.Hour)
+	ips := []ipamv1alpha1.HeldIP{{IP: "10.0.1.1", Pod: "redis-0", NodeName: "node01"}}
+	_, err := keeper.Hold(ctx, "redis", ips, until)
+	assert.NoError(t, err)
+
+	// the deleted IPHold keeps its IP reserved until the deadline
+	assert.NoError(t, keeper.Unhold(ctx, "redis", ips, until))
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+
+	// thawed, the release loop frees it once the deadline is over
+	delete(ipReservation.Annotations, cons.FreezeAnnotation)
+	assert.NoError(t, c.Update(ctx, ipReservation))
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+	clock.SetTime(until)
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+}
@@ -1,34 +1,27 @@
 package handler
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
 	cons "github.com/xdfdotcn/capo/pkg/constants"
 	"github.com/xdfdotcn/capo/pkg/metrics"
-	"github.com/xdfdotcn/capo/pkg/utils"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-type patchMapValue struct {
-	Op    string `json:"op"`
-	Path  string `json:"path"`
-	Value string `json:"value"`
-}
-
 // 实现 sort.Interface 接口
 type byDuration []podIPDuration
 
 type podIPDuration struct {
 	podIP    string
 	duration time.Duration
+	// released before its reserve time as the top-level owner of its pod is gone
+	workloadGone bool
 }
 
 type byIp []string
@@ -37,7 +30,7 @@ func (s byIp) Len() int {
 	return len(s)
 }
 func (s byIp) Less(i, j int) bool {
-	return s[i] < s[j]
+	return cidrLess(s[i], s[j])
 }
 func (s byIp) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
@@ -56,70 +49,50 @@ func (b byDuration) Swap(i, j int) {
 	b[i], b[j] = b[j], b[i]
 }
 
+// getReserveCIDRs returns the compacted reserved CIDRs of the IPReservation without releaseIPs, see compactCIDRs,
+// and the number of reserved IPs
 func getReserveCIDRs(ipReservation *v3.IPReservation, releaseIPs []string) ([]string, int64) {
-	var reserveCIDRs []string
-	var totalIP int64
-	hasCidr := make(map[string]bool, len(ipReservation.Spec.ReservedCIDRs))
-	for _, cidr := range ipReservation.Spec.ReservedCIDRs {
-		isRelease := false
-		// If only one ip is released from a cidr segment, all IPs in the segment will be released here
-		// Excluding human factors, this program will not increase the cidr to IP Reservation, but a single IP
-		// todo consider the human factor to add a cidr segment to the IPReservation scenario
-		for _, releaseIP := range releaseIPs {
-			if cidr == releaseIP {
-				isRelease = true
-				break
-			}
-		}
-
-		if !isRelease && !hasCidr[cidr] {
-			if cidr != cons.SystemReserveIP {
-				totalIP += utils.IPRangeSize(utils.ParseCidr(cidr)).Int64()
-			}
-			reserveCIDRs = append(reserveCIDRs, cidr)
-		}
-		hasCidr[cidr] = true
-	}
-
-	//The Kubernetes API server does not recursively create nested objects for JSON patch inputs, so when spec.reservedCIDRs is nil,
-	//JSONPatch will fail, so add a permanent system reserved IP: 1.1.1.1 in reservedCIDRs
-	if !hasCidr[cons.SystemReserveIP] {
-		reserveCIDRs = append(reserveCIDRs, cons.SystemReserveIP)
-	}
-
+	reserveCIDRs, _, totalIP := compactCIDRs(ipReservation.Spec.ReservedCIDRs, compactedCIDRs(ipReservation), releaseIPs)
 	return reserveCIDRs, totalIP
 }
 
-func getPodInfo(podIP, podInfoTime string) (string, string, string, time.Duration, error) {
-	split := strings.Split(podInfoTime, cons.SeparatorUnderscore)
-	if len(split) != 4 {
-		return "", "", "", 0, fmt.Errorf("podInfoTime is invalid, skip podIP %s , podInfoTime %s", podIP, podInfoTime)
-	}
-
-	podNamespace := split[0]
-	podName := split[1]
-	podPlaceNodeName := split[2]
-	ipReservedTimeStr := split[3]
-
-	ipReservedTime, err := time.ParseInLocation(cons.TimeLayout, ipReservedTimeStr, time.Local)
+// getPodInfo returns the node, the namespace and the name of the pod the IP is reserved for, and when it was reserved
+func getPodInfo(podIP, podInfoTime string) (string, string, string, time.Time, error) {
+	info, _, err := parsePodInfo(podInfoTime)
 	if err != nil {
-		return "", "", "", 0, fmt.Errorf("parse podInfoTime is err: %v, skip podIP %s , podInfoTime %s", err.Error(), podIP, podInfoTime)
+		return "", "", "", time.Time{}, fmt.Errorf("%v, skip podIP %s", err, podIP)
 	}
+	reserved, _ := info.reservedTime()
+	return info.Node, info.Namespace, info.Name, reserved, nil
+}
 
-	// keptTime unit is nanosecond
-	keptTime := time.Since(ipReservedTime)
-	return podPlaceNodeName, podNamespace, podName, keptTime, err
+// ValidatePodInfo checks that a pod info ConfigMap entry is an IP with a pod info as value, JSON or legacy
+func ValidatePodInfo(podIP, podInfoTime string) error {
+	if net.ParseIP(podIP) == nil {
+		return fmt.Errorf("%q is not an IP", podIP)
+	}
+	_, _, _, _, err := getPodInfo(podIP, podInfoTime)
+	return err
 }
 
-func getReleaseIPs(podIPMap *v1.ConfigMap, logger logr.Logger, r *IPKeeper) []string {
+// getReleaseIPs removes the IPs to be released from podIPMap: the reservations of the orphaned IPAM blocks under
+// the block release policy, the expired IPs and those of gone workloads, within the release windows and the rate
+// limit, then the longest held IPs over the max count regardless of both. The reserve time and the max count are
+// those of the IPPool of the IP when configured, the max count of a pool bounding its IPs only. It returns the
+// released IPs and how many of them count against the rate limit, all but the IPs over the max count.
+func getReleaseIPs(podIPMap *v1.ConfigMap, logger logr.Logger, r *IPKeeper, now time.Time) ([]string, int) {
 	var remainingIPs []podIPDuration
+	var expiredIPs []podIPDuration
 	var releaseIPs []string
 	for podIP, podInfoTime := range podIPMap.Data {
-		_, _, _, keptTime, err := getPodInfo(podIP, podInfoTime)
+		info, _, err := parsePodInfo(podInfoTime)
 		if err != nil {
-			logger.Info(err.Error())
+			logger.Info(fmt.Sprintf("%v, skip podIP %s", err, podIP))
 			continue
 		}
+		// measured against now rather than the wall clock, so that tests and capo simulate drive the time
+		reserved, _ := info.reservedTime()
+		keptTime := now.Sub(reserved)
 		/*metrics.IPReserveKeptTime.With(map[string]string{
 			cons.LabelPodIP:        podIP,
 			cons.LabelPodNamespace: podNamespace,
@@ -127,24 +100,85 @@ func getReleaseIPs(podIPMap *v1.ConfigMap, logger logr.Logger, r *IPKeeper) []st
 			cons.LabelNodeName:     podPlaceNodeName,
 		}).Set(keptTime.Seconds())*/
 
-		if keptTime < r.config.IPReserveTime.Duration {
+		if keptTime < r.reserveTime(podIP) {
+			if r.ownerGone(info) {
+				expiredIPs = append(expiredIPs, podIPDuration{
+					podIP:        podIP,
+					duration:     keptTime,
+					workloadGone: true,
+				})
+				continue
+			}
 			remainingIPs = append(remainingIPs, podIPDuration{
 				podIP:    podIP,
 				duration: keptTime,
 			})
 			continue
 		}
+		expiredIPs = append(expiredIPs, podIPDuration{
+			podIP:    podIP,
+			duration: keptTime,
+		})
+	}
+
+	orphaned, expiredIPs, remainingIPs := r.applyBlockPolicy(expiredIPs, remainingIPs)
+
+	inWindow := r.inReleaseWindow(now)
+	budget := r.limiter.budget(now)
+	// the reason each expired IP is held back for
+	heldBack := map[string]string{}
+	release := func(item podIPDuration, reason string) {
+		if !inWindow {
+			heldBack[item.podIP] = cons.ReleasePendingWindow
+			remainingIPs = append(remainingIPs, item)
+			return
+		}
+		if budget == 0 {
+			heldBack[item.podIP] = cons.ReleasePendingRateLimit
+			remainingIPs = append(remainingIPs, item)
+			return
+		}
+		budget--
 
 		//IP to be released
-		releaseIPs = append(releaseIPs, podIP)
-		delete(podIPMap.Data, podIP)
+		r.countRelease(reason, item)
+		releaseIPs = append(releaseIPs, item.podIP)
+		delete(podIPMap.Data, item.podIP)
+	}
+	// the reservations of the orphaned blocks first, then the longest held expired IPs
+	for _, item := range orphaned {
+		release(item, cons.ReleaseReasonBlock)
 	}
+	sort.Stable(byDuration(expiredIPs))
+	for _, item := range expiredIPs {
+		reason := cons.ReleaseReasonTTL
+		if item.workloadGone {
+			reason = cons.ReleaseReasonWorkloadGone
+		}
+		release(item, reason)
+	}
+	expired := len(releaseIPs)
 
-	releaseCount := len(remainingIPs) - *r.config.IPReserveMaxCount
-	if releaseCount > 0 {
+	// the max count is enforced within every pool, the IPs of the pools without settings share the global one
+	groups := map[string][]podIPDuration{}
+	for _, item := range remainingIPs {
+		group := r.limitGroup(item.podIP)
+		groups[group] = append(groups[group], item)
+	}
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		groupIPs := groups[group]
+		releaseCount := len(groupIPs) - r.maxCount(group)
+		if releaseCount <= 0 {
+			continue
+		}
 		// Sorted by the saved duration from largest to smallest
-		sort.Stable(byDuration(remainingIPs))
-		for _, item := range remainingIPs {
+		sort.Stable(byDuration(groupIPs))
+		for _, item := range groupIPs {
 			if releaseCount <= 0 {
 				break
 			}
@@ -154,8 +188,13 @@ func getReleaseIPs(podIPMap *v1.ConfigMap, logger logr.Logger, r *IPKeeper) []st
 				logger.Info(err.Error())
 				continue
 			}
-			// because the count reaches the threshold
+			// because the count reaches the threshold, under pressure when the IP is evicted before its reserve time
 			metrics.IPReserveEvictionsCount.Inc()
+			reason := cons.ReleaseReasonCount
+			if item.duration < r.reserveTime(podIP) {
+				reason = cons.ReleaseReasonPressure
+			}
+			r.countRelease(reason, item)
 			/*metrics.IPReserveEvictionsInfo.With(map[string]string{
 				cons.LabelPodIP:        podIP,
 				cons.LabelPodNamespace: podNamespace,
@@ -164,14 +203,69 @@ func getReleaseIPs(podIPMap *v1.ConfigMap, logger logr.Logger, r *IPKeeper) []st
 				cons.LabelKeptTime:     fmt.Sprintf("%v", keptTime.Seconds()),
 			}).Set(1)*/
 			delete(podIPMap.Data, podIP)
+			delete(heldBack, podIP)
 			releaseIPs = append(releaseIPs, podIP)
 			releaseCount--
 		}
 	}
-	return releaseIPs
+
+	pending := map[string]int{cons.ReleasePendingWindow: 0, cons.ReleasePendingRateLimit: 0}
+	for _, reason := range heldBack {
+		pending[reason]++
+	}
+	for reason, count := range pending {
+		metrics.IPReleasePending.WithLabelValues(reason).Set(float64(count))
+	}
+	if len(heldBack) > 0 {
+		logger.Info("expired IPs held back", "window", pending[cons.ReleasePendingWindow],
+			"rateLimit", pending[cons.ReleasePendingRateLimit])
+	}
+	return releaseIPs, expired
+}
+
+// countRelease counts the release of the IP for the reason
+func (r *IPKeeper) countRelease(reason string, item podIPDuration) {
+	metrics.IPReleaseTotal.WithLabelValues(reason).Inc()
+	metrics.IPReserveHeldSeconds.Observe(item.duration.Seconds())
+	if r.poolsEnabled() {
+		metrics.IPReleaseByPoolTotal.WithLabelValues(r.poolOf(item.podIP), reason).Inc()
+	}
+}
+
+// setHeldMetrics counts the remaining reserved IPs by the namespace, the node and the top-level owner kind of their former pod
+func setHeldMetrics(podIPMap *v1.ConfigMap) {
+	byNamespace := map[string]int{}
+	byNode := map[string]int{}
+	byOwnerKind := map[string]int{}
+	for podIP, podInfoTime := range podIPMap.Data {
+		nodeName, podNamespace, _, _, err := getPodInfo(podIP, podInfoTime)
+		if err != nil {
+			continue
+		}
+		byNamespace[podNamespace]++
+		byNode[nodeName]++
+		if owner := podInfoOwner(podInfoTime); owner != "" {
+			byOwnerKind[ownerKind(owner)]++
+		}
+	}
+
+	// namespaces and nodes without reserved IPs anymore must disappear
+	metrics.IPReserveHeldByNamespace.Reset()
+	for namespace, count := range byNamespace {
+		metrics.IPReserveHeldByNamespace.WithLabelValues(namespace).Set(float64(count))
+	}
+	metrics.IPReserveHeldByNode.Reset()
+	for nodeName, count := range byNode {
+		metrics.IPReserveHeldByNode.WithLabelValues(nodeName).Set(float64(count))
+	}
+	metrics.IPReserveHeldByOwnerKind.Reset()
+	for kind, count := range byOwnerKind {
+		metrics.IPReserveHeldByOwnerKind.WithLabelValues(kind).Set(float64(count))
+	}
 }
 
-func getResources(pod *v1.Pod) (*v1.ConfigMap, []byte) {
+// getResources returns the pod info of the IPs of the pod, reserved at now
+func getResources(pod *v1.Pod, ips []string, owner string, now time.Time) *v1.ConfigMap {
 	podIPMap := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      podIPMapNsName.Name,
@@ -181,49 +275,59 @@ func getResources(pod *v1.Pod) (*v1.ConfigMap, []byte) {
 	}
 
 	// Must not update the time of the reserved IP already
-	var patches []patchMapValue
-	for _, ip := range pod.Status.PodIPs {
-		podIPMap.Data[ip.IP] = buildPodInfo(pod.Namespace, pod.Name, pod.Spec.NodeName, time.Now())
-
-		patch := patchMapValue{
-			Op:    "add",
-			Path:  "/spec/reservedCIDRs/-",
-			Value: ip.IP,
+	for _, ip := range ips {
+		podIPMap.Data[ip] = withOwner(buildPodInfo(pod.Namespace, pod.Name, pod.Spec.NodeName, now), owner)
+	}
+
+	return podIPMap
+}
+
+// mergePodInfos records the pod infos into podIPMap. The pod info of an IP already recorded for the same pod and
+// owner is kept with its timestamp, so that repeated deletions of a pod do not extend its reservation.
+// It reports whether podIPMap changed.
+func mergePodInfos(podIPMap *v1.ConfigMap, podInfos map[string]string) bool {
+	if podIPMap.Data == nil {
+		podIPMap.Data = map[string]string{}
+	}
+	changed := false
+	for ip, podInfo := range podInfos {
+		if recorded, ok := podIPMap.Data[ip]; ok && samePodInfoOwner(recorded, podInfo) {
+			continue
 		}
-		patches = append(patches, patch)
+		podIPMap.Data[ip] = podInfo
+		changed = true
 	}
-	patchJson, _ := json.Marshal(patches)
+	return changed
+}
 
-	return podIPMap, patchJson
+// samePodInfoOwner reports whether both pod infos record the same pod and owner
+func samePodInfoOwner(a, b string) bool {
+	infoA, _, errA := parsePodInfo(a)
+	infoB, _, errB := parsePodInfo(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return infoA.Namespace == infoB.Namespace && infoA.Name == infoB.Name && infoA.Owner == infoB.Owner
 }
 
+// buildPodInfo returns the JSON pod info of an IP reserved at now
 func buildPodInfo(namespace, name, nodeName string, now time.Time) string {
-	return fmt.Sprintf(cons.IPInfoPlaceholder, namespace, cons.SeparatorUnderscore,
-		name, cons.SeparatorUnderscore,
-		nodeName, cons.SeparatorUnderscore,
-		now.Format(cons.TimeLayout))
+	return newPodInfo(namespace, name, nodeName, now).String()
 }
 
-func ipDeduplicateAppend(pod *v1.Pod, ipReservation *v3.IPReservation, logger logr.Logger) []string {
+// ipDeduplicateAppend appends the IPs not reserved yet to the IPReservation, and returns them
+func ipDeduplicateAppend(ips []string, ipReservation *v3.IPReservation, logger logr.Logger) []string {
 	var addedIP []string
 	// deduplicate
-	for _, ip := range pod.Status.PodIPs {
-		exist := false
-		for _, cidr := range ipReservation.Spec.ReservedCIDRs {
-			ipNet := utils.ParseCidr(cidr)
-			if ipNet == nil {
-				logger.Info("is invalid", "cidr", cidr)
-				continue
-			}
-
-			if ipNet.Contains(net.ParseIP(ip.IP)) {
-				exist = true
-				break
-			}
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			logger.Info("is invalid", "ip", ip)
+			continue
 		}
-		if !exist {
-			addedIP = append(addedIP, ip.IP)
-			ipReservation.Spec.ReservedCIDRs = append(ipReservation.Spec.ReservedCIDRs, ip.IP)
+		if !reservationCovers(ipReservation, parsed) {
+			addedIP = append(addedIP, ip)
+			ipReservation.Spec.ReservedCIDRs = append(ipReservation.Spec.ReservedCIDRs, ip)
 		}
 	}
 	return addedIP
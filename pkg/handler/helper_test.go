@@ -1,17 +1,18 @@
 package handler
 
 import (
-	"fmt"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/go-logr/logr"
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
 	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
 	"github.com/xdfdotcn/capo/pkg/utils"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -71,21 +72,14 @@ func TestExampleTestSuite(t *testing.T) {
 // All methods that begin with "Test" are run as tests within a
 // suite.
 func (suite *ExampleTestSuite) TestIPDeduplicateAppend() {
-	addIps := ipDeduplicateAppend(suite.pod, suite.ipReservation, suite.logger)
+	addIps := ipDeduplicateAppend([]string{suite.pod.Status.PodIP}, suite.ipReservation, suite.logger)
 	suite.Empty(addIps)
 
 	ip1 := "5.5.5.5"
-	pod := &v1.Pod{
-		Status: v1.PodStatus{
-			PodIPs: []v1.PodIP{
-				{
-					IP: ip1,
-				},
-			},
-		},
-	}
-	addIps = ipDeduplicateAppend(pod, suite.ipReservation, suite.logger)
-	suite.Contains(addIps, ip1)
+	addIps = ipDeduplicateAppend([]string{ip1, ip1, "invalid"}, suite.ipReservation, suite.logger)
+	suite.Equal([]string{ip1}, addIps)
+	addIps = ipDeduplicateAppend([]string{ip1}, suite.ipReservation, suite.logger)
+	suite.Empty(addIps)
 }
 
 func TestTimeFormat(t *testing.T) {
@@ -123,8 +117,10 @@ func TestSortByIP(t *testing.T) {
 		ip1 = "1.1.1.1"
 		ip2 = "3.1.1.1"
 		ip3 = "5.1.1.1"
+		ip4 = "10.1.1.1"
 	)
 	bIP := byIp{
+		ip4,
 		ip2,
 		ip1,
 		ip3,
@@ -135,6 +131,7 @@ func TestSortByIP(t *testing.T) {
 	assert.Equal(t, ip1, bIP[0])
 	assert.Equal(t, ip2, bIP[1])
 	assert.Equal(t, ip3, bIP[2])
+	assert.Equal(t, ip4, bIP[3])
 }
 
 func (suite *ExampleTestSuite) TestGetReserveCIDRs() {
@@ -177,8 +174,9 @@ func (suite *ExampleTestSuite) TestGetPodInfo() {
 	startTime, err := time.Parse(cons.TimeLayout, startStr)
 	suite.Nil(err)
 	podInfo := buildPodInfo(ns, name, nn, startTime)
-	nodeName, podNs, podName, _, err := getPodInfo(ip, podInfo)
+	nodeName, podNs, podName, reserved, err := getPodInfo(ip, podInfo)
 	suite.Nil(err)
+	suite.True(startTime.Equal(reserved))
 	suite.Equal(nodeName, nodeName)
 	suite.Equal(nn, nodeName)
 	suite.Equal(ns, podNs)
@@ -206,6 +204,8 @@ func (suite *ExampleTestSuite) TestGetReleaseIPs() {
 		"10.0.1.2",
 		"10.0.1.3",
 	}
+	// a day after the legacy pod infos below, in any local time zone
+	now := time.Date(2022, 11, 26, 0, 0, 0, 0, time.UTC)
 	podIPMap := &v1.ConfigMap{
 		Data: map[string]string{
 			ips[0]: "redis_test0-1_node01_2022-11-24-14:33:22",
@@ -214,15 +214,15 @@ func (suite *ExampleTestSuite) TestGetReleaseIPs() {
 		},
 	}
 
-	releaseIPs := getReleaseIPs(podIPMap, suite.logger, keeper)
+	releaseIPs, _ := getReleaseIPs(podIPMap, suite.logger, keeper, now)
 	for _, ip := range ips {
 		suite.Contains(releaseIPs, ip)
 	}
 
 	// did not reach the release time
 	ip1 := "1.1.1.3"
-	podIPMap.Data[ip1] = buildPodInfo("redis", "test4", "node09", time.Now())
-	releaseIPs = getReleaseIPs(podIPMap, suite.logger, keeper)
+	podIPMap.Data[ip1] = buildPodInfo("redis", "test4", "node09", now)
+	releaseIPs, _ = getReleaseIPs(podIPMap, suite.logger, keeper, now)
 	suite.NotContains(releaseIPs, ip1)
 
 	// The number of IP reservations reaches the threshold
@@ -232,7 +232,6 @@ func (suite *ExampleTestSuite) TestGetReleaseIPs() {
 
 	keeper.config.IPReserveMaxCount = pointer.Int(max)
 
-	now := time.Now()
 	time1 := now.Add(-2 * time.Minute)
 	podIPMap.Data[ip1] = buildPodInfo("redis", "test4", "node09", time1)
 
@@ -244,7 +243,7 @@ func (suite *ExampleTestSuite) TestGetReleaseIPs() {
 	ip3 := "4.5.6.7"
 	podIPMap.Data[ip3] = buildPodInfo("redis2", "test6", "node01", time3)
 
-	releaseIPs = getReleaseIPs(podIPMap, suite.logger, keeper)
+	releaseIPs, _ = getReleaseIPs(podIPMap, suite.logger, keeper, now)
 	suite.Len(podIPMap.Data, max)
 	suite.Contains(podIPMap.Data, ip1)
 	suite.NotContains(releaseIPs, ip1)
@@ -253,11 +252,69 @@ func (suite *ExampleTestSuite) TestGetReleaseIPs() {
 }
 
 func (suite *ExampleTestSuite) TestGetResources() {
-	patchTph := `[{"op":"add","path":"/spec/reservedCIDRs/-","value":"%s"}]`
-	podIPMap, patchJson := getResources(suite.pod)
-	curTime := time.Now()
+	curTime := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := getResources(suite.pod, []string{suite.pod.Status.PodIP}, "", curTime)
 	suite.Equal(podIPMap.Data[suite.pod.Status.PodIP], buildPodInfo(suite.pod.Namespace, suite.pod.Name, suite.pod.Spec.NodeName, curTime))
+	podIPMap = getResources(suite.pod, []string{suite.pod.Status.PodIP}, "RedisCluster.redis.io/redis", curTime)
+	suite.Equal(podIPMap.Data[suite.pod.Status.PodIP], withOwner(buildPodInfo(suite.pod.Namespace, suite.pod.Name, suite.pod.Spec.NodeName, curTime), "RedisCluster.redis.io/redis"))
+	suite.Equal("RedisCluster.redis.io/redis", podInfoOwner(podIPMap.Data[suite.pod.Status.PodIP]))
 	suite.Equal(podIPMap.Name, podIPMapNsName.Name)
 	suite.Equal(podIPMap.Namespace, podIPMapNsName.Namespace)
-	suite.Equal(string(patchJson), fmt.Sprintf(patchTph, suite.pod.Status.PodIP))
+}
+
+func TestMergePodInfos(t *testing.T) {
+	reserved := time.Now().Add(-10 * time.Minute)
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		"10.0.0.1": buildPodInfo("redis", "redis-0", "node01", reserved),
+		"10.0.0.2": withOwner(buildPodInfo("redis", "redis-1", "node01", reserved), "RedisCluster.redis.io/redis"),
+		"10.0.0.3": buildPodInfo(cons.DriftUnknownOwner, cons.DriftUnknownOwner, cons.DriftUnknownOwner, reserved),
+	}}
+	now := time.Now()
+	// the same pod deleted again keeps its timestamp
+	assert.False(t, mergePodInfos(podIPMap, map[string]string{
+		"10.0.0.1": buildPodInfo("redis", "redis-0", "node02", now),
+	}))
+	assert.Equal(t, buildPodInfo("redis", "redis-0", "node01", reserved), podIPMap.Data["10.0.0.1"])
+
+	// another owner, another pod, or a new IP are recorded
+	assert.True(t, mergePodInfos(podIPMap, map[string]string{
+		"10.0.0.2": buildPodInfo("redis", "redis-1", "node01", now),
+		"10.0.0.3": buildPodInfo("redis", "redis-2", "node01", now),
+		"10.0.0.4": buildPodInfo("redis", "redis-3", "node01", now),
+	}))
+	assert.Equal(t, buildPodInfo("redis", "redis-1", "node01", now), podIPMap.Data["10.0.0.2"])
+	assert.Equal(t, buildPodInfo("redis", "redis-2", "node01", now), podIPMap.Data["10.0.0.3"])
+	assert.Equal(t, buildPodInfo("redis", "redis-3", "node01", now), podIPMap.Data["10.0.0.4"])
+}
+
+func (suite *ExampleTestSuite) TestReleaseMetrics() {
+	keeper := &IPKeeper{
+		config: &configv1.CapoConfig{
+			IPReserveMaxCount: pointer.Int(1),
+			IPReserveTime: metav1.Duration{
+				Duration: 40 * time.Minute,
+			},
+		},
+	}
+	ttlBefore := testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonTTL))
+	pressureBefore := testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonPressure))
+
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{
+		Data: map[string]string{
+			"10.0.1.1": buildPodInfo("redis", "test-0", "node01", now.Add(-time.Hour)),
+			"10.0.1.2": buildPodInfo("redis", "test-1", "node01", now.Add(-10*time.Minute)),
+			"10.0.1.3": buildPodInfo("kafka", "test-2", "node02", now.Add(-time.Minute)),
+		},
+	}
+	releaseIPs, _ := getReleaseIPs(podIPMap, suite.logger, keeper, now)
+	suite.ElementsMatch([]string{"10.0.1.1", "10.0.1.2"}, releaseIPs)
+	suite.Equal(ttlBefore+1, testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonTTL)))
+	// evicted by the max count before its reserve time
+	suite.Equal(pressureBefore+1, testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonPressure)))
+
+	setHeldMetrics(podIPMap)
+	suite.Equal(float64(1), testutil.ToFloat64(metrics.IPReserveHeldByNamespace.WithLabelValues("kafka")))
+	suite.Equal(float64(1), testutil.ToFloat64(metrics.IPReserveHeldByNode.WithLabelValues("node02")))
+	suite.Equal(1, testutil.CollectAndCount(metrics.IPReserveHeldByNamespace))
 }
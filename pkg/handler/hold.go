@@ -0,0 +1,189 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"net"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// The pod info only records when an IP was reserved, and the release loop frees it the reserve time of its pool later.
+// A hold until a deadline is therefore recorded as a reservation made that reserve time before the deadline.
+
+// heldSince returns the reservation time recorded for the IP held until the deadline
+func (r *IPKeeper) heldSince(ip string, until time.Time) time.Time {
+	return until.Add(-r.reserveTime(ip))
+}
+
+// heldUntil returns when the IP of a pod info is released, and the namespace and the name of its pod
+func (r *IPKeeper) heldUntil(ip, podInfoTime string) (time.Time, string, string, error) {
+	info, _, err := parsePodInfo(podInfoTime)
+	if err != nil {
+		return time.Time{}, "", "", err
+	}
+	reservedTime, _ := info.reservedTime()
+	return reservedTime.Add(r.reserveTime(ip)), info.Namespace, info.Name, nil
+}
+
+// Hold reserves the IPs of pods of namespace until the deadline. IPs already reserved for a later deadline
+// keep it, IPs reserved for another pod are left untouched and returned as conflicts.
+func (r *IPKeeper) Hold(ctx context.Context, namespace string, ips []ipamv1alpha1.HeldIP, until time.Time) (conflicts []string, err error) {
+	if !r.Initialized() {
+		return nil, errNotInitialized
+	}
+	r.releaseMu.Lock()
+	defer r.releaseMu.Unlock()
+	if err := r.refreshPools(ctx); err != nil {
+		log.FromContext(ctx).Info("refresh IPPools failed, using the cached pools", "err", err.Error())
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipReservation, podIPMap, err := r.getResources(ctx)
+		if err != nil {
+			return err
+		}
+		if podIPMap.Data == nil {
+			podIPMap.Data = map[string]string{}
+		}
+
+		conflicts = nil
+		recorded, reserved := false, false
+		for _, held := range ips {
+			ip := net.ParseIP(held.IP)
+			if ip == nil {
+				conflicts = append(conflicts, held.IP)
+				continue
+			}
+			record, owner := true, ""
+			if podInfoTime, ok := podIPMap.Data[held.IP]; ok {
+				deadline, podNamespace, podName, err := r.heldUntil(held.IP, podInfoTime)
+				if err == nil && podNamespace != cons.DriftUnknownOwner && (podNamespace != namespace || podName != held.Pod) {
+					conflicts = append(conflicts, held.IP)
+					continue
+				}
+				record = err != nil || deadline.Before(until.Truncate(time.Second))
+				owner = podInfoOwner(podInfoTime)
+			}
+			if record {
+				podIPMap.Data[held.IP] = withOwner(buildPodInfo(namespace, held.Pod, held.NodeName, r.heldSince(held.IP, until)), owner)
+				recorded = true
+			}
+			if !reservationCovers(ipReservation, ip) {
+				ipReservation.Spec.ReservedCIDRs = append(ipReservation.Spec.ReservedCIDRs, held.IP)
+				reserved = true
+			}
+		}
+
+		// the pod info first, like IpReserve, so that the drift check never sees an unrecorded IP
+		if recorded {
+			err = kubeCall(ctx, "ConfigMap update", func(ctx context.Context) error {
+				return r.client.Update(ctx, podIPMap)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if reserved {
+			return r.updateReservation(ctx, ipReservation)
+		}
+		return nil
+	})
+	return conflicts, err
+}
+
+// Unhold releases the IPs of pods of namespace still held until the deadline, IPs reserved since
+// for another reason, e.g. the deletion of their pod, stay reserved. While releases are frozen the IPs
+// stay reserved until the deadline, the release loop frees them once thawed.
+func (r *IPKeeper) Unhold(ctx context.Context, namespace string, ips []ipamv1alpha1.HeldIP, until time.Time) error {
+	if !r.Initialized() {
+		return errNotInitialized
+	}
+	r.releaseMu.Lock()
+	defer r.releaseMu.Unlock()
+	if err := r.refreshPools(ctx); err != nil {
+		log.FromContext(ctx).Info("refresh IPPools failed, using the cached pools", "err", err.Error())
+	}
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipReservation, podIPMap, err := r.getResources(ctx)
+		if err != nil {
+			return err
+		}
+		if reason := frozen(ipReservation); reason != "" {
+			log.FromContext(ctx).Info("releases frozen, the held IPs are kept until the deadline",
+				"reason", reason, "until", until)
+			return nil
+		}
+
+		var releaseIPs []string
+		podInfos := map[string]string{}
+		for _, held := range ips {
+			podInfoTime, ok := podIPMap.Data[held.IP]
+			if !ok {
+				continue
+			}
+			deadline, podNamespace, podName, err := r.heldUntil(held.IP, podInfoTime)
+			if err != nil || podNamespace != namespace || podName != held.Pod || !deadline.Equal(until.Truncate(time.Second)) {
+				continue
+			}
+			podInfos[held.IP] = podInfoTime
+			releaseIPs = append(releaseIPs, held.IP)
+			delete(podIPMap.Data, held.IP)
+		}
+		if len(releaseIPs) == 0 {
+			return nil
+		}
+
+		changed, totalIP := compactReservation(ipReservation, releaseIPs)
+		if changed {
+			err = r.updateReservation(ctx, ipReservation)
+			if err != nil {
+				return err
+			}
+		}
+		err = kubeCall(ctx, "ConfigMap update", func(ctx context.Context) error {
+			return r.client.Update(ctx, podIPMap)
+		})
+		if err != nil {
+			return err
+		}
+
+		metrics.IPReserveCount.Set(float64(totalIP))
+		now := r.clock.Now()
+		for _, podIP := range releaseIPs {
+			nodeName, podNamespace, podName, reserved, err := getPodInfo(podIP, podInfos[podIP])
+			if err != nil {
+				continue
+			}
+			// the reservation time recorded for a hold is in the future until the hold is almost over
+			held := now.Sub(reserved)
+			if held < 0 {
+				held = 0
+			}
+			r.countRelease(cons.ReleaseReasonManual, podIPDuration{podIP: podIP, duration: held})
+			r.history.Released(podIP, podNamespace, podName, nodeName, now)
+		}
+		return nil
+	})
+}
+
+// reservationCovers reports whether ip is in a reserved CIDR
+func reservationCovers(ipReservation *v3.IPReservation, ip net.IP) bool {
+	for _, cidr := range ipReservation.Spec.ReservedCIDRs {
+		if ipNet := utils.ParseCidr(cidr); ipNet != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
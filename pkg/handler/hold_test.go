@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+)
+
+func TestHold(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: podIPMapNsName.Name, Namespace: podIPMapNsName.Namespace},
+		Data: map[string]string{
+			// reserved for a pod of another namespace
+			"10.0.1.2": buildPodInfo("kafka", "kafka-0", "node02", now),
+		},
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+	}, podIPMap)
+	keeper.SetClock(clocktesting.NewFakeClock(now))
+	ctx := context.Background()
+
+	until := now.Add(2 * time.Hour).Truncate(time.Second)
+	ips := []ipamv1alpha1.HeldIP{
+		{IP: "10.0.1.1", Pod: "redis-0", NodeName: "node01"},
+		{IP: "10.0.1.2", Pod: "redis-1", NodeName: "node01"},
+	}
+	conflicts, err := keeper.Hold(ctx, "redis", ips, until)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.1.2"}, conflicts)
+
+	stored := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, stored))
+	assert.Equal(t, buildPodInfo("redis", "redis-0", "node01", until.Add(-30*time.Minute)), stored.Data["10.0.1.1"])
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.2")
+
+	// the release loop keeps the IP until the hold expires
+	assert.NoError(t, keeper.IpRelease(ctx, utils.CreateLogger(true, true)))
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Contains(t, ipReservation.Spec.ReservedCIDRs, "10.0.1.1")
+
+	// a shorter hold does not shorten the reservation
+	_, err = keeper.Hold(ctx, "redis", ips[:1], now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, stored))
+	assert.Equal(t, buildPodInfo("redis", "redis-0", "node01", until.Add(-30*time.Minute)), stored.Data["10.0.1.1"])
+
+	// only the IPs still held until the deadline are released
+	assert.NoError(t, keeper.Unhold(ctx, "redis", ips, now.Add(time.Hour)))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, stored))
+	assert.Contains(t, stored.Data, "10.0.1.1")
+	assert.NoError(t, keeper.Unhold(ctx, "redis", ips, until))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, stored))
+	assert.NotContains(t, stored.Data, "10.0.1.1")
+	assert.Contains(t, stored.Data, "10.0.1.2")
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Equal(t, []string{cons.SystemReserveIP}, ipReservation.Spec.ReservedCIDRs)
+}
@@ -3,30 +3,64 @@ package handler
 import (
 	"context"
 	"fmt"
-	"os"
-	"sort"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
 	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
 	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/history"
 	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/tracing"
 	"github.com/xdfdotcn/capo/pkg/utils"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 type IPKeeper struct {
-	client   client.Client
-	config   *configv1.CapoConfig
-	selector *utils.AnyMatchSelector
+	client    client.Client
+	config    *configv1.CapoConfig
+	selectors utils.PodSelectors
+	history   *history.Ledger
+	windows   []releaseWindow
+	limiter   *releaseLimiter
+	blocks    blockCache
+	pools     poolCache
+	// settings of the configured IPPools by name
+	poolSettings map[string]configv1.IPPoolConfig
+	// nil writes every reservation on its own
+	batcher *reserveBatcher
+	// the pod info ConfigMap, the shadow one in shadow mode
+	podIPMapKey types.NamespacedName
+	// the time of reservations, releases and drift repairs
+	clock clock.PassiveClock
+	// the namespace/owner keys of the recorded top-level owners found gone by the release cycle, under releaseMu
+	goneOwners map[string]bool
+
+	// unix nanoseconds of the start and the finish of the last release cycle
+	releaseStarted  int64
+	releaseFinished int64
+	// unix nanoseconds of when the IPReservation and the pod info ConfigMap were ensured, 0 until then
+	initializedAt int64
+	// serializes the release cycles with Hold, Unhold and ReconcileDrift; the other writers, the reservations and
+	// the batcher flush, don't take it and rely on optimistic updates retried on resourceVersion conflicts
+	releaseMu sync.Mutex
 }
 
+var errNotInitialized = fmt.Errorf("IPKeeper is not initialized")
+
 var (
 	podIPMapNsName = types.NamespacedName{
 		Name:      cons.IPReservationName,
@@ -40,68 +74,247 @@ var (
 
 func init() {
 	// update namespace
-	ns := os.Getenv(cons.EnvNamespace)
-	if ns != "" {
-		podIPMapNsName.Namespace = ns
-	}
+	podIPMapNsName.Namespace = utils.GetNamespace()
+}
+
+// PodIPMapKey is the key of the ConfigMap holding the pod info of the reserved IPs
+func PodIPMapKey() types.NamespacedName {
+	return podIPMapNsName
 }
 
+// IPReservationKey is the key of the Calico IPReservation holding the reserved IPs
+func IPReservationKey() types.NamespacedName {
+	return ipReservationNsName
+}
+
+// NewIPKeeper returns a keeper whose resources are initialized
 func NewIPKeeper(client client.Client, config *configv1.CapoConfig) (*IPKeeper, error) {
-	if config.LabelSelector == nil {
-		config.LabelSelector = &metav1.LabelSelector{
-			MatchExpressions: []metav1.LabelSelectorRequirement{
-				{
-					Key:      cons.LabelSelectorStatefulSetPodKey,
-					Operator: metav1.LabelSelectorOpExists,
-				},
-				{
-					Key:      cons.LabelSelectorKafkaPodKey,
-					Operator: metav1.LabelSelectorOpExists,
-				},
-			},
-		}
-	}
-	selector, err := metav1.LabelSelectorAsSelector(config.LabelSelector)
+	keeper, err := NewLazyIPKeeper(client, config)
 	if err != nil {
 		return nil, err
 	}
-	requirements, _ := selector.Requirements()
-	anySelector := utils.NewAnyMatchSelector(selector, requirements)
-
-	keeper := &IPKeeper{
-		client:   client,
-		config:   config,
-		selector: anySelector,
+	if err = keeper.Init(context.TODO()); err != nil {
+		return nil, err
 	}
+	return keeper, nil
+}
 
-	err = keeper.initResources(context.TODO())
+// NewLazyIPKeeper returns a keeper whose resources are initialized by Start, so that
+// capo keeps running while its dependencies, such as the calico-apiserver, are not up yet.
+func NewLazyIPKeeper(client client.Client, config *configv1.CapoConfig) (*IPKeeper, error) {
+	if len(config.PodSelectors) == 0 {
+		if config.LabelSelector == nil {
+			config.LabelSelector = utils.DefaultLabelSelector()
+		}
+		config.PodSelectors = utils.LegacyPodSelectors(config.LabelSelector)
+	}
+	selectors, err := utils.NewPodSelectors(config.PodSelectors)
+	if err != nil {
+		return nil, err
+	}
+	windows, err := newReleaseWindows(config.ReleaseWindows)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newReleaseLimiter(config.ReleaseRateLimit)
 	if err != nil {
 		return nil, err
 	}
+	if blocks := config.IPAMBlocks; blocks != nil && blocks.ReleasePolicy != "" &&
+		blocks.ReleasePolicy != cons.BlockReleasePolicyIP && blocks.ReleasePolicy != cons.BlockReleasePolicyBlock {
+		return nil, fmt.Errorf("unknown IPAM block release policy %q", blocks.ReleasePolicy)
+	}
+	poolSettings, err := newPoolSettings(config.IPPools)
+	if err != nil {
+		return nil, err
+	}
+
+	keeper := &IPKeeper{
+		client:    client,
+		config:    config,
+		selectors: selectors,
+		windows:   windows,
+		limiter:   limiter,
+
+		poolSettings: poolSettings,
+		podIPMapKey:  podIPMapNsName,
+		clock:        clock.RealClock{},
+	}
+	if config.ShadowMode {
+		keeper.podIPMapKey = shadowPodIPMapNsName
+		metrics.IPReserveShadow.Set(1)
+	} else {
+		metrics.IPReserveShadow.Set(0)
+	}
+	keeper.batcher = newReserveBatcher(config.ReserveBatchWindow, keeper.writeReservation)
+	keeper.setDegradedMetric()
 
 	return keeper, nil
 }
 
-func (r *IPKeeper) IpRelease(ctx context.Context, logger logr.Logger) error {
+// Init ensures the IPReservation and the pod info ConfigMap exist
+func (r *IPKeeper) Init(ctx context.Context) error {
+	if err := r.initResources(ctx); err != nil {
+		return err
+	}
+	atomic.CompareAndSwapInt64(&r.initializedAt, 0, time.Now().UnixNano())
+	r.setDegradedMetric()
+	return nil
+}
+
+// Initialized reports whether Init succeeded
+func (r *IPKeeper) Initialized() bool {
+	return atomic.LoadInt64(&r.initializedAt) != 0
+}
+
+// InitializedAt returns when Init first succeeded, the zero time until it does
+func (r *IPKeeper) InitializedAt() time.Time {
+	if at := atomic.LoadInt64(&r.initializedAt); at != 0 {
+		return time.Unix(0, at)
+	}
+	return time.Time{}
+}
+
+// Degraded reports whether pod deletions are to be allowed without reserving IPs,
+// that is while the keeper is not initialized and the degraded mode is enabled
+func (r *IPKeeper) Degraded() bool {
+	return r.config.DegradedMode && !r.Initialized()
+}
+
+func (r *IPKeeper) setDegradedMetric() {
+	if r.Degraded() {
+		metrics.IPReserveDegraded.Set(1)
+	} else {
+		metrics.IPReserveDegraded.Set(0)
+	}
+}
+
+// Start initializes the keeper, retrying with backoff until it succeeds
+func (r *IPKeeper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("keeper")
+	backoff := wait.Backoff{
+		Duration: cons.KeeperInitBackoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      cons.KeeperInitMaxBackoff,
+	}
+	for !r.Initialized() {
+		err := r.Init(ctx)
+		if err == nil {
+			logger.Info("IPKeeper initialized")
+			break
+		}
+		delay := backoff.Step()
+		logger.Error(err, "init IPKeeper failed, retrying", "after", delay.String(), "degraded", r.Degraded())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica serves the webhook
+func (r *IPKeeper) NeedLeaderElection() bool {
+	return false
+}
+
+// SetHistory makes the keeper record reservations and releases in the ownership history
+func (r *IPKeeper) SetHistory(ledger *history.Ledger) {
+	r.history = ledger
+}
+
+// SetClock makes the keeper reserve and release IPs, hold them and expire its IPPool and IPAM block
+// caches at the time of c rather than the wall clock, so that tests and simulations drive the reserve
+// time. The release cycle times and the reserve batches stay on the wall clock.
+func (r *IPKeeper) SetClock(c clock.PassiveClock) {
+	r.clock = c
+}
+
+// Clock returns the clock the keeper reserves and releases IPs at
+func (r *IPKeeper) Clock() clock.PassiveClock {
+	return r.clock
+}
+
+// Selects reports whether a pod selector matches the pod, whatever its namespace
+func (r *IPKeeper) Selects(pod *v1.Pod) bool {
+	return r.selectors.SelectsPod(pod)
+}
+
+// ReleaseTimes returns the start and the finish time of the last release cycle
+func (r *IPKeeper) ReleaseTimes() (started, finished time.Time) {
+	return time.Unix(0, atomic.LoadInt64(&r.releaseStarted)), time.Unix(0, atomic.LoadInt64(&r.releaseFinished))
+}
+
+func (r *IPKeeper) IpRelease(ctx context.Context, logger logr.Logger) (err error) {
+	if !r.Initialized() {
+		return errNotInitialized
+	}
+	r.releaseMu.Lock()
+	defer r.releaseMu.Unlock()
 	logger.V(1).Info("IpRelease start")
 	defer logger.V(1).Info("IpRelease end")
 
+	atomic.StoreInt64(&r.releaseStarted, time.Now().UnixNano())
+	defer func() {
+		atomic.StoreInt64(&r.releaseFinished, time.Now().UnixNano())
+	}()
+
+	ctx, span := tracing.Tracer().Start(ctx, "IPKeeper.IpRelease")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if err := r.refreshBlocks(ctx); err != nil {
+		logger.Info("refresh IPAM blocks failed, using the cached blocks", "err", err.Error())
+	}
+	if err := r.refreshPools(ctx); err != nil {
+		logger.Info("refresh IPPools failed, using the cached pools", "err", err.Error())
+	}
+
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		ipReservation, podIPMap, err := r.getResources(ctx)
 		if err != nil {
 			return err
 		}
 
+		reason := frozen(ipReservation)
+		r.setFrozenMetrics(reason, podIPMap)
+		if reason != "" {
+			logger.Info("releases frozen", "reason", reason, "reserved", len(podIPMap.Data))
+			_, totalIP := getReserveCIDRs(ipReservation, nil)
+			metrics.IPReserveCount.Set(float64(totalIP))
+			setHeldMetrics(podIPMap)
+			r.setBlockMetrics(podIPMap)
+			r.setPoolMetrics(podIPMap)
+			return nil
+		}
+
+		// keep the pod info of released IPs for the ownership history
+		podInfos := make(map[string]string, len(podIPMap.Data))
+		for podIP, podInfo := range podIPMap.Data {
+			podInfos[podIP] = podInfo
+		}
+
 		//The existing CIDR and the new one cannot be repeat and need to be merged.
 		//At present, only consider the scenario of a single IP in IPReservation CR
-		releaseIPs := getReleaseIPs(podIPMap, logger, r)
-		var reserveCIDRs byIp
-		reserveCIDRs, totalIP := getReserveCIDRs(ipReservation, releaseIPs)
+		now := r.clock.Now()
+		r.refreshGoneOwners(ctx, podIPMap)
+		releaseIPs, expired := getReleaseIPs(podIPMap, logger, r, now)
+		// the legacy pod infos are rewritten with the ConfigMap update below
+		if migrated := migratePodInfos(podIPMap); migrated > 0 {
+			logger.Info("legacy pod infos rewritten as JSON", "count", migrated)
+		}
+		changed, totalIP := compactReservation(ipReservation, releaseIPs)
 		metrics.IPReserveCount.Set(float64(totalIP))
-		if len(reserveCIDRs) != len(ipReservation.Spec.ReservedCIDRs) {
-			sort.Sort(reserveCIDRs)
-			ipReservation.Spec.ReservedCIDRs = reserveCIDRs
-			err = r.client.Update(ctx, ipReservation)
+		setHeldMetrics(podIPMap)
+		r.setBlockMetrics(podIPMap)
+		r.setPoolMetrics(podIPMap)
+		if changed {
+			err = r.updateReservation(ctx, ipReservation)
 			if err != nil {
 				logger.V(1).Info("ipRelease update ipReservation failed", "err", err.Error())
 				return err
@@ -109,11 +322,28 @@ func (r *IPKeeper) IpRelease(ctx context.Context, logger logr.Logger) error {
 		}
 
 		//update configmaps
-		err = r.client.Update(ctx, podIPMap)
+		err = kubeCall(ctx, "ConfigMap update", func(ctx context.Context) error {
+			return r.client.Update(ctx, podIPMap)
+		})
 		if err != nil {
 			logger.V(1).Info("ipRelease update podIPMap failed", "err", err.Error())
 			return err
 		}
+		r.limiter.record(now, expired)
+		if r.config.ShadowMode && len(releaseIPs) > 0 {
+			logger.Info("shadow release", "ips", releaseIPs)
+		}
+
+		for _, podIP := range releaseIPs {
+			nodeName, podNamespace, podName, _, err := getPodInfo(podIP, podInfos[podIP])
+			if err != nil {
+				continue
+			}
+			r.history.Released(podIP, podNamespace, podName, nodeName, now)
+			logger.V(1).Info("released", "ip", podIP, "pod", podNamespace+"/"+podName, "owner", podInfoOwner(podInfos[podIP]))
+			span.AddEvent("released", trace.WithAttributes(append(tracing.PodAttributes(podNamespace, podName),
+				tracing.AttrIP.String(podIP))...))
+		}
 		return nil
 	})
 }
@@ -121,14 +351,18 @@ func (r *IPKeeper) IpRelease(ctx context.Context, logger logr.Logger) error {
 func (r *IPKeeper) getResources(ctx context.Context) (*v3.IPReservation, *v1.ConfigMap, error) {
 	podIPMap := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podIPMapNsName.Name,
-			Namespace: podIPMapNsName.Namespace,
+			Name:      r.podIPMapKey.Name,
+			Namespace: r.podIPMapKey.Namespace,
 		},
 	}
-	err := r.client.Get(ctx, podIPMapNsName, podIPMap)
+	err := kubeCall(ctx, "ConfigMap get", func(ctx context.Context) error {
+		return r.client.Get(ctx, r.podIPMapKey, podIPMap)
+	})
 	if errors.IsNotFound(err) {
 		// create podIPInfo configmaps
-		err = r.client.Create(ctx, podIPMap)
+		err = kubeCall(ctx, "ConfigMap create", func(ctx context.Context) error {
+			return r.client.Create(ctx, podIPMap)
+		})
 	} else if err != nil {
 		return nil, nil, err
 	}
@@ -137,29 +371,67 @@ func (r *IPKeeper) getResources(ctx context.Context) (*v3.IPReservation, *v1.Con
 		return nil, podIPMap, err
 	}
 
+	ipReservation, err := r.getReservation(ctx)
+	if ipReservation == nil {
+		return nil, nil, err
+	}
+	return ipReservation, podIPMap, err
+}
+
+// getReservation returns the IPReservation, created if missing, or its shadow in shadow mode
+func (r *IPKeeper) getReservation(ctx context.Context) (*v3.IPReservation, error) {
+	if r.config.ShadowMode {
+		return r.getShadowReservation(ctx)
+	}
 	ipReservation := &v3.IPReservation{}
-	err = r.client.Get(ctx, ipReservationNsName, ipReservation)
+	err := calicoCall(ctx, cons.OperationGet, func(ctx context.Context) error {
+		return r.client.Get(ctx, ipReservationNsName, ipReservation)
+	})
 	if errors.IsNotFound(err) {
 		// create ipReservation
 		ipReservation.Name = podIPMapNsName.Name
 		ipReservation.Namespace = podIPMapNsName.Namespace
 		//add a permanent system reserved IP: 1.1.1.1 in reservedCIDRs
 		ipReservation.Spec.ReservedCIDRs = []string{cons.SystemReserveIP}
-		err = r.client.Create(ctx, ipReservation)
-		return ipReservation, podIPMap, err
+		err = calicoCall(ctx, cons.OperationCreate, func(ctx context.Context) error {
+			return r.client.Create(ctx, ipReservation)
+		})
+		return ipReservation, err
 	} else if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return ipReservation, nil
+}
 
-	return ipReservation, podIPMap, nil
+// updateReservation updates the IPReservation, or its shadow in shadow mode
+func (r *IPKeeper) updateReservation(ctx context.Context, ipReservation *v3.IPReservation) error {
+	if r.config.ShadowMode {
+		return r.updateShadowReservation(ctx, ipReservation)
+	}
+	return calicoCall(ctx, cons.OperationUpdate, func(ctx context.Context) error {
+		return r.client.Update(ctx, ipReservation)
+	})
 }
 
-func (r *IPKeeper) IpReserve(ctx context.Context, logger logr.Logger, namespace, name string) error {
-	//Do not process if there is no ip reserve flag: ip-reserve=enabled on the namespace
+func (r *IPKeeper) IpReserve(ctx context.Context, logger logr.Logger, namespace, name string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "IPKeeper.IpReserve",
+		trace.WithAttributes(tracing.PodAttributes(namespace, name)...))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if !r.Initialized() {
+		return errNotInitialized
+	}
+
+	//Do not process if no pod selector selects the namespace, by default labeled ip-reserve=enabled
 	podNamespace := &v1.Namespace{}
-	err := r.client.Get(ctx, types.NamespacedName{
-		Name: namespace,
-	}, podNamespace)
+	err = kubeCall(ctx, "Namespace get", func(ctx context.Context) error {
+		return r.client.Get(ctx, types.NamespacedName{
+			Name: namespace,
+		}, podNamespace)
+	})
 	if errors.IsNotFound(err) {
 		return nil
 	}
@@ -167,15 +439,17 @@ func (r *IPKeeper) IpReserve(ctx context.Context, logger logr.Logger, namespace,
 		return fmt.Errorf("get pod namespace error: %v", err.Error())
 	}
 
-	if value := podNamespace.Labels[cons.IPReserveKey]; value != cons.IPReserveValue {
+	if !r.selectors.SelectsNamespace(podNamespace.Labels) {
 		return nil
 	}
 
 	pod := &v1.Pod{}
-	err = r.client.Get(ctx, types.NamespacedName{
-		Name:      name,
-		Namespace: namespace,
-	}, pod)
+	err = kubeCall(ctx, "Pod get", func(ctx context.Context) error {
+		return r.client.Get(ctx, types.NamespacedName{
+			Name:      name,
+			Namespace: namespace,
+		}, pod)
+	})
 	if errors.IsNotFound(err) {
 		return fmt.Errorf("get pod not found")
 	}
@@ -183,10 +457,33 @@ func (r *IPKeeper) IpReserve(ctx context.Context, logger logr.Logger, namespace,
 		return fmt.Errorf("get pod error: %v", err.Error())
 	}
 
-	if !r.selector.Matches(labels.Set(pod.Labels)) {
+	if claimName := pod.Annotations[cons.IPClaimAnnotation]; claimName != "" {
+		claim := &ipamv1alpha1.IPClaim{}
+		err = kubeCall(ctx, "IPClaim get", func(ctx context.Context) error {
+			return r.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: claimName}, claim)
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("get IPClaim error: %v", err.Error())
+		}
+		if err == nil && claim.DeletionTimestamp.IsZero() {
+			// reserved for good before the pod is gone, Calico must not hand the IP out in between
+			logger.Info("Pod", "msg", "ip claimed", "claim", claimName, "ip", claim.Spec.IP)
+			return r.ReserveClaimed(ctx, claim.Spec.IP)
+		}
+		// the claim is gone, the IP is reserved like any other
+	}
+
+	// the owner chain is only resolved for the pods a selector may select
+	if !r.selectors.SelectsPod(pod) {
 		logger.Info("Pod", "msg", "not match selector")
 		return nil
 	}
+	topOwner := r.resolveOwner(ctx, pod)
+	if !r.selectors.Selects(podNamespace.Labels, pod, topOwner) {
+		logger.Info("Pod", "msg", "not match selector", "owner", formatOwner(topOwner))
+		return nil
+	}
+	owner := formatOwner(topOwner)
 
 	//IP reservation is required, check the IP of the Pod
 	if len(pod.Status.PodIPs) == 0 {
@@ -195,49 +492,96 @@ func (r *IPKeeper) IpReserve(ctx context.Context, logger logr.Logger, namespace,
 		return nil
 	}
 
-	podIPMap, patchJson := getResources(pod)
-
-	// ip relation persistent to configmaps
-	//In order to avoid update conflicts when deleting Pods in parallel( delete node or node not ready ), causing the deletion
-	//to fail all the time, the Update function cannot be used here.
-	err = r.client.Patch(ctx, podIPMap, client.Merge)
+	ips, err := r.podIPs(ctx, pod)
 	if err != nil {
-		return err
+		// the primary IPs are reserved anyway
+		logger.Error(err, "get the secondary IPs failed")
 	}
+	span.SetAttributes(tracing.AttrIP.StringSlice(ips))
 
-	ipReservation := &v3.IPReservation{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: ipReservationNsName.Name,
-		},
+	now := r.clock.Now()
+	podIPMap := getResources(pod, ips, owner, now)
+	r.recordBlocks(ctx, podIPMap.Data, logger)
+	if r.batcher != nil {
+		// answered once the batch holding the IPs is written
+		err = r.batcher.submit(ctx, podIPMap.Data, ips)
+	} else {
+		err = r.writeReservation(ctx, podIPMap.Data, ips)
 	}
-	//CRD does not support StrategicMergePatchType, we only append Pod IP, and do not cover other IPs,
-	//so MergePatchType cannot be used, and JSONPatchType can only be used here.
-	//The Kubernetes API server does not recursively create nested objects for JSON patch inputs, so when spec.reservedCIDRs is nil,
-	//JSONPatch will fail, so add a permanent reserved IP: 1.1.1.1 in reservedCIDRs
-	err = r.client.Patch(ctx, ipReservation, client.RawPatch(types.JSONPatchType, patchJson))
 	if err != nil {
 		return err
 	}
+
+	if r.config.ShadowMode {
+		logger.Info("shadow reserve", "pod", namespace+"/"+name, "ips", ips, "owner", owner)
+	}
+	for _, ip := range ips {
+		r.history.Reserved(pod, ip, owner, now)
+		if info, _, err := parsePodInfo(podIPMap.Data[ip]); err == nil && info.Block != "" {
+			r.history.Placed(pod, ip, info.Block, info.BlockNode)
+		}
+	}
 	return nil
 }
 
+// writeReservation records the pod infos of the IPs, then adds the IPs to the IPReservation. Both are updated
+// optimistically with their resourceVersion and retried on conflict, so that concurrent or repeated deletions of
+// a pod reserve its IPs once: see mergePodInfos and ipDeduplicateAppend.
+func (r *IPKeeper) writeReservation(ctx context.Context, podInfos map[string]string, ips []string) error {
+	logger := log.FromContext(ctx)
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		ipReservation, podIPMap, err := r.getResources(ctx)
+		if err != nil {
+			return err
+		}
+
+		// the pod info first, so that the drift check never sees an unrecorded IP
+		if mergePodInfos(podIPMap, podInfos) {
+			err = kubeCall(ctx, "ConfigMap update", func(ctx context.Context) error {
+				return r.client.Update(ctx, podIPMap)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if added := ipDeduplicateAppend(ips, ipReservation, logger); len(added) > 0 {
+			return r.updateReservation(ctx, ipReservation)
+		}
+		return nil
+	})
+}
+
 func (r *IPKeeper) initResources(ctx context.Context) error {
+	// the managed-by label selects the objects guarded by the state webhook
+	managedBy := map[string]string{cons.LabelManagedBy: cons.ManagedByValue}
+	labelPatch := client.RawPatch(types.MergePatchType,
+		[]byte(fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, cons.LabelManagedBy, cons.ManagedByValue)))
+
 	podIPMap := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podIPMapNsName.Name,
-			Namespace: podIPMapNsName.Namespace,
+			Name:      r.podIPMapKey.Name,
+			Namespace: r.podIPMapKey.Namespace,
+			Labels:    managedBy,
 		},
 	}
 	err := r.client.Create(ctx, podIPMap)
 	if errors.IsAlreadyExists(err) {
-	} else if err != nil {
+		err = r.client.Patch(ctx, podIPMap, labelPatch)
+	}
+	if err != nil {
+		return err
+	}
+	if r.config.ShadowMode {
+		// the Calico IPReservation is left alone
+		_, err = r.getShadowReservation(ctx)
 		return err
 	}
 
 	// create ipReservation
 	ipReservation := &v3.IPReservation{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: podIPMapNsName.Name,
+			Name:   podIPMapNsName.Name,
+			Labels: managedBy,
 		},
 		Spec: v3.IPReservationSpec{
 			//add a permanent system reserved IP: 1.1.1.1 in reservedCIDRs
@@ -245,11 +589,35 @@ func (r *IPKeeper) initResources(ctx context.Context) error {
 		},
 	}
 
-	err = r.client.Create(ctx, ipReservation)
+	err = calicoCall(ctx, cons.OperationCreate, func(ctx context.Context) error {
+		return r.client.Create(ctx, ipReservation)
+	})
 	if errors.IsAlreadyExists(err) {
-	} else if err != nil {
-		return err
+		err = calicoCall(ctx, cons.OperationPatch, func(ctx context.Context) error {
+			return r.client.Patch(ctx, ipReservation, labelPatch)
+		})
 	}
+	return err
+}
 
-	return nil
+// kubeCall runs a call of the Kubernetes API in its own span
+func kubeCall(ctx context.Context, name string, call func(ctx context.Context) error) error {
+	ctx, span := tracing.Tracer().Start(ctx, name)
+	defer span.End()
+	err := call(ctx)
+	if err != nil && !errors.IsNotFound(err) && !errors.IsAlreadyExists(err) {
+		tracing.RecordError(span, err)
+	}
+	return err
+}
+
+// calicoCall calls the calico-apiserver and records the latency and the unexpected errors of the operation
+func calicoCall(ctx context.Context, operation string, call func(ctx context.Context) error) error {
+	start := time.Now()
+	err := kubeCall(ctx, "IPReservation "+operation, call)
+	metrics.CalicoAPIDurationSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.IsNotFound(err) && !errors.IsAlreadyExists(err) {
+		metrics.CalicoAPIErrorsTotal.WithLabelValues(operation).Inc()
+	}
+	return err
 }
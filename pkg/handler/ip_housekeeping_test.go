@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta/testrestmapper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// unavailableClient fails the IPReservation calls until the calico-apiserver is up
+type unavailableClient struct {
+	client.Client
+	down int32
+}
+
+func (c *unavailableClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*v3.IPReservation); ok && atomic.LoadInt32(&c.down) == 1 {
+		return fmt.Errorf("the server is currently unable to handle the request")
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// newTestKeeper initializes a keeper over a fake client holding objs
+func newTestKeeper(t *testing.T, config *configv1.CapoConfig, objs ...client.Object) (*IPKeeper, client.Client) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, v3.AddToScheme(scheme))
+	assert.NoError(t, ipamv1alpha1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(testrestmapper.TestOnlyStaticRESTMapper(scheme)).
+		WithObjects(objs...).Build()
+	keeper, err := NewIPKeeper(c, config)
+	assert.NoError(t, err)
+	return keeper, c
+}
+
+func TestLazyIPKeeperRecovers(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, v3.AddToScheme(scheme))
+	c := &unavailableClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), down: 1}
+
+	keeper, err := NewLazyIPKeeper(c, &configv1.CapoConfig{DegradedMode: true})
+	assert.NoError(t, err)
+	assert.False(t, keeper.Initialized())
+	assert.True(t, keeper.Degraded())
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveDegraded))
+	assert.ErrorIs(t, keeper.IpReserve(context.Background(), utils.CreateLogger(true, true), "redis", "redis-0"), errNotInitialized)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, keeper.Start(ctx))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, keeper.Initialized(), "retrying while the calico-apiserver is down")
+
+	atomic.StoreInt32(&c.down, 0)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keeper not initialized after the calico-apiserver is up")
+	}
+	assert.True(t, keeper.Initialized())
+	assert.False(t, keeper.Degraded())
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReserveDegraded))
+	assert.NoError(t, c.Get(context.Background(), ipReservationNsName, &v3.IPReservation{}))
+}
+
+func TestIpReserveConcurrentDuplicates(t *testing.T) {
+	reserved := time.Now().Add(-10 * time.Minute)
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		PodSelectors:      []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}}},
+	},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "redis", Labels: map[string]string{"ip-reserve": "enabled"}}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: "redis-0", Labels: map[string]string{"app": "redis"}},
+			Spec:       v1.PodSpec{NodeName: "node01"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.5.1"}, {IP: "10.0.5.2"}}},
+		},
+	)
+	ctx := context.Background()
+
+	// 10.0.5.2 was reserved for the pod by an earlier deletion
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	podIPMap.Data = map[string]string{"10.0.5.2": buildPodInfo("redis", "redis-0", "node01", reserved)}
+	assert.NoError(t, c.Update(ctx, podIPMap))
+
+	// the deletion and the eviction of the pod, and their retries
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, keeper.IpReserve(ctx, utils.CreateLogger(true, true), "redis", "redis-0"))
+		}()
+	}
+	wg.Wait()
+
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	count := map[string]int{}
+	for _, cidr := range ipReservation.Spec.ReservedCIDRs {
+		count[cidr]++
+	}
+	assert.Equal(t, map[string]int{"1.1.1.1": 1, "10.0.5.1": 1, "10.0.5.2": 1}, count)
+
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Len(t, podIPMap.Data, 2)
+	// the timestamp of the pod is not refreshed by the repeated deletions
+	assert.Equal(t, buildPodInfo("redis", "redis-0", "node01", reserved), podIPMap.Data["10.0.5.2"])
+	assert.NoError(t, ValidatePodInfo("10.0.5.1", podIPMap.Data["10.0.5.1"]))
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+)
+
+// networkStatus is an entry of the Multus network-status annotation
+type networkStatus struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Default   bool     `json:"default,omitempty"`
+}
+
+// secondaryIPs returns the IPs of the non-default networks of the network-status annotation of the pod,
+// restricted to the networks when set
+func secondaryIPs(pod *v1.Pod, networks []string) ([]string, error) {
+	annotation, ok := pod.Annotations[cons.MultusNetworkStatusAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var statuses []networkStatus
+	if err := json.Unmarshal([]byte(annotation), &statuses); err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, status := range statuses {
+		if status.Default || (len(networks) > 0 && !contains(networks, status.Name)) {
+			continue
+		}
+		for _, ip := range status.IPs {
+			if net.ParseIP(ip) != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// podIPs returns the primary IPs of the pod, followed by its secondary IPs allocated from an enabled Calico IPPool
+// when Multus is enabled. The IPs of other IPAMs are left alone, Calico would not honor their reservation.
+func (r *IPKeeper) podIPs(ctx context.Context, pod *v1.Pod) ([]string, error) {
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if r.config.Multus == nil || !r.config.Multus.Enabled {
+		return ips, nil
+	}
+
+	secondary, err := secondaryIPs(pod, r.config.Multus.Networks)
+	if err != nil || len(secondary) == 0 {
+		return ips, err
+	}
+	pools := &v3.IPPoolList{}
+	if err = kubeCall(ctx, "IPPool list", func(ctx context.Context) error {
+		return r.client.List(ctx, pools)
+	}); err != nil {
+		return ips, err
+	}
+	for _, ip := range secondary {
+		if !contains(ips, ip) && inPools(pools, net.ParseIP(ip)) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func inPools(pools *v3.IPPoolList, ip net.IP) bool {
+	for _, pool := range pools.Items {
+		if ipNet := utils.ParseCidr(pool.Spec.CIDR); ipNet != nil && ipNet.Contains(ip) && !pool.Spec.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
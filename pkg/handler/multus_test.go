@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const storageNetworkStatus = `[
+  {"name": "k8s-pod-network", "interface": "eth0", "ips": ["10.0.1.1"], "default": true},
+  {"name": "storage/calico-storage", "interface": "net1", "ips": ["10.1.0.5", "fd00::5"]},
+  {"name": "storage/sriov", "interface": "net2", "ips": ["192.168.7.5"]}
+]`
+
+func TestSecondaryIPs(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{cons.MultusNetworkStatusAnnotation: storageNetworkStatus}}}
+	ips, err := secondaryIPs(pod, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.1.0.5", "fd00::5", "192.168.7.5"}, ips)
+
+	ips, err = secondaryIPs(pod, []string{"storage/sriov"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.168.7.5"}, ips)
+
+	ips, err = secondaryIPs(&v1.Pod{}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+
+	pod.Annotations[cons.MultusNetworkStatusAnnotation] = "{"
+	_, err = secondaryIPs(pod, nil)
+	assert.Error(t, err)
+}
+
+func TestIpReserveSecondary(t *testing.T) {
+	newPool := func(name, cidr string, disabled bool) *v3.IPPool {
+		return &v3.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v3.IPPoolSpec{CIDR: cidr, Disabled: disabled}}
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		Multus:            &configv1.MultusConfig{Enabled: true},
+	},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "storage", Labels: map[string]string{cons.IPReserveKey: cons.IPReserveValue}}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "storage", Name: "ceph-0",
+				Labels:      map[string]string{cons.LabelSelectorStatefulSetPodKey: "ceph-0"},
+				Annotations: map[string]string{cons.MultusNetworkStatusAnnotation: storageNetworkStatus}},
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.1"}}},
+		},
+		newPool("default-ipv4-ippool", "10.0.0.0/16", false),
+		newPool("storage-ipv4-ippool", "10.1.0.0/16", false),
+		newPool("storage-ipv6-ippool", "fd00::/64", true),
+	)
+	ctx := context.Background()
+
+	// the IP of the SR-IOV network is not Calico's, nor the one of the disabled pool
+	assert.NoError(t, keeper.IpReserve(ctx, utils.CreateLogger(true, true), "storage", "ceph-0"))
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Len(t, podIPMap.Data, 2)
+	assert.Equal(t, podIPMap.Data["10.0.1.1"], podIPMap.Data["10.1.0.5"])
+	ipReservation := &v3.IPReservation{}
+	assert.NoError(t, c.Get(ctx, ipReservationNsName, ipReservation))
+	assert.Subset(t, ipReservation.Spec.ReservedCIDRs, []string{"10.0.1.1", "10.1.0.5"})
+	assert.NotContains(t, ipReservation.Spec.ReservedCIDRs, "192.168.7.5")
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"strings"
+
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+//+kubebuilder:rbac:groups=apps,resources=statefulsets;replicasets;deployments,verbs=get
+
+// resolveOwner walks the controller owner chain of the pod, e.g. Pod -> StatefulSet -> RedisCluster, and
+// returns its top-level owner, nil for a pod without controller. The chain stops at an owner capo may not
+// read, or which is gone.
+func (r *IPKeeper) resolveOwner(ctx context.Context, pod *v1.Pod) *metav1.OwnerReference {
+	owner := metav1.GetControllerOf(pod)
+	for depth := 1; owner != nil && depth < cons.OwnerChainMaxDepth; depth++ {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion(owner.APIVersion)
+		object.SetKind(owner.Kind)
+		// read from the API server, the cache would start an informer per owner kind
+		err := kubeCall(ctx, owner.Kind+" get", func(ctx context.Context) error {
+			return r.client.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, object)
+		})
+		if err != nil {
+			log.FromContext(ctx).V(1).Info("owner chain stopped", "owner", formatOwner(owner), "err", err.Error())
+			break
+		}
+		next := metav1.GetControllerOf(object)
+		if next == nil {
+			break
+		}
+		owner = next
+	}
+	return owner
+}
+
+// formatOwner formats an owner as Kind.group/name, Kind/name for the core group, empty for no owner
+func formatOwner(owner *metav1.OwnerReference) string {
+	if owner == nil {
+		return ""
+	}
+	kind := owner.Kind
+	if gv, err := schema.ParseGroupVersion(owner.APIVersion); err == nil && gv.Group != "" {
+		kind += "." + gv.Group
+	}
+	return kind + "/" + owner.Name
+}
+
+// ownerKind returns the Kind.group of an owner formatted by formatOwner
+func ownerKind(owner string) string {
+	return strings.SplitN(owner, "/", 2)[0]
+}
+
+// withOwner records the owner in a pod info, the pod info of pods without owner is unchanged
+func withOwner(value, owner string) string {
+	if owner == "" {
+		return value
+	}
+	info, _, err := parsePodInfo(value)
+	if err != nil {
+		return value
+	}
+	info.Owner = owner
+	return info.String()
+}
+
+// podInfoOwner returns the owner recorded in a pod info, empty if there is none
+func podInfoOwner(value string) string {
+	info, _, err := parsePodInfo(value)
+	if err != nil {
+		return ""
+	}
+	return info.Owner
+}
+
+// refreshGoneOwners looks the recorded top-level owners of the reserved IPs up when releaseWorkloadGone is set,
+// and keeps those not found for getReleaseIPs. An owner whose kind is unknown or which capo may not read is
+// never gone.
+func (r *IPKeeper) refreshGoneOwners(ctx context.Context, podIPMap *v1.ConfigMap) {
+	r.goneOwners = nil
+	if !r.config.ReleaseWorkloadGone {
+		return
+	}
+	logger := log.FromContext(ctx)
+	gone := map[string]bool{}
+	checked := map[string]bool{}
+	for _, value := range podIPMap.Data {
+		info, _, err := parsePodInfo(value)
+		if err != nil || info.Owner == "" {
+			continue
+		}
+		key := info.Namespace + "/" + info.Owner
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		kindName := strings.SplitN(info.Owner, "/", 2)
+		if len(kindName) != 2 {
+			continue
+		}
+		mapping, err := r.client.RESTMapper().RESTMapping(schema.ParseGroupKind(kindName[0]))
+		if err != nil {
+			logger.V(1).Info("owner kind unknown", "owner", key, "err", err.Error())
+			continue
+		}
+		object := &unstructured.Unstructured{}
+		object.SetGroupVersionKind(mapping.GroupVersionKind)
+		err = kubeCall(ctx, mapping.GroupVersionKind.Kind+" get", func(ctx context.Context) error {
+			return r.client.Get(ctx, types.NamespacedName{Namespace: info.Namespace, Name: kindName[1]}, object)
+		})
+		if errors.IsNotFound(err) {
+			logger.Info("workload gone, its reserved IPs are released", "owner", key)
+			gone[key] = true
+		}
+	}
+	r.goneOwners = gone
+}
+
+// ownerGone reports whether the top-level owner recorded in the pod info was found gone by the release cycle
+func (r *IPKeeper) ownerGone(info podInfo) bool {
+	return info.Owner != "" && r.goneOwners[info.Namespace+"/"+info.Owner]
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+)
+
+func controlledBy(apiVersion, kind, name string) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name, Controller: pointer.Bool(true)}}
+}
+
+func TestIpReserveOwner(t *testing.T) {
+	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"team": "web"}}}
+	// Pod -> ReplicaSet -> Deployment, the Deployment owned by nothing capo can read
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "web"}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "web-5d4f",
+		OwnerReferences: controlledBy("apps/v1", "Deployment", "web")}}
+	newPod := func(name, ip string, owners []metav1.OwnerReference) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: name, OwnerReferences: owners},
+			Spec:       v1.PodSpec{NodeName: "node01"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: ip}}},
+		}
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		PodSelectors: []configv1.PodSelector{
+			{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+				TopOwnerKinds:     []string{"Deployment.apps", "Job"},
+			},
+		},
+	}, namespace, deployment, replicaSet,
+		newPod("web-5d4f-x2", "10.0.2.1", controlledBy("apps/v1", "ReplicaSet", "web-5d4f")),
+		newPod("batch-1", "10.0.2.2", controlledBy("batch/v1", "Job", "batch")),
+		newPod("bare", "10.0.2.3", nil),
+	)
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+
+	assert.Equal(t, "Deployment.apps/web", formatOwner(keeper.resolveOwner(ctx, newPod("web-5d4f-x2", "", controlledBy("apps/v1", "ReplicaSet", "web-5d4f")))))
+	// the Job is not found, the chain stops at it
+	assert.Equal(t, "Job.batch/batch", formatOwner(keeper.resolveOwner(ctx, newPod("batch-1", "", controlledBy("batch/v1", "Job", "batch")))))
+	assert.Nil(t, keeper.resolveOwner(ctx, newPod("bare", "", nil)))
+
+	for _, name := range []string{"web-5d4f-x2", "batch-1", "bare"} {
+		assert.NoError(t, keeper.IpReserve(ctx, logger, "web", name))
+	}
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Equal(t, "Deployment.apps/web", podInfoOwner(podIPMap.Data["10.0.2.1"]))
+	assert.Equal(t, "Job.batch/batch", podInfoOwner(podIPMap.Data["10.0.2.2"]))
+	assert.NotContains(t, podIPMap.Data, "10.0.2.3")
+	for ip, podInfo := range podIPMap.Data {
+		assert.NoError(t, ValidatePodInfo(ip, podInfo))
+	}
+
+	setHeldMetrics(podIPMap)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveHeldByOwnerKind.WithLabelValues("Deployment.apps")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveHeldByOwnerKind.WithLabelValues("Job.batch")))
+}
+
+func TestIpReleaseWorkloadGone(t *testing.T) {
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: podIPMapNsName.Name, Namespace: podIPMapNsName.Namespace},
+		Data: map[string]string{
+			"10.0.2.1": withOwner(buildPodInfo("web", "web-0", "node01", now), "StatefulSet.apps/web"),
+			"10.0.2.2": withOwner(buildPodInfo("web", "db-0", "node01", now), "StatefulSet.apps/db"),
+			// the kind is unknown, the owner is never gone
+			"10.0.2.3": withOwner(buildPodInfo("web", "kafka-0", "node01", now), "Kafka.kafka.strimzi.io/kafka"),
+			"10.0.2.4": buildPodInfo("web", "bare", "node01", now),
+		},
+	}
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:       metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount:   pointer.Int(200),
+		ReleaseWorkloadGone: true,
+	}, podIPMap, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "web"}})
+	keeper.SetClock(clocktesting.NewFakeClock(now.Add(time.Minute)))
+	ctx := context.Background()
+	goneBefore := testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonWorkloadGone))
+
+	// the IP of the deleted StatefulSet is released before its reserve time
+	assert.NoError(t, keeper.IpRelease(ctx, utils.CreateLogger(true, true)))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.NotContains(t, podIPMap.Data, "10.0.2.2")
+	assert.Len(t, podIPMap.Data, 3)
+	assert.Equal(t, goneBefore+1, testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonWorkloadGone)))
+
+	// disabled, the reservation waits for its reserve time
+	keeper.config.ReleaseWorkloadGone = false
+	assert.NoError(t, c.Delete(ctx, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "web"}}))
+	assert.NoError(t, keeper.IpRelease(ctx, utils.CreateLogger(true, true)))
+	assert.NoError(t, c.Get(ctx, podIPMapNsName, podIPMap))
+	assert.Contains(t, podIPMap.Data, "10.0.2.1")
+}
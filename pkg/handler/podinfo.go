@@ -0,0 +1,97 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+)
+
+// podInfo is the pod info recorded for a reserved IP, stored as JSON in the pod info ConfigMap
+type podInfo struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Node      string `json:"node"`
+	// when the IP was reserved, RFC3339 in UTC
+	Reserved string `json:"reserved"`
+	// top-level owner of the pod, Kind.group/name
+	Owner string `json:"owner,omitempty"`
+	// the Calico IPAM block of the IP and its affine node when reserved, with ipamBlocks enabled
+	Block     string `json:"block,omitempty"`
+	BlockNode string `json:"blockNode,omitempty"`
+}
+
+func newPodInfo(namespace, name, nodeName string, reserved time.Time) podInfo {
+	return podInfo{
+		Namespace: namespace,
+		Name:      name,
+		Node:      nodeName,
+		Reserved:  reserved.UTC().Format(time.RFC3339),
+	}
+}
+
+func (p podInfo) String() string {
+	value, _ := json.Marshal(p)
+	return string(value)
+}
+
+// reservedTime returns when the IP was reserved
+func (p podInfo) reservedTime() (time.Time, error) {
+	return time.Parse(time.RFC3339, p.Reserved)
+}
+
+// parsePodInfo parses a pod info ConfigMap value: the JSON podInfo, or the legacy namespace_name_node_time[_owner]
+// whose time has no zone and is read in the local time zone. legacy reports the latter.
+func parsePodInfo(value string) (info podInfo, legacy bool, err error) {
+	if !strings.HasPrefix(value, "{") {
+		info, err = parseLegacyPodInfo(value)
+		return info, true, err
+	}
+	if err = json.Unmarshal([]byte(value), &info); err != nil {
+		return podInfo{}, false, fmt.Errorf("pod info %s is invalid: %v", value, err)
+	}
+	if info.Namespace == "" || info.Name == "" {
+		return podInfo{}, false, fmt.Errorf("pod info %s is invalid: namespace and name must be set", value)
+	}
+	if _, err = info.reservedTime(); err != nil {
+		return podInfo{}, false, fmt.Errorf("pod info %s is invalid: %v", value, err)
+	}
+	return info, false, nil
+}
+
+func parseLegacyPodInfo(value string) (podInfo, error) {
+	// namespace_name_node_time, followed by _owner for the pods with a controller owner
+	split := strings.Split(value, cons.SeparatorUnderscore)
+	if len(split) != 4 && len(split) != 5 {
+		return podInfo{}, fmt.Errorf("pod info %s is invalid", value)
+	}
+	reserved, err := time.ParseInLocation(cons.TimeLayout, split[3], time.Local)
+	if err != nil {
+		return podInfo{}, fmt.Errorf("pod info %s is invalid: %v", value, err)
+	}
+	info := newPodInfo(split[0], split[1], split[2], reserved)
+	if len(split) == 5 {
+		info.Owner = split[4]
+	}
+	return info, nil
+}
+
+// migratePodInfos rewrites the legacy pod infos of podIPMap as JSON, and returns how many were rewritten.
+// The malformed ones are left for the release loop to report.
+func migratePodInfos(podIPMap *v1.ConfigMap) int {
+	migrated := 0
+	for podIP, value := range podIPMap.Data {
+		if info, legacy, err := parsePodInfo(value); err == nil && legacy {
+			podIPMap.Data[podIP] = info.String()
+			migrated++
+		}
+	}
+	return migrated
+}
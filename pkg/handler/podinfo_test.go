@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParsePodInfo(t *testing.T) {
+	reserved := time.Date(2022, 11, 24, 14, 33, 22, 0, time.FixedZone("CST", 8*3600))
+	value := withOwner(buildPodInfo("redis", "redis-0", "node01", reserved), "RedisCluster.redis.io/redis")
+	assert.Equal(t, `{"namespace":"redis","name":"redis-0","node":"node01","reserved":"2022-11-24T06:33:22Z","owner":"RedisCluster.redis.io/redis"}`, value)
+	info, legacy, err := parsePodInfo(value)
+	assert.NoError(t, err)
+	assert.False(t, legacy)
+	reservedTime, _ := info.reservedTime()
+	assert.True(t, reserved.Equal(reservedTime))
+	assert.Equal(t, "RedisCluster.redis.io/redis", podInfoOwner(value))
+
+	for _, invalid := range []string{
+		`{"namespace":"redis","name":"redis-0"`,
+		`{"name":"redis-0","node":"node01","reserved":"2022-11-24T06:33:22Z"}`,
+		`{"namespace":"redis","name":"redis-0","node":"node01","reserved":"2022-11-24-14:33:22"}`,
+		"redis_redis-0_node01",
+	} {
+		_, _, err = parsePodInfo(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseLegacyPodInfo(t *testing.T) {
+	// the legacy time has no zone, it is read in the local time zone of the replica
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("CST", 8*3600)
+
+	info, legacy, err := parsePodInfo("redis_redis-0_node01_2022-11-24-14:33:22_RedisCluster.redis.io/redis")
+	assert.NoError(t, err)
+	assert.True(t, legacy)
+	assert.Equal(t, podInfo{Namespace: "redis", Name: "redis-0", Node: "node01", Reserved: "2022-11-24T06:33:22Z",
+		Owner: "RedisCluster.redis.io/redis"}, info)
+
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		"10.0.1.1": "redis_redis-0_node01_2022-11-24-14:33:22",
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", time.Now()),
+		"10.0.1.3": "malformed",
+	}}
+	assert.Equal(t, 1, migratePodInfos(podIPMap))
+	assert.Equal(t, `{"namespace":"redis","name":"redis-0","node":"node01","reserved":"2022-11-24T06:33:22Z"}`, podIPMap.Data["10.0.1.1"])
+	assert.Equal(t, "malformed", podIPMap.Data["10.0.1.3"])
+	// the rewritten pod infos are read the same in any time zone
+	time.Local = time.UTC
+	_, _, _, reserved, err := getPodInfo("10.0.1.1", podIPMap.Data["10.0.1.1"])
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2022, 11, 24, 6, 33, 22, 0, time.UTC).Equal(reserved))
+	assert.Equal(t, 0, migratePodInfos(podIPMap))
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ipPool is a Calico IPPool with its CIDR
+type ipPool struct {
+	name string
+	cidr *net.IPNet
+}
+
+// poolCache keeps the IPPools, listed at most every IPPoolRefreshPeriod
+type poolCache struct {
+	mu        sync.RWMutex
+	refreshed time.Time
+	pools     []ipPool
+}
+
+// newPoolSettings indexes the settings of the configured IPPools by name
+func newPoolSettings(pools []configv1.IPPoolConfig) (map[string]configv1.IPPoolConfig, error) {
+	settings := make(map[string]configv1.IPPoolConfig, len(pools))
+	for _, pool := range pools {
+		if pool.Name == "" {
+			return nil, fmt.Errorf("ipPools: name must be set")
+		}
+		if _, ok := settings[pool.Name]; ok {
+			return nil, fmt.Errorf("ipPools: pool %q configured twice", pool.Name)
+		}
+		if pool.IPReserveTime != nil && pool.IPReserveTime.Duration <= 0 {
+			return nil, fmt.Errorf("ipPools: pool %q: ipReserveTime must be positive", pool.Name)
+		}
+		if pool.IPReserveMaxCount != nil && *pool.IPReserveMaxCount < 0 {
+			return nil, fmt.Errorf("ipPools: pool %q: ipReserveMaxCount must not be negative", pool.Name)
+		}
+		settings[pool.Name] = pool
+	}
+	return settings, nil
+}
+
+// poolsEnabled reports whether any IPPool has its own settings
+func (r *IPKeeper) poolsEnabled() bool {
+	return len(r.poolSettings) > 0
+}
+
+// refreshPools lists the IPPools again once the cache is stale. The stale pools are kept when the listing fails.
+func (r *IPKeeper) refreshPools(ctx context.Context) error {
+	if !r.poolsEnabled() {
+		return nil
+	}
+	r.pools.mu.RLock()
+	fresh := r.clock.Since(r.pools.refreshed) < cons.IPPoolRefreshPeriod
+	r.pools.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	poolList := &v3.IPPoolList{}
+	if err := kubeCall(ctx, "IPPool list", func(ctx context.Context) error {
+		return r.client.List(ctx, poolList)
+	}); err != nil {
+		return err
+	}
+	var pools []ipPool
+	for _, pool := range poolList.Items {
+		if ipNet := utils.ParseCidr(pool.Spec.CIDR); ipNet != nil {
+			pools = append(pools, ipPool{name: pool.Name, cidr: ipNet})
+		}
+	}
+	r.pools.mu.Lock()
+	r.pools.pools = pools
+	r.pools.refreshed = r.clock.Now()
+	r.pools.mu.Unlock()
+	return nil
+}
+
+// poolOf returns the name of the cached IPPool of the IP, empty when it is in no known pool
+func (r *IPKeeper) poolOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	r.pools.mu.RLock()
+	defer r.pools.mu.RUnlock()
+	for _, pool := range r.pools.pools {
+		if pool.cidr.Contains(parsed) {
+			return pool.name
+		}
+	}
+	return ""
+}
+
+// limitGroup returns the configured pool of the IP, whose max count applies to its IPs only,
+// and empty for the IPs sharing ipReserveMaxCount
+func (r *IPKeeper) limitGroup(ip string) string {
+	if !r.poolsEnabled() {
+		return ""
+	}
+	pool := r.poolOf(ip)
+	if _, ok := r.poolSettings[pool]; !ok {
+		return ""
+	}
+	return pool
+}
+
+// reserveTime returns how long the IP is reserved: the ipReserveTime of its pool, else ipReserveTime
+func (r *IPKeeper) reserveTime(ip string) time.Duration {
+	if settings, ok := r.poolSettings[r.limitGroup(ip)]; ok && settings.IPReserveTime != nil {
+		return settings.IPReserveTime.Duration
+	}
+	return r.config.IPReserveTime.Duration
+}
+
+// maxCount returns the max count of a group of limitGroup
+func (r *IPKeeper) maxCount(group string) int {
+	if settings, ok := r.poolSettings[group]; ok && settings.IPReserveMaxCount != nil {
+		return *settings.IPReserveMaxCount
+	}
+	return *r.config.IPReserveMaxCount
+}
+
+// setPoolMetrics counts the reserved IPs by pool, and exports the max count of the configured pools
+func (r *IPKeeper) setPoolMetrics(podIPMap *v1.ConfigMap) {
+	metrics.IPReserveHeldByPool.Reset()
+	metrics.IPReserveCountMaxByPool.Reset()
+	if !r.poolsEnabled() {
+		return
+	}
+	for name := range r.poolSettings {
+		metrics.IPReserveCountMaxByPool.WithLabelValues(name).Set(float64(r.maxCount(name)))
+	}
+	byPool := map[string]int{}
+	for podIP := range podIPMap.Data {
+		byPool[r.poolOf(podIP)]++
+	}
+	for pool, count := range byPool {
+		metrics.IPReserveHeldByPool.WithLabelValues(pool).Set(float64(count))
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+)
+
+func TestNewPoolSettings(t *testing.T) {
+	_, err := newPoolSettings([]configv1.IPPoolConfig{{Name: "redis"}, {Name: "kafka"}})
+	assert.NoError(t, err)
+	_, err = newPoolSettings([]configv1.IPPoolConfig{{}})
+	assert.Error(t, err)
+	_, err = newPoolSettings([]configv1.IPPoolConfig{{Name: "redis"}, {Name: "redis"}})
+	assert.Error(t, err)
+	_, err = newPoolSettings([]configv1.IPPoolConfig{{Name: "redis", IPReserveTime: &metav1.Duration{}}})
+	assert.Error(t, err)
+	_, err = newPoolSettings([]configv1.IPPoolConfig{{Name: "redis", IPReserveMaxCount: pointer.Int(-1)}})
+	assert.Error(t, err)
+}
+
+func TestGetReleaseIPsByPool(t *testing.T) {
+	newPool := func(name, cidr string) *v3.IPPool {
+		return &v3.IPPool{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v3.IPPoolSpec{CIDR: cidr}}
+	}
+	keeper, _ := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(2),
+		IPPools: []configv1.IPPoolConfig{
+			{Name: "redis", IPReserveTime: &metav1.Duration{Duration: 2 * time.Hour}},
+			{Name: "kafka", IPReserveMaxCount: pointer.Int(1)},
+		},
+	},
+		newPool("redis", "10.0.1.0/24"),
+		newPool("kafka", "10.0.2.0/24"),
+		newPool("default", "10.0.3.0/24"),
+	)
+	assert.NoError(t, keeper.refreshPools(context.Background()))
+
+	assert.Equal(t, "redis", keeper.poolOf("10.0.1.5"))
+	assert.Equal(t, "default", keeper.poolOf("10.0.3.5"))
+	assert.Equal(t, "", keeper.poolOf("10.0.9.5"))
+	assert.Equal(t, 2*time.Hour, keeper.reserveTime("10.0.1.5"))
+	assert.Equal(t, 30*time.Minute, keeper.reserveTime("10.0.2.5"))
+	assert.Equal(t, 30*time.Minute, keeper.reserveTime("10.0.3.5"))
+
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		// the reserve time of redis is 2h, its max count the global one
+		"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", now.Add(-time.Hour)),
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", now.Add(-3*time.Hour)),
+		"10.0.1.3": buildPodInfo("redis", "redis-2", "node01", now),
+		// kafka keeps 1 IP
+		"10.0.2.1": buildPodInfo("kafka", "kafka-0", "node01", now.Add(-10*time.Minute)),
+		"10.0.2.2": buildPodInfo("kafka", "kafka-1", "node01", now),
+		// the IPs of the pools without settings and outside of any pool share the global max count
+		"10.0.3.1": buildPodInfo("mysql", "mysql-0", "node01", now.Add(-20*time.Minute)),
+		"10.0.3.2": buildPodInfo("mysql", "mysql-1", "node01", now),
+		"10.0.9.1": buildPodInfo("mysql", "mysql-2", "node01", now),
+	}}
+	pressureBefore := testutil.ToFloat64(metrics.IPReleaseByPoolTotal.WithLabelValues("kafka", cons.ReleaseReasonPressure))
+	releaseIPs, expired := getReleaseIPs(podIPMap, utils.CreateLogger(true, true), keeper, now)
+	assert.ElementsMatch(t, []string{"10.0.1.2", "10.0.2.1", "10.0.3.1"}, releaseIPs)
+	assert.Equal(t, 1, expired)
+	assert.Equal(t, pressureBefore+1, testutil.ToFloat64(metrics.IPReleaseByPoolTotal.WithLabelValues("kafka", cons.ReleaseReasonPressure)))
+
+	keeper.setPoolMetrics(podIPMap)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.IPReserveHeldByPool.WithLabelValues("redis")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveHeldByPool.WithLabelValues("kafka")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReserveCountMaxByPool.WithLabelValues("kafka")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.IPReserveCountMaxByPool.WithLabelValues("redis")))
+}
+
+func TestRefreshPoolsUnderFakeClock(t *testing.T) {
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(2),
+		IPPools:           []configv1.IPPoolConfig{{Name: "redis"}},
+	})
+	clock := clocktesting.NewFakeClock(time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC))
+	keeper.SetClock(clock)
+	ctx := context.Background()
+	assert.NoError(t, keeper.refreshPools(ctx))
+	assert.NoError(t, c.Create(ctx, &v3.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "redis"}, Spec: v3.IPPoolSpec{CIDR: "10.0.1.0/24"}}))
+
+	// the cache expires on the keeper clock
+	clock.Step(cons.IPPoolRefreshPeriod - time.Second)
+	assert.NoError(t, keeper.refreshPools(ctx))
+	assert.Equal(t, "", keeper.poolOf("10.0.1.5"))
+	clock.Step(time.Second)
+	assert.NoError(t, keeper.refreshPools(ctx))
+	assert.Equal(t, "redis", keeper.poolOf("10.0.1.5"))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"context"
+	"strings"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// In shadow mode the keeper computes reservations and releases as usual, but records the pod infos and the
+// reserved CIDRs in two ConfigMaps of the capo namespace instead of the pod info ConfigMap and the Calico
+// IPReservation, so that the selection and the sizing can be reviewed before enforcement.
+var (
+	shadowPodIPMapNsName = types.NamespacedName{
+		Name: cons.ShadowPodIPMapName,
+	}
+
+	shadowReservationNsName = types.NamespacedName{
+		Name: cons.ShadowReservationName,
+	}
+)
+
+func init() {
+	shadowPodIPMapNsName.Namespace = utils.GetNamespace()
+	shadowReservationNsName.Namespace = utils.GetNamespace()
+}
+
+// ShadowPodIPMapKey is the key of the ConfigMap holding the pod info of the reserved IPs in shadow mode
+func ShadowPodIPMapKey() types.NamespacedName {
+	return shadowPodIPMapNsName
+}
+
+// ShadowReservationKey is the key of the ConfigMap holding the reserved CIDRs in shadow mode
+func ShadowReservationKey() types.NamespacedName {
+	return shadowReservationNsName
+}
+
+// ShadowMode reports whether the keeper leaves the Calico IPReservation alone
+func (r *IPKeeper) ShadowMode() bool {
+	return r.config.ShadowMode
+}
+
+// getShadowReservation returns the shadow reservation as an IPReservation, created if missing.
+// Its resourceVersion is the one of the ConfigMap, so that updateShadowReservation is optimistic as well.
+func (r *IPKeeper) getShadowReservation(ctx context.Context) (*v3.IPReservation, error) {
+	cm := &v1.ConfigMap{}
+	err := kubeCall(ctx, "Shadow IPReservation get", func(ctx context.Context) error {
+		return r.client.Get(ctx, shadowReservationNsName, cm)
+	})
+	if errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      shadowReservationNsName.Name,
+				Namespace: shadowReservationNsName.Namespace,
+				Labels:    map[string]string{cons.LabelManagedBy: cons.ManagedByValue},
+			},
+			// like the IPReservation, the system reserved IP is permanent
+			Data: map[string]string{cons.ShadowReservedCIDRsKey: cons.SystemReserveIP},
+		}
+		err = kubeCall(ctx, "Shadow IPReservation create", func(ctx context.Context) error {
+			return r.client.Create(ctx, cm)
+		})
+		return shadowReservation(cm), err
+	} else if err != nil {
+		return nil, err
+	}
+	return shadowReservation(cm), nil
+}
+
+func (r *IPKeeper) updateShadowReservation(ctx context.Context, ipReservation *v3.IPReservation) error {
+	cm := shadowConfigMap(ipReservation)
+	err := kubeCall(ctx, "Shadow IPReservation update", func(ctx context.Context) error {
+		return r.client.Update(ctx, cm)
+	})
+	// the next update of the same object needs the new resourceVersion
+	ipReservation.ResourceVersion = cm.ResourceVersion
+	return err
+}
+
+func shadowReservation(cm *v1.ConfigMap) *v3.IPReservation {
+	ipReservation := &v3.IPReservation{ObjectMeta: *cm.ObjectMeta.DeepCopy()}
+	if cidrs := cm.Data[cons.ShadowReservedCIDRsKey]; cidrs != "" {
+		ipReservation.Spec.ReservedCIDRs = strings.Split(cidrs, ",")
+	}
+	return ipReservation
+}
+
+func shadowConfigMap(ipReservation *v3.IPReservation) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: *ipReservation.ObjectMeta.DeepCopy(),
+		Data: map[string]string{
+			cons.ShadowReservedCIDRsKey: strings.Join(ipReservation.Spec.ReservedCIDRs, ","),
+		},
+	}
+}
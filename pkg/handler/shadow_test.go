@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer"
+)
+
+func TestShadowMode(t *testing.T) {
+	keeper, c := newTestKeeper(t, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(200),
+		ShadowMode:        true,
+		PodSelectors:      []configv1.PodSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}}}},
+	},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "redis", Labels: map[string]string{"ip-reserve": "enabled"}}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: "redis-0", Labels: map[string]string{"app": "redis"}},
+			Spec:       v1.PodSpec{NodeName: "node01"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.1.1"}}},
+		},
+	)
+	assert.True(t, keeper.ShadowMode())
+	now := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	keeper.SetClock(clocktesting.NewFakeClock(now))
+
+	ctx := context.Background()
+	logger := utils.CreateLogger(true, true)
+	assert.NoError(t, keeper.IpReserve(ctx, logger, "redis", "redis-0"))
+	assert.NoError(t, keeper.writeReservation(ctx, map[string]string{
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", now.Add(-time.Hour)),
+	}, []string{"10.0.1.2"}))
+
+	podIPMap := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, ShadowPodIPMapKey(), podIPMap))
+	assert.Contains(t, podIPMap.Data, "10.0.1.1")
+	shadow := &v1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, ShadowReservationKey(), shadow))
+	assert.Equal(t, cons.SystemReserveIP+",10.0.1.1,10.0.1.2", shadow.Data[cons.ShadowReservedCIDRsKey])
+
+	// the expired IP is released from the shadow reservation
+	assert.NoError(t, keeper.IpRelease(ctx, logger))
+	assert.NoError(t, c.Get(ctx, ShadowPodIPMapKey(), podIPMap))
+	assert.NotContains(t, podIPMap.Data, "10.0.1.2")
+	assert.NoError(t, c.Get(ctx, ShadowReservationKey(), shadow))
+	assert.Equal(t, cons.SystemReserveIP+",10.0.1.1", shadow.Data[cons.ShadowReservedCIDRsKey])
+
+	// neither the IPReservation nor the pod info ConfigMap are touched
+	assert.True(t, errors.IsNotFound(c.Get(ctx, IPReservationKey(), &v3.IPReservation{})))
+	assert.True(t, errors.IsNotFound(c.Get(ctx, PodIPMapKey(), &v1.ConfigMap{})))
+}
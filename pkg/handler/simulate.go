@@ -0,0 +1,129 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TraceEvent is a pod event of a trace replayed by Simulate
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+	// Type is TraceEventAssign, the IP assigned to the pod, or TraceEventDelete, the pod deleted and its IP reserved
+	Type      string `json:"type"`
+	IP        string `json:"ip"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Node      string `json:"node,omitempty"`
+}
+
+// SimulationResult sums up the replay of a trace with a setting
+type SimulationResult struct {
+	IPReserveTime     metav1.Duration `json:"ipReserveTime"`
+	IPReserveMaxCount int             `json:"ipReserveMaxCount"`
+	// Reserved is the number of reservations
+	Reserved int `json:"reserved"`
+	// Peak is the most IPs reserved at once, first reached at PeakAt
+	Peak   int       `json:"peak"`
+	PeakAt time.Time `json:"peakAt,omitempty"`
+	// ReleasedTTL is the number of IPs released once held ipReserveTime
+	ReleasedTTL int `json:"releasedTTL"`
+	// EarlyEvictions is the number of IPs released over ipReserveMaxCount before their ipReserveTime
+	EarlyEvictions int `json:"earlyEvictions"`
+	// ReuseIncidents is the number of IPs evicted early, then assigned to another pod
+	ReuseIncidents int `json:"reuseIncidents"`
+	// Prevented is the number of assignments of the trace to another pod that a reservation would have prevented
+	Prevented int `json:"prevented"`
+}
+
+// Simulate replays the trace through the release logic of config on a virtual clock, releasing every period
+// from the first event on. The IPPool and IPAM block settings are left out, a trace does not tell the pools.
+func Simulate(events []TraceEvent, config configv1.CapoConfig, period time.Duration) (*SimulationResult, error) {
+	if config.IPReserveMaxCount == nil {
+		return nil, fmt.Errorf("ipReserveMaxCount must be set")
+	}
+	if period <= 0 {
+		return nil, fmt.Errorf("release period must be positive")
+	}
+	config.IPPools, config.IPAMBlocks = nil, nil
+	keeper, err := NewLazyIPKeeper(nil, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	events = append([]TraceEvent(nil), events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	result := &SimulationResult{IPReserveTime: config.IPReserveTime, IPReserveMaxCount: *config.IPReserveMaxCount}
+	if len(events) == 0 {
+		return result, nil
+	}
+
+	podIPMap := &v1.ConfigMap{Data: map[string]string{}}
+	// the pod, namespace/name, each IP is reserved for, and evicted early from
+	owners := map[string]string{}
+	evicted := map[string]string{}
+	release := func(now time.Time) {
+		releaseIPs, expired := getReleaseIPs(podIPMap, logr.Discard(), keeper, now)
+		keeper.limiter.record(now, expired)
+		// the expired IPs come first, the IPs over the max count last
+		for i, ip := range releaseIPs {
+			if i < expired {
+				result.ReleasedTTL++
+				delete(evicted, ip)
+			} else {
+				result.EarlyEvictions++
+				evicted[ip] = owners[ip]
+			}
+			delete(owners, ip)
+		}
+	}
+
+	next := events[0].Time.Add(period)
+	for _, event := range events {
+		for !next.After(event.Time) {
+			release(next)
+			next = next.Add(period)
+		}
+		pod := event.Namespace + "/" + event.Pod
+		switch event.Type {
+		case cons.TraceEventDelete:
+			if owners[event.IP] == pod {
+				// reserved already, see mergePodInfos
+				continue
+			}
+			podIPMap.Data[event.IP] = buildPodInfo(event.Namespace, event.Pod, event.Node, event.Time)
+			owners[event.IP] = pod
+			delete(evicted, event.IP)
+			result.Reserved++
+			if len(podIPMap.Data) > result.Peak {
+				result.Peak, result.PeakAt = len(podIPMap.Data), event.Time
+			}
+		case cons.TraceEventAssign:
+			if owner, ok := owners[event.IP]; ok {
+				if owner != pod {
+					result.Prevented++
+				}
+				continue
+			}
+			if owner, ok := evicted[event.IP]; ok && owner != pod {
+				result.ReuseIncidents++
+			}
+			delete(evicted, event.IP)
+		default:
+			return nil, fmt.Errorf("unknown trace event type %q", event.Type)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestSimulate(t *testing.T) {
+	start := time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC)
+	event := func(after time.Duration, eventType, ip, pod string) TraceEvent {
+		return TraceEvent{Time: start.Add(after), Type: eventType, IP: ip, Namespace: "redis", Pod: pod, Node: "node01"}
+	}
+	// out of order, Simulate sorts them
+	events := []TraceEvent{
+		event(10*time.Minute, cons.TraceEventAssign, "10.0.1.1", "kafka-0"),
+		event(0, cons.TraceEventDelete, "10.0.1.1", "redis-0"),
+		event(time.Minute, cons.TraceEventDelete, "10.0.1.2", "redis-1"),
+		// deleted twice, reserved once
+		event(90*time.Second, cons.TraceEventDelete, "10.0.1.2", "redis-1"),
+		event(2*time.Minute, cons.TraceEventDelete, "10.0.1.3", "redis-2"),
+		event(11*time.Minute, cons.TraceEventAssign, "10.0.1.2", "kafka-1"),
+		event(2*time.Hour, cons.TraceEventAssign, "10.0.1.3", "kafka-2"),
+	}
+	config := configv1.CapoConfig{IPReserveTime: metav1.Duration{Duration: 30 * time.Minute}}
+
+	// the oldest IP is evicted over the max count, then assigned to another pod
+	config.IPReserveMaxCount = pointer.Int(2)
+	result, err := Simulate(events, config, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, &SimulationResult{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: 2,
+		Reserved:          3,
+		Peak:              3,
+		PeakAt:            start.Add(2 * time.Minute),
+		ReleasedTTL:       2,
+		EarlyEvictions:    1,
+		ReuseIncidents:    1,
+		Prevented:         1,
+	}, result)
+
+	// every IP is held until its reserve time, the assignments within are prevented
+	config.IPReserveMaxCount = pointer.Int(5)
+	result, err = Simulate(events, config, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.ReleasedTTL)
+	assert.Equal(t, 0, result.EarlyEvictions)
+	assert.Equal(t, 0, result.ReuseIncidents)
+	assert.Equal(t, 2, result.Prevented)
+
+	_, err = Simulate([]TraceEvent{{Type: "create"}}, config, time.Minute)
+	assert.Error(t, err)
+	_, err = Simulate(events, configv1.CapoConfig{}, time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+)
+
+// releaseWindow is a window of TTL releases opened at every fire of its schedule
+type releaseWindow struct {
+	schedule *utils.Schedule
+	duration time.Duration
+}
+
+func newReleaseWindows(windows []configv1.ReleaseWindow) ([]releaseWindow, error) {
+	var parsed []releaseWindow
+	for _, window := range windows {
+		schedule, err := utils.ParseSchedule(window.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		if window.Duration.Duration <= 0 || window.Duration.Duration > cons.ReleaseWindowMaxDuration {
+			return nil, fmt.Errorf("release window %q: duration %s out of range (0, %s]",
+				window.Schedule, window.Duration.Duration, cons.ReleaseWindowMaxDuration)
+		}
+		parsed = append(parsed, releaseWindow{schedule: schedule, duration: window.Duration.Duration})
+	}
+	return parsed, nil
+}
+
+// inReleaseWindow reports whether TTL releases may happen at now, always without windows
+func (r *IPKeeper) inReleaseWindow(now time.Time) bool {
+	if len(r.windows) == 0 {
+		return true
+	}
+	for _, window := range r.windows {
+		if _, ok := window.schedule.LastFire(now, window.duration); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLimiter bounds the TTL releases within a sliding interval. It lives in memory,
+// so a new leader starts with the full budget.
+type releaseLimiter struct {
+	max      int
+	interval time.Duration
+
+	mu       sync.Mutex
+	released []time.Time
+}
+
+func newReleaseLimiter(limit *configv1.ReleaseRateLimit) (*releaseLimiter, error) {
+	if limit == nil {
+		return nil, nil
+	}
+	if limit.MaxReleases <= 0 || limit.Interval.Duration <= 0 {
+		return nil, fmt.Errorf("release rate limit: maxReleases and interval must be positive")
+	}
+	return &releaseLimiter{max: limit.MaxReleases, interval: limit.Interval.Duration}, nil
+}
+
+// budget returns how many IPs may be released at now, -1 for no limit
+func (l *releaseLimiter) budget(now time.Time) int {
+	if l == nil {
+		return -1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	since := now.Add(-l.interval)
+	i := 0
+	for i < len(l.released) && !l.released[i].After(since) {
+		i++
+	}
+	l.released = l.released[i:]
+	if left := l.max - len(l.released); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// record records n IPs released at now, once they are actually released
+func (l *releaseLimiter) record(now time.Time, n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i < n; i++ {
+		l.released = append(l.released, now)
+	}
+}
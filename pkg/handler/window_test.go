@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func TestReleaseWindowsAndRateLimit(t *testing.T) {
+	keeper, err := NewLazyIPKeeper(nil, &configv1.CapoConfig{
+		IPReserveTime:     metav1.Duration{Duration: 30 * time.Minute},
+		IPReserveMaxCount: pointer.Int(4),
+		ReleaseWindows: []configv1.ReleaseWindow{
+			{Schedule: "0 2 * * *", Duration: metav1.Duration{Duration: time.Hour}},
+		},
+		ReleaseRateLimit: &configv1.ReleaseRateLimit{MaxReleases: 2, Interval: metav1.Duration{Duration: 10 * time.Minute}},
+	})
+	assert.NoError(t, err)
+	logger := utils.CreateLogger(true, true)
+	open := time.Date(2022, 6, 6, 2, 30, 0, 0, time.Local)
+	closed := open.Add(-time.Hour)
+	// the pod infos are measured against the time of the release
+	podIPMap := &v1.ConfigMap{Data: map[string]string{
+		"10.0.1.1": buildPodInfo("redis", "redis-0", "node01", closed.Add(-4*time.Hour)),
+		"10.0.1.2": buildPodInfo("redis", "redis-1", "node01", closed.Add(-3*time.Hour)),
+		"10.0.1.3": buildPodInfo("redis", "redis-2", "node01", closed.Add(-2*time.Hour)),
+		"10.0.1.4": buildPodInfo("redis", "redis-3", "node01", closed.Add(-time.Hour)),
+		"10.0.1.5": buildPodInfo("redis", "redis-4", "node01", open),
+	}}
+
+	// outside the windows only the longest held IP over the max count is released, expired but held back
+	countBefore := testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonCount))
+	releaseIPs, expired := getReleaseIPs(podIPMap, logger, keeper, closed)
+	assert.Equal(t, []string{"10.0.1.1"}, releaseIPs)
+	assert.Equal(t, 0, expired)
+	assert.Equal(t, countBefore+1, testutil.ToFloat64(metrics.IPReleaseTotal.WithLabelValues(cons.ReleaseReasonCount)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(metrics.IPReleasePending.WithLabelValues(cons.ReleasePendingWindow)))
+
+	// within the window the longest held expired IPs are released up to the rate limit
+	releaseIPs, expired = getReleaseIPs(podIPMap, logger, keeper, open)
+	assert.Equal(t, []string{"10.0.1.2", "10.0.1.3"}, releaseIPs)
+	assert.Equal(t, 2, expired)
+	keeper.limiter.record(open, expired)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReleasePending.WithLabelValues(cons.ReleasePendingWindow)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.IPReleasePending.WithLabelValues(cons.ReleasePendingRateLimit)))
+
+	releaseIPs, _ = getReleaseIPs(podIPMap, logger, keeper, open.Add(5*time.Minute))
+	assert.Empty(t, releaseIPs)
+	releaseIPs, _ = getReleaseIPs(podIPMap, logger, keeper, open.Add(10*time.Minute))
+	assert.Equal(t, []string{"10.0.1.4"}, releaseIPs)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.IPReleasePending.WithLabelValues(cons.ReleasePendingRateLimit)))
+}
+
+func TestReleaseWindowsInvalid(t *testing.T) {
+	for _, config := range []*configv1.CapoConfig{
+		{ReleaseWindows: []configv1.ReleaseWindow{{Schedule: "0 2 * *", Duration: metav1.Duration{Duration: time.Hour}}}},
+		{ReleaseWindows: []configv1.ReleaseWindow{{Schedule: "0 2 * * *"}}},
+		{ReleaseWindows: []configv1.ReleaseWindow{{Schedule: "0 2 * * *", Duration: metav1.Duration{Duration: 8 * 24 * time.Hour}}}},
+		{ReleaseRateLimit: &configv1.ReleaseRateLimit{MaxReleases: 0, Interval: metav1.Duration{Duration: time.Minute}}},
+	} {
+		_, err := NewLazyIPKeeper(nil, config)
+		assert.Error(t, err)
+	}
+}
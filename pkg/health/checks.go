@@ -0,0 +1,114 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// ReleaseLoop reports when it was initialized, and the start and the finish time of the last release cycle
+type ReleaseLoop interface {
+	InitializedAt() time.Time
+	ReleaseTimes() (started, finished time.Time)
+}
+
+// Initialized fails until initialized returns true
+func Initialized(name string, initialized func() bool) healthz.Checker {
+	return func(_ *http.Request) error {
+		if !initialized() {
+			return fmt.Errorf("%s is not initialized", name)
+		}
+		return nil
+	}
+}
+
+// Unless passes while skip returns true, and runs check otherwise
+func Unless(skip func() bool, check healthz.Checker) healthz.Checker {
+	return func(req *http.Request) error {
+		if skip() {
+			return nil
+		}
+		return check(req)
+	}
+}
+
+// Readable fails when the object cannot be read from the API server
+func Readable(reader client.Reader, key client.ObjectKey, newObject func() client.Object) healthz.Checker {
+	return func(req *http.Request) error {
+		obj := newObject()
+		if err := reader.Get(req.Context(), key, obj); err != nil {
+			return fmt.Errorf("unable to read %T %s: %v", obj, key, err)
+		}
+		return nil
+	}
+}
+
+// APIServed fails when the API server does not serve the resource in the group version,
+// for instance when the calico-apiserver is down or its APIService is unavailable
+func APIServed(discoveryClient discovery.DiscoveryInterface, groupVersion, resource string) healthz.Checker {
+	return func(_ *http.Request) error {
+		resources, err := discoveryClient.ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			return fmt.Errorf("%s is not served: %v", groupVersion, err)
+		}
+		for _, r := range resources.APIResources {
+			if r.Name == resource {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not served by %s", resource, groupVersion)
+	}
+}
+
+// ElectedAt returns when elected was closed, the zero time until it is
+func ElectedAt(elected <-chan struct{}) func() time.Time {
+	var at int64
+	go func() {
+		<-elected
+		atomic.StoreInt64(&at, time.Now().UnixNano())
+	}()
+	return func() time.Time {
+		if nanos := atomic.LoadInt64(&at); nanos != 0 {
+			return time.Unix(0, nanos)
+		}
+		return time.Time{}
+	}
+}
+
+// ReleaseLoopAlive fails when the release loop is wedged: a cycle has been running for longer than
+// timeout, or no cycle has started within timeout since this replica became the leader, at electedAt,
+// with an initialized keeper. Only the leader runs the release loop, the check always passes before
+// it is elected, and until the loop is initialized, which the readiness checks cover.
+func ReleaseLoopAlive(loop ReleaseLoop, electedAt func() time.Time, timeout time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		since, initialized := electedAt(), loop.InitializedAt()
+		if since.IsZero() || initialized.IsZero() {
+			return nil
+		}
+		if initialized.After(since) {
+			since = initialized
+		}
+
+		now := time.Now()
+		started, finished := loop.ReleaseTimes()
+		if started.After(finished) && now.Sub(started) > timeout {
+			return fmt.Errorf("release cycle started at %s has not finished", started.Format(time.RFC3339))
+		}
+		if started.After(since) {
+			since = started
+		}
+		if now.Sub(since) > timeout {
+			return fmt.Errorf("no release cycle started since %s", since.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
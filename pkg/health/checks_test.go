@@ -0,0 +1,126 @@
+package health
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+type releaseLoop struct {
+	initializedAt     time.Time
+	started, finished time.Time
+}
+
+func (l *releaseLoop) InitializedAt() time.Time {
+	return l.initializedAt
+}
+
+func (l *releaseLoop) ReleaseTimes() (time.Time, time.Time) {
+	return l.started, l.finished
+}
+
+func newRequest() *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	return req
+}
+
+func TestReadable(t *testing.T) {
+	key := types.NamespacedName{Namespace: "capo", Name: "ip-reserve-delay-release"}
+	newConfigMap := func() client.Object { return &v1.ConfigMap{} }
+
+	empty := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+	assert.Error(t, Readable(empty, key, newConfigMap)(newRequest()))
+
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+	withState := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(cm).Build()
+	assert.NoError(t, Readable(withState, key, newConfigMap)(newRequest()))
+}
+
+func TestAPIServed(t *testing.T) {
+	discovery := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{}}
+	check := APIServed(discovery, "projectcalico.org/v3", "ipreservations")
+	assert.Error(t, check(newRequest()))
+
+	discovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "projectcalico.org/v3",
+		APIResources: []metav1.APIResource{{Name: "ippools"}},
+	}}
+	assert.Error(t, check(newRequest()))
+
+	discovery.Resources[0].APIResources = append(discovery.Resources[0].APIResources, metav1.APIResource{Name: "ipreservations"})
+	assert.NoError(t, check(newRequest()))
+}
+
+func TestUnless(t *testing.T) {
+	skip := true
+	check := Unless(func() bool { return skip }, Initialized("IPKeeper", func() bool { return false }))
+	assert.NoError(t, check(newRequest()))
+	skip = false
+	assert.Error(t, check(newRequest()))
+}
+
+func TestInitialized(t *testing.T) {
+	initialized := false
+	check := Initialized("IPKeeper", func() bool { return initialized })
+	assert.Error(t, check(newRequest()))
+	initialized = true
+	assert.NoError(t, check(newRequest()))
+}
+
+func TestReleaseLoopAlive(t *testing.T) {
+	loop := &releaseLoop{}
+	var electedAt time.Time
+	timeout := time.Minute
+	check := ReleaseLoopAlive(loop, func() time.Time { return electedAt }, timeout)
+	now := time.Now()
+
+	// a follower never runs the loop
+	loop.initializedAt = now.Add(-time.Hour)
+	assert.NoError(t, check(newRequest()))
+
+	// the window starts at the election, whenever the first probe comes
+	electedAt = now.Add(-2 * timeout)
+	assert.Error(t, check(newRequest()), "no cycle started since elected")
+	electedAt = now.Add(-timeout / 2)
+	assert.NoError(t, check(newRequest()), "just elected")
+
+	// or once the keeper is initialized, if later
+	electedAt = now.Add(-time.Hour)
+	loop.initializedAt = time.Time{}
+	assert.NoError(t, check(newRequest()), "uninitialized")
+	loop.initializedAt = now.Add(-timeout / 2)
+	assert.NoError(t, check(newRequest()), "just initialized")
+	loop.initializedAt = now.Add(-2 * timeout)
+	assert.Error(t, check(newRequest()), "no cycle started since initialized")
+
+	loop.started, loop.finished = now.Add(-2*time.Millisecond), now.Add(-time.Millisecond)
+	assert.NoError(t, check(newRequest()), "finished cycle")
+
+	loop.started, loop.finished = now.Add(-2*timeout), now.Add(-3*timeout)
+	assert.Error(t, check(newRequest()), "cycle in flight for longer than the timeout")
+
+	loop.started, loop.finished = now.Add(-3*timeout), now.Add(-2*timeout)
+	assert.Error(t, check(newRequest()), "no cycle started within the timeout")
+}
+
+func TestElectedAt(t *testing.T) {
+	elected := make(chan struct{})
+	electedAt := ElectedAt(elected)
+	assert.True(t, electedAt().IsZero())
+
+	before := time.Now()
+	close(elected)
+	assert.Eventually(t, func() bool { return !electedAt().IsZero() }, time.Second, time.Millisecond)
+	assert.False(t, electedAt().Before(before))
+	assert.Equal(t, electedAt(), electedAt())
+}
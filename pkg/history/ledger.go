@@ -0,0 +1,340 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// recordsKey is the ConfigMap data key holding the JSON encoded records
+const recordsKey = "records"
+
+// Record is the ownership history of one IP by one pod, Owner is the top-level controller owner of the pod,
+// Block the Calico IPAM block of the IP and BlockNode the node the block was affine to when the IP was reserved
+type Record struct {
+	IP         string     `json:"ip"`
+	Namespace  string     `json:"namespace"`
+	Pod        string     `json:"pod"`
+	Node       string     `json:"node,omitempty"`
+	Owner      string     `json:"owner,omitempty"`
+	Block      string     `json:"block,omitempty"`
+	BlockNode  string     `json:"blockNode,omitempty"`
+	UID        types.UID  `json:"uid,omitempty"`
+	AssignedAt *time.Time `json:"assignedAt,omitempty"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty"`
+	ReservedAt *time.Time `json:"reservedAt,omitempty"`
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+}
+
+// start is the first time the pod is known to have owned the IP
+func (r *Record) start() time.Time {
+	var start time.Time
+	for _, t := range []*time.Time{r.AssignedAt, r.ReservedAt, r.DeletedAt, r.ReleasedAt} {
+		if t != nil && (start.IsZero() || t.Before(start)) {
+			start = *t
+		}
+	}
+	return start
+}
+
+// end is the time the IP stopped belonging to the pod, zero if it still does
+func (r *Record) end() time.Time {
+	if r.ReleasedAt != nil {
+		return *r.ReleasedAt
+	}
+	if r.ReservedAt == nil && r.DeletedAt != nil {
+		return *r.DeletedAt
+	}
+	return time.Time{}
+}
+
+// matches reports whether the record belongs to the given pod incarnation,
+// an empty uid matches any incarnation
+func (r *Record) matches(ip, namespace, pod string, uid types.UID) bool {
+	if r.IP != ip || r.Namespace != namespace || r.Pod != pod {
+		return false
+	}
+	return uid == "" || r.UID == "" || r.UID == uid
+}
+
+// merge fills the fields of r missing or later than those in o
+func (r *Record) merge(o *Record) {
+	if r.Node == "" {
+		r.Node = o.Node
+	}
+	if r.Owner == "" {
+		r.Owner = o.Owner
+	}
+	if r.Block == "" {
+		r.Block, r.BlockNode = o.Block, o.BlockNode
+	}
+	if r.UID == "" {
+		r.UID = o.UID
+	}
+	r.AssignedAt = earliest(r.AssignedAt, o.AssignedAt)
+	r.DeletedAt = earliest(r.DeletedAt, o.DeletedAt)
+	r.ReservedAt = earliest(r.ReservedAt, o.ReservedAt)
+	r.ReleasedAt = earliest(r.ReleasedAt, o.ReleasedAt)
+}
+
+func earliest(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.Before(*a)) {
+		return b
+	}
+	return a
+}
+
+// Ledger keeps a bounded ownership history of pod IPs. Records are kept in memory
+// and periodically merged into a ConfigMap shared by all capo replicas, so the history
+// survives restarts and IpRelease deleting the pod info of released IPs.
+type Ledger struct {
+	client      client.Client
+	nsName      types.NamespacedName
+	maxRecords  int
+	flushPeriod time.Duration
+
+	mu      sync.RWMutex
+	records []*Record
+	// records changed since the last flush, 0 if none
+	changes uint64
+}
+
+func NewLedger(client client.Client, maxRecords int) *Ledger {
+	return &Ledger{
+		client: client,
+		nsName: types.NamespacedName{
+			Name:      cons.HistoryConfigMapName,
+			Namespace: utils.GetNamespace(),
+		},
+		maxRecords:  maxRecords,
+		flushPeriod: cons.HistoryFlushPeriod,
+	}
+}
+
+// Assigned records that the pod owns its IPs
+func (l *Ledger) Assigned(pod *v1.Pod, at time.Time) {
+	if l == nil {
+		return
+	}
+	for _, ip := range pod.Status.PodIPs {
+		l.update(ip.IP, pod.Namespace, pod.Name, pod.Spec.NodeName, pod.UID, func(r *Record) {
+			r.AssignedAt = earliest(r.AssignedAt, &at)
+		})
+	}
+}
+
+// Deleted records the deletion of the pod for every IP it still owns
+func (l *Ledger) Deleted(namespace, name string, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.records {
+		if r.Namespace == namespace && r.Pod == name && r.DeletedAt == nil && r.ReleasedAt == nil {
+			r.DeletedAt = &at
+			l.changes++
+		}
+	}
+}
+
+// Reserved records that the IP of the pod, owned by owner, was put into the IPReservation
+func (l *Ledger) Reserved(pod *v1.Pod, ip, owner string, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.update(ip, pod.Namespace, pod.Name, pod.Spec.NodeName, pod.UID, func(r *Record) {
+		if r.Owner == "" {
+			r.Owner = owner
+		}
+		r.ReservedAt = earliest(r.ReservedAt, &at)
+	})
+}
+
+// Placed records the IPAM block of the reserved IP of the pod and the node the block is affine to
+func (l *Ledger) Placed(pod *v1.Pod, ip, block, blockNode string) {
+	if l == nil {
+		return
+	}
+	l.update(ip, pod.Namespace, pod.Name, pod.Spec.NodeName, pod.UID, func(r *Record) {
+		r.Block, r.BlockNode = block, blockNode
+	})
+}
+
+// Released records that the IP reserved for the pod was given back to Calico
+func (l *Ledger) Released(ip, namespace, name, nodeName string, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.update(ip, namespace, name, nodeName, "", func(r *Record) {
+		if r.ReleasedAt == nil {
+			r.ReleasedAt = &at
+		}
+	})
+}
+
+// update applies fn to the newest record of the pod incarnation owning the IP, creating it if needed
+func (l *Ledger) update(ip, namespace, name, nodeName string, uid types.UID, fn func(r *Record)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := l.find(l.records, &Record{IP: ip, Namespace: namespace, Pod: name, UID: uid})
+	if record == nil {
+		record = &Record{IP: ip, Namespace: namespace, Pod: name}
+		l.records = append(l.records, record)
+	}
+	record.merge(&Record{Node: nodeName, UID: uid})
+	fn(record)
+	l.changes++
+	l.records = trim(l.records, l.maxRecords)
+}
+
+// find returns the newest record in records matching r
+func (l *Ledger) find(records []*Record, r *Record) *Record {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].matches(r.IP, r.Namespace, r.Pod, r.UID) {
+			return records[i]
+		}
+	}
+	return nil
+}
+
+// Query returns copies of the records matching q, oldest first
+func (l *Ledger) Query(q Query) []Record {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	result := []Record{}
+	for _, r := range l.records {
+		if q.Matches(r) {
+			result = append(result, *r)
+		}
+	}
+	return result
+}
+
+// Start loads the persisted history and merges the in-memory records into it every flush period
+func (l *Ledger) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("history")
+	ticker := time.NewTicker(l.flushPeriod)
+	defer ticker.Stop()
+	for {
+		if err := l.Flush(ctx); err != nil {
+			logger.Error(err, "flush ip history failed")
+		}
+		select {
+		case <-ctx.Done():
+			// last chance to persist what was recorded since the previous flush
+			if err := l.Flush(context.Background()); err != nil {
+				logger.Error(err, "flush ip history failed")
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica records its own webhook calls
+func (l *Ledger) NeedLeaderElection() bool {
+	return false
+}
+
+// Flush merges the in-memory records with the persisted ones, and keeps the merged result in memory
+// so that queries on every replica see the records of the others.
+func (l *Ledger) Flush(ctx context.Context) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.nsName.Name,
+				Namespace: l.nsName.Namespace,
+			},
+		}
+		err := l.client.Get(ctx, l.nsName, cm)
+		notFound := errors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+
+		var persisted []*Record
+		if data := cm.Data[recordsKey]; data != "" {
+			if err = json.Unmarshal([]byte(data), &persisted); err != nil {
+				log.FromContext(ctx).Info("drop undecodable ip history", "err", err.Error())
+				persisted = nil
+			}
+		}
+
+		// the webhook records while the merged records are written
+		l.mu.Lock()
+		merged := l.mergeInto(persisted)
+		changes := l.changes
+		l.mu.Unlock()
+
+		if changes > 0 {
+			data, err := json.Marshal(merged)
+			if err != nil {
+				return err
+			}
+			cm.Data = map[string]string{recordsKey: string(data)}
+			if notFound {
+				err = l.client.Create(ctx, cm)
+			} else {
+				err = l.client.Update(ctx, cm)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// records changed since the snapshot stay in memory, merged at the next flush
+		if l.changes == changes {
+			l.records = merged
+			l.changes = 0
+		}
+		return nil
+	})
+}
+
+// mergeInto merges the in-memory records into persisted, sorted by start time and trimmed to maxRecords
+func (l *Ledger) mergeInto(persisted []*Record) []*Record {
+	for _, r := range l.records {
+		if found := l.find(persisted, r); found != nil {
+			found.merge(r)
+			continue
+		}
+		record := *r
+		persisted = append(persisted, &record)
+	}
+	sort.SliceStable(persisted, func(i, j int) bool {
+		return persisted[i].start().Before(persisted[j].start())
+	})
+	return trim(persisted, l.maxRecords)
+}
+
+// trim drops the oldest records beyond max
+func trim(records []*Record, max int) []*Record {
+	if max <= 0 || len(records) <= max {
+		return records
+	}
+	return records[len(records)-max:]
+}
@@ -0,0 +1,153 @@
+package history
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newPod(name, ip string, uid types.UID) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "redis",
+			UID:       uid,
+		},
+		Spec: v1.PodSpec{
+			NodeName: "node01",
+		},
+		Status: v1.PodStatus{
+			PodIPs: []v1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+func TestLedgerLifecycle(t *testing.T) {
+	ledger := NewLedger(fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(), 10)
+	start := time.Date(2022, 11, 24, 14, 0, 0, 0, time.UTC)
+
+	pod := newPod("redis-0", "10.12.3.4", "uid-1")
+	ledger.Assigned(pod, start)
+	ledger.Reserved(pod, "10.12.3.4", "StatefulSet.apps/redis", start.Add(time.Hour))
+	ledger.Deleted(pod.Namespace, pod.Name, start.Add(time.Hour))
+	ledger.Released("10.12.3.4", pod.Namespace, pod.Name, "node01", start.Add(2*time.Hour))
+
+	// the same pod name gets the IP again later
+	again := newPod("redis-0", "10.12.3.4", "uid-2")
+	ledger.Assigned(again, start.Add(3*time.Hour))
+
+	records := ledger.Query(Query{IP: "10.12.3.4"})
+	assert.Len(t, records, 2)
+	assert.Equal(t, types.UID("uid-1"), records[0].UID)
+	assert.Equal(t, start.Add(2*time.Hour), *records[0].ReleasedAt)
+	assert.Nil(t, records[1].ReleasedAt)
+
+	at := start.Add(90 * time.Minute)
+	records = ledger.Query(Query{IP: "10.12.3.4", Since: at, Until: at})
+	assert.Len(t, records, 1)
+	assert.Equal(t, types.UID("uid-1"), records[0].UID)
+
+	assert.Len(t, ledger.Query(Query{Pod: "redis/redis-0"}), 2)
+	assert.Empty(t, ledger.Query(Query{Pod: "kafka/redis-0"}))
+	assert.Empty(t, ledger.Query(Query{Until: start.Add(-time.Minute)}))
+}
+
+func TestLedgerBounded(t *testing.T) {
+	ledger := NewLedger(fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(), 2)
+	now := time.Now()
+	ledger.Assigned(newPod("a", "10.0.0.1", "a"), now)
+	ledger.Assigned(newPod("b", "10.0.0.2", "b"), now)
+	ledger.Assigned(newPod("c", "10.0.0.3", "c"), now)
+
+	records := ledger.Query(Query{})
+	assert.Len(t, records, 2)
+	assert.Equal(t, "b", records[0].Pod)
+}
+
+func TestLedgerFlush(t *testing.T) {
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	replica1 := NewLedger(fakeClient, 10)
+	pod := newPod("redis-0", "10.12.3.4", "uid-1")
+	replica1.Reserved(pod, "10.12.3.4", "", now)
+	replica1.Placed(pod, "10.12.3.4", "10.12.3.0/26", "node01")
+	assert.Nil(t, replica1.Flush(context.TODO()))
+
+	// another replica releases the IP without having seen the reservation
+	replica2 := NewLedger(fakeClient, 10)
+	replica2.Released("10.12.3.4", pod.Namespace, pod.Name, "node01", now.Add(time.Hour))
+	assert.Nil(t, replica2.Flush(context.TODO()))
+
+	cm := &v1.ConfigMap{}
+	assert.Nil(t, fakeClient.Get(context.TODO(), replica1.nsName, cm))
+	assert.Contains(t, cm.Data[recordsKey], "uid-1")
+
+	assert.Nil(t, replica1.Flush(context.TODO()))
+	records := replica1.Query(Query{IP: "10.12.3.4"})
+	assert.Len(t, records, 1)
+	assert.Equal(t, now, *records[0].ReservedAt)
+	assert.Equal(t, now.Add(time.Hour), *records[0].ReleasedAt)
+	assert.Equal(t, "10.12.3.0/26", records[0].Block)
+	assert.Equal(t, "node01", records[0].BlockNode)
+}
+
+// recordingClient records a pod in the ledger while the history ConfigMap is written
+type recordingClient struct {
+	client.Client
+	ledger *Ledger
+	pod    *v1.Pod
+}
+
+func (c *recordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if c.pod != nil {
+		c.ledger.Assigned(c.pod, time.Now())
+		c.pod = nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestLedgerFlushConcurrentRecord(t *testing.T) {
+	c := &recordingClient{Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(), pod: newPod("redis-1", "10.12.3.5", "uid-2")}
+	ledger := NewLedger(c, 10)
+	c.ledger = ledger
+	ledger.Assigned(newPod("redis-0", "10.12.3.4", "uid-1"), time.Now())
+
+	// the record made during the write is neither blocked nor lost
+	assert.Nil(t, ledger.Flush(context.TODO()))
+	assert.Len(t, ledger.Query(Query{}), 2)
+	cm := &v1.ConfigMap{}
+	assert.Nil(t, c.Get(context.TODO(), ledger.nsName, cm))
+	assert.NotContains(t, cm.Data[recordsKey], "uid-2")
+
+	assert.Nil(t, ledger.Flush(context.TODO()))
+	assert.Nil(t, c.Get(context.TODO(), ledger.nsName, cm))
+	assert.Contains(t, cm.Data[recordsKey], "uid-2")
+	assert.Len(t, ledger.Query(Query{}), 2)
+}
+
+func TestHandler(t *testing.T) {
+	ledger := NewLedger(fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(), 10)
+	ledger.Assigned(newPod("redis-0", "10.12.3.4", "uid-1"), time.Now())
+	h := NewHandler(ledger)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, cons.HistoryPath+"?ip=10.12.3.4", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "redis-0")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, cons.HistoryPath+"?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	paramIP    = "ip"
+	paramPod   = "pod"
+	paramOwner = "owner"
+	paramSince = "since"
+	paramUntil = "until"
+)
+
+// Query filters the ownership history, zero fields match everything
+type Query struct {
+	IP string
+	// Pod is either a pod name or namespace/name
+	Pod string
+	// Owner is the top-level owner of the pods, Kind.group/name
+	Owner string
+	Since time.Time
+	Until time.Time
+}
+
+// Matches reports whether the record passes every filter of q. A record matches the
+// time range if the pod owned the IP at any moment within [Since, Until].
+func (q Query) Matches(r *Record) bool {
+	if q.IP != "" && q.IP != r.IP {
+		return false
+	}
+	if q.Pod != "" {
+		if split := strings.SplitN(q.Pod, "/", 2); len(split) == 2 {
+			if split[0] != r.Namespace || split[1] != r.Pod {
+				return false
+			}
+		} else if q.Pod != r.Pod {
+			return false
+		}
+	}
+	if q.Owner != "" && q.Owner != r.Owner {
+		return false
+	}
+	if !q.Until.IsZero() && r.start().After(q.Until) {
+		return false
+	}
+	if end := r.end(); !q.Since.IsZero() && !end.IsZero() && end.Before(q.Since) {
+		return false
+	}
+	return true
+}
+
+// Values encodes q as URL query parameters
+func (q Query) Values() url.Values {
+	values := url.Values{}
+	if q.IP != "" {
+		values.Set(paramIP, q.IP)
+	}
+	if q.Pod != "" {
+		values.Set(paramPod, q.Pod)
+	}
+	if q.Owner != "" {
+		values.Set(paramOwner, q.Owner)
+	}
+	if !q.Since.IsZero() {
+		values.Set(paramSince, q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		values.Set(paramUntil, q.Until.Format(time.RFC3339))
+	}
+	return values
+}
+
+// ParseQuery decodes the URL query parameters produced by Query.Values
+func ParseQuery(values url.Values) (Query, error) {
+	q := Query{
+		IP:    values.Get(paramIP),
+		Pod:   values.Get(paramPod),
+		Owner: values.Get(paramOwner),
+	}
+	var err error
+	if v := values.Get(paramSince); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid %s: %v", paramSince, err)
+		}
+	}
+	if v := values.Get(paramUntil); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid %s: %v", paramUntil, err)
+		}
+	}
+	return q, nil
+}
+
+// Response is the body served by the history endpoint
+type Response struct {
+	Records []Record `json:"records"`
+}
+
+type handler struct {
+	ledger *Ledger
+}
+
+// NewHandler serves the records of the ledger matching the query parameters as JSON
+func NewHandler(ledger *Ledger) http.Handler {
+	return &handler{ledger: ledger}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := ParseQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Response{Records: h.ledger.Query(q)})
+}
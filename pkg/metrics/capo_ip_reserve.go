@@ -36,6 +36,213 @@ var (
 		},
 	)
 
+	IPReserveHeldByNamespace = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_by_namespace",
+			Help:      "Number of reserved IPs by the namespace of the pod that owned them",
+		},
+		[]string{cons.LabelNamespace},
+	)
+
+	IPReserveHeldByNode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_by_node",
+			Help:      "Number of reserved IPs by the node of the pod that owned them",
+		},
+		[]string{cons.LabelNode},
+	)
+
+	IPReserveHeldByOwnerKind = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_by_owner_kind",
+			Help:      "Number of reserved IPs by the top-level owner kind of the pod that owned them",
+		},
+		[]string{cons.LabelKind},
+	)
+
+	IPReserveHeldByBlock = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_by_block",
+			Help:      "Number of reserved IPs by the Calico IPAM block they belong to and the node the block is affine to",
+		},
+		[]string{cons.LabelBlock, cons.LabelNode},
+	)
+
+	IPReserveHeldByPool = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_by_pool",
+			Help:      "Number of reserved IPs by the Calico IPPool they belong to, set when ipPools is configured",
+		},
+		[]string{cons.LabelPool},
+	)
+
+	IPReserveCountMaxByPool = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "count_max_by_pool",
+			Help:      "ip reserve count max number of the configured Calico IPPools",
+		},
+		[]string{cons.LabelPool},
+	)
+
+	IPReleaseByPoolTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "release_by_pool_total",
+			Help:      "Number of released IP reservations by Calico IPPool and reason, counted when ipPools is configured",
+		},
+		[]string{cons.LabelPool, cons.LabelReason},
+	)
+
+	IPReserveHeldSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "held_seconds",
+			Help:      "How long IPs were held in the reservation before they were released",
+			// 1m to ~34h
+			Buckets: prometheus.ExponentialBuckets(60, 2, 12),
+		},
+	)
+
+	ReserveBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "reserve_batch_size",
+			Help:      "Number of pods whose reservations were written together in one batch",
+			// 1 to 128
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		},
+	)
+
+	IPReleaseTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "release_total",
+			Help:      "Number of released IP reservations by reason: ttl, count, pressure, block, manual, workload-gone",
+		},
+		[]string{cons.LabelReason},
+	)
+
+	IPReleasePending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "release_pending",
+			Help:      "Number of expired IPs held back by reason: window (outside the release windows), rate-limit",
+		},
+		[]string{cons.LabelReason},
+	)
+
+	WebhookDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "webhook_decisions_total",
+			Help:      "Number of pod webhook decisions by outcome: ignored, allowed, denied, degraded",
+		},
+		[]string{cons.LabelOutcome},
+	)
+
+	WebhookDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "webhook_duration_seconds",
+			Help:      "Latency of the pod webhook by outcome",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{cons.LabelOutcome},
+	)
+
+	CalicoAPIDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "calico_api_duration_seconds",
+			Help:      "Latency of the calico-apiserver IPReservation calls by operation",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{cons.LabelOperation},
+	)
+
+	CalicoAPIErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "calico_api_errors_total",
+			Help:      "Number of failed calico-apiserver IPReservation calls by operation",
+		},
+		[]string{cons.LabelOperation},
+	)
+
+	ClaimWebhookDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "claim_webhook_decisions_total",
+			Help:      "Number of decisions on pod creations by outcome: ignored, bound, denied",
+		},
+		[]string{cons.LabelOutcome},
+	)
+
+	StateWebhookDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "state_webhook_decisions_total",
+			Help:      "Number of decisions on changes of the IPReservation and the pod info ConfigMap by outcome: ignored, allowed, denied, break-glass",
+		},
+		[]string{cons.LabelOutcome},
+	)
+
+	IPReserveDegraded = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "degraded",
+			Help:      "1 while pod deletions are allowed without reserving IPs because the keeper is not initialized",
+		},
+	)
+
+	IPReserveShadow = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "shadow",
+			Help:      "1 while reservations and releases are recorded in the shadow ConfigMaps instead of the IPReservation",
+		},
+	)
+
+	IPReserveFrozen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "frozen",
+			Help:      "1 while the releases are frozen by the freeze annotation of the IPReservation",
+		},
+	)
+
+	IPReserveFrozenExcess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "frozen_excess_count",
+			Help:      "Number of reserved IPs beyond the max count kept because the releases are frozen",
+		},
+	)
+
+	IPReserveDriftOrphans = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "drift_orphans",
+			Help:      "Number of IPs found by the last consistency check by kind: unrecorded (reserved without pod info), unreserved (pod info without reservation)",
+		},
+		[]string{cons.LabelKind},
+	)
+
+	IPReserveDriftRepairedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: cons.IPReserveMetricNamespace,
+			Name:      "drift_repaired_total",
+			Help:      "Number of drifted IPs repaired by kind and action: adopt, drop",
+		},
+		[]string{cons.LabelKind, cons.LabelAction},
+	)
+
 	/*IPReserveKeptTime = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: cons.IPReserveMetricNamespace,
@@ -60,5 +267,9 @@ func init() {
 	// Registry is a prometheus registry for storing metrics within the controller-runtime.
 	// todo 导入 _ "k8s.io/component-base/metrics/prometheus/clientgo" 这个包获取leader选举metrics失败, 因为和这里的metrics.Registry不是同一个对象
 	// 这里是kubebuilder controller runtime包内置的，而leader选举 metrics位于 k8s 代码中
-	metrics.Registry.MustRegister(IPReserveCount, IPReserveCountMaxLimit, IPReserveEvictionsCount)
+	metrics.Registry.MustRegister(IPReserveCount, IPReserveCountMaxLimit, IPReserveEvictionsCount,
+		IPReserveHeldByNamespace, IPReserveHeldByNode, IPReserveHeldByOwnerKind, IPReserveHeldByBlock, IPReserveHeldByPool, IPReserveCountMaxByPool,
+		IPReserveHeldSeconds, ReserveBatchSize, IPReleaseTotal, IPReleaseByPoolTotal, IPReleasePending,
+		WebhookDecisionsTotal, WebhookDurationSeconds, StateWebhookDecisionsTotal, ClaimWebhookDecisionsTotal, CalicoAPIDurationSeconds, CalicoAPIErrorsTotal,
+		IPReserveDegraded, IPReserveShadow, IPReserveFrozen, IPReserveFrozenExcess, IPReserveDriftOrphans, IPReserveDriftRepairedTotal)
 }
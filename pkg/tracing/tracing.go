@@ -0,0 +1,88 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package tracing
+
+import (
+	"context"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/xdfdotcn/capo"
+	defaultServiceName = "capo"
+	defaultPercentage  = 100
+
+	// span attribute keys
+	AttrNamespace = attribute.Key("k8s.namespace.name")
+	AttrPod       = attribute.Key("k8s.pod.name")
+	AttrIP        = attribute.Key("capo.ip")
+)
+
+// Tracer returns the capo tracer, a no-op one until Setup installs an exporting provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Setup installs a global tracer provider exporting spans over OTLP/HTTP when tracing is enabled.
+// The returned function flushes the pending spans and must be called before exiting.
+func Setup(ctx context.Context, config *configv1.TracingConfig) (func(context.Context) error, error) {
+	if config == nil || !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if config.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	percentage := defaultPercentage
+	if config.SamplingPercentage != nil {
+		percentage = *config.SamplingPercentage
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(percentage)/100))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// PodAttributes returns the span attributes identifying a pod
+func PodAttributes(namespace, name string) []attribute.KeyValue {
+	return []attribute.KeyValue{AttrNamespace.String(namespace), AttrPod.String(name)}
+}
+
+// RecordError marks the span failed when err is not nil
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector recording the export requests
+type collector struct {
+	mu     sync.Mutex
+	paths  []string
+	bodies [][]byte
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, req.URL.Path)
+	c.bodies = append(c.bodies, body)
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestSetupDisabled(t *testing.T) {
+	shutdown, err := Setup(context.TODO(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.TODO()))
+
+	shutdown, err = Setup(context.TODO(), &configv1.TracingConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, shutdown(context.TODO()))
+}
+
+func TestSetupExportsSpans(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	shutdown, err := Setup(context.TODO(), &configv1.TracingConfig{
+		Enabled:  true,
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Insecure: true,
+	})
+	assert.Nil(t, err)
+
+	_, span := Tracer().Start(context.TODO(), "podValidator.Handle")
+	span.SetAttributes(PodAttributes("redis", "redis-0")...)
+	span.SetAttributes(AttrIP.String("10.12.3.4"))
+	span.End()
+
+	// shutdown flushes the batched spans to the collector
+	assert.Nil(t, shutdown(context.TODO()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Equal(t, []string{"/v1/traces"}, c.paths)
+	assert.Contains(t, string(c.bodies[0]), "podValidator.Handle")
+	assert.Contains(t, string(c.bodies[0]), "redis-0")
+	assert.Contains(t, string(c.bodies[0]), "10.12.3.4")
+}
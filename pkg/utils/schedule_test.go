@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+
+	// Monday 2022-06-06 02:30 UTC
+	monday := time.Date(2022, 6, 6, 2, 30, 0, 0, time.UTC)
+	for spec, matches := range map[string]bool{
+		"* * * * *":        true,
+		"30 2 * * *":       true,
+		"*/15 2 * * *":     true,
+		"*/20 2 * * *":     false,
+		"10/20 * * * *":    true,
+		"0,30 1-3 * * 1-5": true,
+		"30 2 * * 0,6":     false,
+		"30 2 6 * 0":       true,
+		"30 2 7 * 0":       false,
+		"30 2 * 6 *":       true,
+		"30 2 * 7 *":       false,
+		"30 2 * * 7":       false,
+		"30 2 * * */2":     false,
+		"30 2 1-7 * *":     true,
+		// a day field starting with * is unrestricted, so both day fields must match
+		"30 2 */5 * 3":       false,
+		"30 2 15 * 3-4,2":    false,
+		"0-59/30 0-23 * * *": true,
+	} {
+		schedule, err := ParseSchedule(spec)
+		assert.NoError(t, err, spec)
+		assert.Equal(t, matches, schedule.Matches(monday), spec)
+	}
+
+	// 7 is Sunday as well
+	schedule, err := ParseSchedule("0 0 * * 7")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Matches(time.Date(2022, 6, 5, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestScheduleLastFire(t *testing.T) {
+	schedule, err := ParseSchedule("0 2 * * *")
+	assert.NoError(t, err)
+
+	now := time.Date(2022, 6, 6, 3, 59, 30, 0, time.UTC)
+	fire, ok := schedule.LastFire(now, 2*time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2022, 6, 6, 2, 0, 0, 0, time.UTC), fire)
+
+	// the window of 2h opened at 02:00 closes at 04:00
+	_, ok = schedule.LastFire(now.Add(time.Minute), 2*time.Hour)
+	assert.False(t, ok)
+	_, ok = schedule.LastFire(time.Date(2022, 6, 6, 1, 59, 0, 0, time.UTC), 24*time.Hour)
+	assert.True(t, ok)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// PodSelectors selects the pods matched by any of its entries
+type PodSelectors []podSelector
+
+type podSelector struct {
+	namespace     labels.Selector
+	pod           labels.Selector
+	ownerKinds    []kindMatcher
+	topOwnerKinds []kindMatcher
+}
+
+// kindMatcher matches the kind of an owner, and its group and version when set
+type kindMatcher struct {
+	kind     string
+	group    string
+	version  string
+	anyGroup bool
+}
+
+var versionPattern = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// parseKind parses Kind, Kind.group or Kind.version.group, the group may contain dots
+func parseKind(s string) (kindMatcher, error) {
+	split := strings.SplitN(s, ".", 2)
+	if split[0] == "" {
+		return kindMatcher{}, fmt.Errorf("invalid kind %q", s)
+	}
+	matcher := kindMatcher{kind: split[0], anyGroup: len(split) == 1}
+	if len(split) == 2 {
+		matcher.group = split[1]
+		if rest := strings.SplitN(split[1], ".", 2); versionPattern.MatchString(rest[0]) {
+			matcher.version = rest[0]
+			matcher.group = ""
+			if len(rest) == 2 {
+				matcher.group = rest[1]
+			}
+		}
+	}
+	return matcher, nil
+}
+
+func (m kindMatcher) matches(owner *metav1.OwnerReference) bool {
+	if owner == nil || owner.Kind != m.kind {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return false
+	}
+	return (m.anyGroup || m.group == gv.Group) && (m.version == "" || m.version == gv.Version)
+}
+
+func parseKinds(field string, kinds []string) ([]kindMatcher, error) {
+	matchers := make([]kindMatcher, 0, len(kinds))
+	for _, kind := range kinds {
+		matcher, err := parseKind(kind)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+func anyKindMatches(matchers []kindMatcher, owner *metav1.OwnerReference) bool {
+	for _, matcher := range matchers {
+		if matcher.matches(owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultLabelSelector selects the pods of StatefulSets and the Kafka brokers
+func DefaultLabelSelector() *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      cons.LabelSelectorStatefulSetPodKey,
+				Operator: metav1.LabelSelectorOpExists,
+			},
+			{
+				Key:      cons.LabelSelectorKafkaPodKey,
+				Operator: metav1.LabelSelectorOpExists,
+			},
+		},
+	}
+}
+
+// LegacyPodSelectors converts the deprecated labelSelector, whose requirements are ORed,
+// into one pod selector per requirement, in the namespaces labeled ip-reserve=enabled
+func LegacyPodSelectors(selector *metav1.LabelSelector) []configv1.PodSelector {
+	var requirements []metav1.LabelSelectorRequirement
+	for key, value := range selector.MatchLabels {
+		requirements = append(requirements, metav1.LabelSelectorRequirement{
+			Key:      key,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{value},
+		})
+	}
+	requirements = append(requirements, selector.MatchExpressions...)
+
+	selectors := make([]configv1.PodSelector, 0, len(requirements))
+	for _, requirement := range requirements {
+		selectors = append(selectors, configv1.PodSelector{
+			LabelSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{requirement},
+			},
+		})
+	}
+	return selectors
+}
+
+// NewPodSelectors compiles the pod selectors, an entry without namespaceSelector selects the namespaces
+// labeled ip-reserve=enabled
+func NewPodSelectors(selectors []configv1.PodSelector) (PodSelectors, error) {
+	compiled := make(PodSelectors, 0, len(selectors))
+	for i, selector := range selectors {
+		namespaceSelector := selector.NamespaceSelector
+		if namespaceSelector == nil {
+			namespaceSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{cons.IPReserveKey: cons.IPReserveValue},
+			}
+		}
+		namespace, err := metav1.LabelSelectorAsSelector(namespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("podSelectors[%d].namespaceSelector: %v", i, err)
+		}
+		pod := labels.Everything()
+		if selector.LabelSelector != nil {
+			if pod, err = metav1.LabelSelectorAsSelector(selector.LabelSelector); err != nil {
+				return nil, fmt.Errorf("podSelectors[%d].labelSelector: %v", i, err)
+			}
+		}
+
+		entry := podSelector{namespace: namespace, pod: pod}
+		if entry.ownerKinds, err = parseKinds(fmt.Sprintf("podSelectors[%d].ownerKinds", i), selector.OwnerKinds); err != nil {
+			return nil, err
+		}
+		if entry.topOwnerKinds, err = parseKinds(fmt.Sprintf("podSelectors[%d].topOwnerKinds", i), selector.TopOwnerKinds); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+// SelectsNamespace reports whether any entry selects pods of a namespace with these labels
+func (s PodSelectors) SelectsNamespace(namespaceLabels map[string]string) bool {
+	for _, entry := range s {
+		if entry.namespace.Matches(labels.Set(namespaceLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Selects reports whether any entry selects the pod in a namespace with these labels,
+// topOwner is the top-level owner of its controller owner chain, nil for a pod without controller
+func (s PodSelectors) Selects(namespaceLabels map[string]string, pod *v1.Pod, topOwner *metav1.OwnerReference) bool {
+	for _, entry := range s {
+		if entry.namespace.Matches(labels.Set(namespaceLabels)) && entry.selectsPod(pod) &&
+			(len(entry.topOwnerKinds) == 0 || anyKindMatches(entry.topOwnerKinds, topOwner)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectsPod reports whether any entry may select the pod, whatever its namespace and its top-level owner
+func (s PodSelectors) SelectsPod(pod *v1.Pod) bool {
+	for _, entry := range s {
+		if entry.selectsPod(pod) && (len(entry.topOwnerKinds) == 0 || metav1.GetControllerOf(pod) != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *podSelector) selectsPod(pod *v1.Pod) bool {
+	if !e.pod.Matches(labels.Set(pod.Labels)) {
+		return false
+	}
+	return len(e.ownerKinds) == 0 || anyKindMatches(e.ownerKinds, metav1.GetControllerOf(pod))
+}
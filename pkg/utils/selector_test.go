@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	configv1 "github.com/xdfdotcn/capo/apis/config/v1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func newPod(labels map[string]string, apiVersion, kind string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "redis-0", Labels: labels}}
+	if kind != "" {
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: apiVersion, Kind: kind, Name: "redis", Controller: pointer.Bool(true)},
+		}
+	}
+	return pod
+}
+
+func TestLegacyPodSelectors(t *testing.T) {
+	selectors, err := NewPodSelectors(LegacyPodSelectors(DefaultLabelSelector()))
+	assert.NoError(t, err)
+	enabled := map[string]string{cons.IPReserveKey: cons.IPReserveValue}
+
+	// the requirements are ORed, in the namespaces labeled ip-reserve=enabled only
+	assert.True(t, selectors.Selects(enabled, newPod(map[string]string{cons.LabelSelectorStatefulSetPodKey: "1", "other": "true"}, "", ""), nil))
+	assert.True(t, selectors.Selects(enabled, newPod(map[string]string{cons.LabelSelectorKafkaPodKey: "1"}, "", ""), nil))
+	assert.False(t, selectors.Selects(enabled, newPod(map[string]string{"other": "true"}, "", ""), nil))
+	assert.False(t, selectors.Selects(nil, newPod(map[string]string{cons.LabelSelectorKafkaPodKey: "1"}, "", ""), nil))
+	assert.True(t, selectors.SelectsNamespace(enabled))
+	assert.False(t, selectors.SelectsNamespace(map[string]string{cons.IPReserveKey: "disabled"}))
+	assert.True(t, selectors.SelectsPod(newPod(map[string]string{cons.LabelSelectorKafkaPodKey: "1"}, "", "")))
+
+	selectors, err = NewPodSelectors(LegacyPodSelectors(&metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis", "tier": "cache"}}))
+	assert.NoError(t, err)
+	assert.True(t, selectors.Selects(enabled, newPod(map[string]string{"app": "redis"}, "", ""), nil))
+	assert.True(t, selectors.Selects(enabled, newPod(map[string]string{"tier": "cache"}, "", ""), nil))
+}
+
+func TestPodSelectors(t *testing.T) {
+	selectors, err := NewPodSelectors([]configv1.PodSelector{
+		{
+			// StatefulSet pods AND app=redis, in every namespace
+			NamespaceSelector: &metav1.LabelSelector{},
+			LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "redis"}},
+			OwnerKinds:        []string{"StatefulSet"},
+		},
+		{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "db"}},
+			OwnerKinds:        []string{"RedisCluster.redis.io"},
+		},
+		{
+			// pods of StatefulSets created by the Kafka operator
+			NamespaceSelector: &metav1.LabelSelector{},
+			TopOwnerKinds:     []string{"Kafka.v1beta2.kafka.strimzi.io"},
+		},
+	})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		namespace map[string]string
+		pod       *v1.Pod
+		topOwner  *metav1.OwnerReference
+		selected  bool
+	}{
+		{name: "statefulset redis", pod: newPod(map[string]string{"app": "redis"}, "apps/v1", "StatefulSet"), selected: true},
+		{name: "deployment redis", pod: newPod(map[string]string{"app": "redis"}, "apps/v1", "ReplicaSet")},
+		{name: "statefulset mysql", pod: newPod(map[string]string{"app": "mysql"}, "apps/v1", "StatefulSet")},
+		{name: "custom group statefulset", pod: newPod(map[string]string{"app": "redis"}, "apps.kruise.io/v1beta1", "StatefulSet"), selected: true},
+		{name: "bare pod", pod: newPod(map[string]string{"app": "redis"}, "", "")},
+		{name: "operator pod", namespace: map[string]string{"team": "db"}, pod: newPod(nil, "redis.io/v1", "RedisCluster"), selected: true},
+		{name: "operator pod of another group", namespace: map[string]string{"team": "db"}, pod: newPod(nil, "cache.io/v1", "RedisCluster")},
+		{name: "operator pod of another namespace", pod: newPod(nil, "redis.io/v1", "RedisCluster")},
+		{name: "kafka pod", pod: newPod(nil, "apps/v1", "StatefulSet"),
+			topOwner: &metav1.OwnerReference{APIVersion: "kafka.strimzi.io/v1beta2", Kind: "Kafka", Name: "kafka"}, selected: true},
+		{name: "kafka pod of another version", pod: newPod(nil, "apps/v1", "StatefulSet"),
+			topOwner: &metav1.OwnerReference{APIVersion: "kafka.strimzi.io/v1beta1", Kind: "Kafka", Name: "kafka"}},
+		{name: "unresolved owner", pod: newPod(nil, "apps/v1", "StatefulSet")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.selected, selectors.Selects(tc.namespace, tc.pod, tc.topOwner))
+		})
+	}
+
+	assert.True(t, selectors.SelectsPod(newPod(nil, "apps/v1", "StatefulSet")))
+	assert.False(t, selectors.SelectsPod(newPod(nil, "", "")))
+
+	_, err = NewPodSelectors([]configv1.PodSelector{
+		{LabelSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bad"}}}},
+	})
+	assert.Error(t, err)
+}
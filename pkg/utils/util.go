@@ -8,11 +8,12 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"os"
 
 	"github.com/go-logr/logr"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"k8s.io/apimachinery/pkg/labels"
 	k8szap "sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
@@ -75,25 +76,22 @@ func IPRangeSize(cidr *net.IPNet) *big.Int {
 	return big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
 }
 
-type AnyMatchSelector struct {
-	r []labels.Requirement
-	s labels.Selector
-}
-
-func NewAnyMatchSelector(s labels.Selector, r []labels.Requirement) *AnyMatchSelector {
-	return &AnyMatchSelector{
-		r: r,
-		s: s,
+// GetNamespace returns the namespace capo runs in, which holds its ConfigMaps.
+// It is taken from the POD_NAMESPACE env and defaults to ip-reserve.
+func GetNamespace() string {
+	if ns := os.Getenv(cons.EnvNamespace); ns != "" {
+		return ns
 	}
+	return cons.IPReserveKey
 }
 
-func (a *AnyMatchSelector) Matches(l labels.Labels) bool {
-	for ix := range a.r {
-		if matches := a.r[ix].Matches(l); matches {
-			return true
-		}
+// GetServiceAccount returns the service account capo runs as.
+// It is taken from the POD_SERVICE_ACCOUNT env and defaults to ip-reserve-controller-manager.
+func GetServiceAccount() string {
+	if sa := os.Getenv(cons.EnvServiceAccount); sa != "" {
+		return sa
 	}
-	return false
+	return cons.ServiceAccountName
 }
 
 //get the local IP address, Here is a better solution to retrieve the preferred outbound ip address when there are multiple ip interfaces exist on the machine.
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:verbs=create,path=/pod-ip-claim,mutating=true,failurePolicy=ignore,groups=core,resources=pods,versions=v1,name=claim.ip.io,admissionReviewVersions=v1,sideEffects=none
+
+// claimMutator assigns the IP of its IPClaim to a pod being created
+type claimMutator struct {
+	client client.Client
+}
+
+func NewClaimMutator(c client.Client) admission.Handler {
+	return &claimMutator{
+		client: c,
+	}
+}
+
+// Handle injects the Calico ipAddrs annotation into a pod claimed by an IPClaim. The reservation of the IP is
+// lifted by the IPClaim controller once the pod exists, so that a pod rejected after this webhook leaves it reserved.
+func (r *claimMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	outcome := cons.WebhookOutcomeIgnored
+	defer func() {
+		metrics.ClaimWebhookDecisionsTotal.WithLabelValues(outcome).Inc()
+	}()
+	if req.Operation != admissionv1.Create || req.RequestSubResource != "" {
+		return admission.Allowed("")
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		outcome = cons.WebhookOutcomeDenied
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	claim, err := r.findClaim(ctx, req.Namespace, pod.Name)
+	if err != nil {
+		outcome = cons.WebhookOutcomeDenied
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if claim == nil {
+		return admission.Allowed("")
+	}
+
+	logger := log.FromContext(ctx).WithValues("pod", req.Namespace+"/"+pod.Name, "claim", claim.Name, "ip", claim.Spec.IP)
+	ipAddrs, _ := json.Marshal([]string{claim.Spec.IP})
+	if current, ok := pod.Annotations[cons.CalicoIPAddrsAnnotation]; ok && current != string(ipAddrs) {
+		outcome = cons.WebhookOutcomeDenied
+		return admission.Denied(fmt.Sprintf("%s %s conflicts with IPClaim %s", cons.CalicoIPAddrsAnnotation, current, claim.Name))
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[cons.CalicoIPAddrsAnnotation] = string(ipAddrs)
+	pod.Annotations[cons.IPClaimAnnotation] = claim.Name
+	mutated, err := json.Marshal(pod)
+	if err != nil {
+		outcome = cons.WebhookOutcomeDenied
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	outcome = cons.WebhookOutcomeBound
+	logger.Info("bind claimed IP")
+	return admission.PatchResponseFromRaw(req.Object.Raw, mutated)
+}
+
+// findClaim returns the IPClaim of the namespace claiming an IP for the pod, nil if none does.
+// Pending claims, invalid or claiming the IP of an older claim, are skipped.
+func (r *claimMutator) findClaim(ctx context.Context, namespace, podName string) (*ipamv1alpha1.IPClaim, error) {
+	if podName == "" {
+		return nil, nil
+	}
+	claims := &ipamv1alpha1.IPClaimList{}
+	if err := r.client.List(ctx, claims, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		if claim.DeletionTimestamp.IsZero() && claim.Spec.TargetPod() == podName &&
+			(claim.Status.Phase == ipamv1alpha1.IPClaimAvailable || claim.Status.Phase == ipamv1alpha1.IPClaimBound) {
+			return claim, nil
+		}
+	}
+	return nil, nil
+}
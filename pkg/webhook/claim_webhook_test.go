@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	ipamv1alpha1 "github.com/xdfdotcn/capo/apis/ipam/v1alpha1"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newClaim(name, ip, phase string, spec ipamv1alpha1.IPClaimSpec) *ipamv1alpha1.IPClaim {
+	spec.IP = ip
+	return &ipamv1alpha1.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: name},
+		Spec:       spec,
+		Status:     ipamv1alpha1.IPClaimStatus{Phase: phase},
+	}
+}
+
+func newPodRequest(pod *v1.Pod) admission.Request {
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Resource:  metav1.GroupVersionResource{Resource: "pods"},
+		Namespace: pod.Namespace,
+	}}
+	req.Object.Raw, _ = json.Marshal(pod)
+	return req
+}
+
+func TestClaimMutator(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, v3.AddToScheme(scheme))
+	assert.NoError(t, ipamv1alpha1.AddToScheme(scheme))
+	reservation := &v3.IPReservation{
+		ObjectMeta: metav1.ObjectMeta{Name: handler.IPClaimReservationKey().Name},
+		Spec:       v3.IPReservationSpec{ReservedCIDRs: []string{"10.0.1.1", "10.0.1.2"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(reservation,
+		newClaim("kafka-0", "10.0.1.1", ipamv1alpha1.IPClaimAvailable,
+			ipamv1alpha1.IPClaimSpec{StatefulSet: &ipamv1alpha1.StatefulSetOrdinal{Name: "kafka", Ordinal: 0}}),
+		newClaim("kafka-1", "10.0.1.2", ipamv1alpha1.IPClaimPending,
+			ipamv1alpha1.IPClaimSpec{StatefulSet: &ipamv1alpha1.StatefulSetOrdinal{Name: "kafka", Ordinal: 1}}),
+		newClaim("client", "10.0.1.3", ipamv1alpha1.IPClaimAvailable, ipamv1alpha1.IPClaimSpec{PodName: "client"}),
+	).Build()
+	mutator := NewClaimMutator(c)
+	ctx := context.Background()
+
+	newPod := func(name string, annotations map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kafka", Name: name, Annotations: annotations}}
+	}
+	cases := []struct {
+		name    string
+		pod     *v1.Pod
+		allowed bool
+		patched bool
+	}{
+		{name: "claimed pod", pod: newPod("kafka-0", nil), allowed: true, patched: true},
+		{name: "unclaimed pod", pod: newPod("kafka-2", nil), allowed: true},
+		{name: "pending claim", pod: newPod("kafka-1", nil), allowed: true},
+		{name: "same ipAddrs", pod: newPod("kafka-0", map[string]string{cons.CalicoIPAddrsAnnotation: `["10.0.1.1"]`}),
+			allowed: true, patched: true},
+		{name: "conflicting ipAddrs", pod: newPod("client", map[string]string{cons.CalicoIPAddrsAnnotation: `["10.0.1.9"]`})},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := mutator.Handle(ctx, newPodRequest(tc.pod))
+			assert.Equal(t, tc.allowed, resp.Allowed)
+			assert.Equal(t, tc.patched, len(resp.Patches) > 0)
+		})
+	}
+
+	// both IPs stay reserved until the IPClaim controller sees the pod
+	assert.NoError(t, c.Get(ctx, handler.IPClaimReservationKey(), reservation))
+	assert.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, reservation.Spec.ReservedCIDRs)
+
+	resp := mutator.Handle(ctx, newPodRequest(newPod("kafka-0", nil)))
+	annotations := map[string]string{}
+	for _, patch := range resp.Patches {
+		if patch.Path == "/metadata/annotations" {
+			for k, v := range patch.Value.(map[string]interface{}) {
+				annotations[k] = v.(string)
+			}
+		}
+	}
+	assert.Equal(t, `["10.0.1.1"]`, annotations[cons.CalicoIPAddrsAnnotation])
+	assert.Equal(t, "kafka-0", annotations[cons.IPClaimAnnotation])
+}
@@ -5,9 +5,14 @@ package webhook
 
 import (
 	"context"
+	"time"
 
 	cons "github.com/xdfdotcn/capo/pkg/constants"
 	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/admission/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -31,6 +36,19 @@ func NewPodValidator(c client.Client, keeper *handler.IPKeeper) admission.Handle
 
 // podValidator admits a pod if a specific annotation exists.
 func (r *podValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	start := time.Now()
+	outcome := cons.WebhookOutcomeAllowed
+	ctx, span := tracing.Tracer().Start(ctx, "podValidator.Handle", trace.WithAttributes(
+		append(tracing.PodAttributes(req.Namespace, req.Name),
+			attribute.String("operation", string(req.Operation)),
+			attribute.String("subresource", req.RequestSubResource))...))
+	defer func() {
+		span.SetAttributes(attribute.String("outcome", outcome))
+		span.End()
+		metrics.WebhookDecisionsTotal.WithLabelValues(outcome).Inc()
+		metrics.WebhookDurationSeconds.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	}()
+
 	logger := log.FromContext(ctx).WithValues("reqKind", req.Kind,
 		"reqNamespace", req.Namespace,
 		"reqName", req.Name,
@@ -39,11 +57,26 @@ func (r *podValidator) Handle(ctx context.Context, req admission.Request) admiss
 		"reqSubResource", req.RequestSubResource)
 	logger.Info("Request detail")
 	if v1.Delete != req.Operation && cons.PodSubResourceEviction != req.RequestSubResource {
+		outcome = cons.WebhookOutcomeIgnored
 		return admission.Allowed("")
 	}
 
+	if r.keeper.Degraded() {
+		outcome = cons.WebhookOutcomeDegraded
+		logger.Info("allowed without reserving IPs, IPKeeper is not initialized")
+		return admission.Allowed("capo is degraded, IPs are not reserved")
+	}
+
 	err := r.keeper.IpReserve(ctx, logger, req.Namespace, req.Name)
+	if err != nil && r.keeper.ShadowMode() {
+		outcome = cons.WebhookOutcomeShadow
+		tracing.RecordError(span, err)
+		logger.Error(err, "allowed in shadow mode, would be denied")
+		return admission.Allowed("capo is in shadow mode, the deletion would be denied: " + err.Error())
+	}
 	if err != nil {
+		outcome = cons.WebhookOutcomeDenied
+		tracing.RecordError(span, err)
 		logger.Error(err, "denied")
 		return admission.Denied(err.Error())
 	}
@@ -0,0 +1,178 @@
+/*
+Copyright 2022 xdfdotcn
+*/
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	"github.com/xdfdotcn/capo/pkg/metrics"
+	"github.com/xdfdotcn/capo/pkg/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:verbs=update;delete,path=/capo-state,mutating=false,failurePolicy=ignore,groups="";projectcalico.org,resources=configmaps;ipreservations,versions=v1;v3,name=state.ip.io,admissionReviewVersions=v1,sideEffects=none
+
+// stateValidator guards the IPReservation and the pod info ConfigMap against changes by other identities than capo
+type stateValidator struct {
+	client client.Client
+	// username of the service account capo runs as
+	capo string
+}
+
+func NewStateValidator(c client.Client) admission.Handler {
+	return &stateValidator{
+		client: c,
+		capo:   fmt.Sprintf("system:serviceaccount:%s:%s", utils.GetNamespace(), utils.GetServiceAccount()),
+	}
+}
+
+// Handle denies removals of the entries capo owns and malformed values, unless the object has the break-glass annotation
+func (r *stateValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	outcome := cons.WebhookOutcomeIgnored
+	defer func() {
+		metrics.StateWebhookDecisionsTotal.WithLabelValues(outcome).Inc()
+	}()
+
+	podIPMapKey, ipReservationKey := handler.PodIPMapKey(), handler.IPReservationKey()
+	if req.UserInfo.Username == r.capo {
+		return admission.Allowed("")
+	}
+
+	var (
+		breakGlass bool
+		err        error
+	)
+	switch {
+	case req.Resource.Resource == "configmaps" && req.Namespace == podIPMapKey.Namespace && req.Name == podIPMapKey.Name:
+		var oldObj, newObj v1.ConfigMap
+		if breakGlass, err = decode(req, &oldObj, &newObj, &oldObj.ObjectMeta, &newObj.ObjectMeta); err == nil {
+			err = validatePodIPMap(req.Operation, &oldObj, &newObj)
+		}
+	case req.Resource.Resource == "ipreservations" && req.Name == ipReservationKey.Name:
+		var oldObj, newObj v3.IPReservation
+		if breakGlass, err = decode(req, &oldObj, &newObj, &oldObj.ObjectMeta, &newObj.ObjectMeta); err == nil {
+			err = validateIPReservation(req.Operation, &oldObj, &newObj, r.ownedIPs(ctx))
+		}
+	default:
+		return admission.Allowed("")
+	}
+
+	logger := log.FromContext(ctx).WithValues("reqResource", req.Resource.Resource,
+		"reqName", req.Name,
+		"reqOperation", req.Operation,
+		"user", req.UserInfo.Username)
+	if err == nil {
+		outcome = cons.WebhookOutcomeAllowed
+		return admission.Allowed("")
+	}
+	if breakGlass {
+		outcome = cons.WebhookOutcomeBreakGlass
+		logger.Info("allowed by break-glass annotation", "violation", err.Error())
+		return admission.Allowed("break-glass: " + err.Error())
+	}
+	outcome = cons.WebhookOutcomeDenied
+	logger.Info("denied", "violation", err.Error())
+	return admission.Denied(fmt.Sprintf("%v, set the %s=true annotation to override", err, cons.BreakGlassAnnotation))
+}
+
+// decode decodes the old and the new objects of req, and reports whether the object to change has the break-glass annotation
+func decode(req admission.Request, oldObj, newObj interface{}, oldMeta, newMeta *metav1.ObjectMeta) (bool, error) {
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, oldObj); err != nil {
+			return false, err
+		}
+	}
+	if len(req.Object.Raw) > 0 {
+		if err := json.Unmarshal(req.Object.Raw, newObj); err != nil {
+			return false, err
+		}
+	}
+	// a deletion is overridden by annotating the object first
+	meta := newMeta
+	if req.Operation == admissionv1.Delete {
+		meta = oldMeta
+	}
+	return meta.Annotations[cons.BreakGlassAnnotation] == "true", nil
+}
+
+// ownedIPs returns the IPs capo reserved, that is those with pod info and the system reserved IP
+func (r *stateValidator) ownedIPs(ctx context.Context) map[string]bool {
+	podIPMap := &v1.ConfigMap{}
+	if err := r.client.Get(ctx, handler.PodIPMapKey(), podIPMap); err != nil {
+		// every single IP is then considered owned
+		return nil
+	}
+	owned := map[string]bool{cons.SystemReserveIP: true}
+	for podIP := range podIPMap.Data {
+		owned[podIP] = true
+	}
+	return owned
+}
+
+func validatePodIPMap(operation admissionv1.Operation, oldObj, newObj *v1.ConfigMap) error {
+	if operation == admissionv1.Delete {
+		return fmt.Errorf("the pod info ConfigMap of capo must not be deleted")
+	}
+	for podIP := range oldObj.Data {
+		if _, ok := newObj.Data[podIP]; !ok {
+			return fmt.Errorf("removing the pod info of %s is not allowed, capo releases it", podIP)
+		}
+	}
+	for podIP, podInfo := range newObj.Data {
+		if oldObj.Data[podIP] == podInfo {
+			continue
+		}
+		if err := handler.ValidatePodInfo(podIP, podInfo); err != nil {
+			return fmt.Errorf("malformed pod info: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateIPReservation denies removals of the owned IPs and of the aggregates capo compacted them into,
+// a nil owned means every single IP
+func validateIPReservation(operation admissionv1.Operation, oldObj, newObj *v3.IPReservation, owned map[string]bool) error {
+	if operation == admissionv1.Delete {
+		return fmt.Errorf("the IPReservation of capo must not be deleted")
+	}
+	if oldObj.Annotations[cons.CompactedAnnotation] != newObj.Annotations[cons.CompactedAnnotation] {
+		return fmt.Errorf("changing the %s annotation is not allowed, capo maintains it", cons.CompactedAnnotation)
+	}
+	compacted := map[string]bool{}
+	for _, cidr := range strings.Split(oldObj.Annotations[cons.CompactedAnnotation], ",") {
+		compacted[cidr] = true
+	}
+	kept := map[string]bool{}
+	for _, cidr := range newObj.Spec.ReservedCIDRs {
+		if utils.ParseCidr(cidr) == nil {
+			return fmt.Errorf("malformed reserved CIDR %q", cidr)
+		}
+		kept[cidr] = true
+	}
+	for _, cidr := range oldObj.Spec.ReservedCIDRs {
+		if kept[cidr] {
+			continue
+		}
+		ipNet := utils.ParseCidr(cidr)
+		if ipNet == nil {
+			continue
+		}
+		single := utils.IPRangeSize(ipNet).Int64() == 1
+		if cidr == cons.SystemReserveIP || compacted[ipNet.String()] || (single && (owned == nil || owned[ipNet.IP.String()])) {
+			return fmt.Errorf("removing %s, reserved by capo, is not allowed, capo releases it", cidr)
+		}
+	}
+	return nil
+}
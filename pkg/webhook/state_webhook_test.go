@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/stretchr/testify/assert"
+	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/handler"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const podInfo = "redis_redis-0_node01_2022-11-24-14:00:00"
+
+func newPodIPMap(data map[string]string, annotations map[string]string) *v1.ConfigMap {
+	key := handler.PodIPMapKey()
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name, Annotations: annotations},
+		Data:       data,
+	}
+}
+
+func newIPReservation(cidrs ...string) *v3.IPReservation {
+	return &v3.IPReservation{
+		ObjectMeta: metav1.ObjectMeta{Name: handler.IPReservationKey().Name},
+		Spec:       v3.IPReservationSpec{ReservedCIDRs: cidrs},
+	}
+}
+
+func withCompacted(ipReservation *v3.IPReservation, compacted string) *v3.IPReservation {
+	ipReservation.Annotations = map[string]string{cons.CompactedAnnotation: compacted}
+	return ipReservation
+}
+
+func newStateRequest(operation admissionv1.Operation, resource, user string, oldObj, newObj client.Object) admission.Request {
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: operation,
+		Resource:  metav1.GroupVersionResource{Resource: resource},
+		Name:      oldObj.GetName(),
+		Namespace: oldObj.GetNamespace(),
+		UserInfo:  authenticationv1.UserInfo{Username: user},
+	}}
+	req.OldObject.Raw, _ = json.Marshal(oldObj)
+	if newObj != nil {
+		req.Object.Raw, _ = json.Marshal(newObj)
+	}
+	return req
+}
+
+func TestStateValidator(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	assert.NoError(t, v3.AddToScheme(scheme))
+	stored := newPodIPMap(map[string]string{"10.0.1.1": podInfo}, nil)
+	validator := NewStateValidator(fake.NewClientBuilder().WithScheme(scheme).WithObjects(stored).Build())
+	capo := validator.(*stateValidator).capo
+	ctx := context.Background()
+	now := time.Now().Format(cons.TimeLayout)
+
+	cases := []struct {
+		name    string
+		req     admission.Request
+		allowed bool
+	}{
+		{
+			name: "capo releases pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", capo,
+				stored, newPodIPMap(nil, nil)),
+			allowed: true,
+		},
+		{
+			name: "removing pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(nil, nil)),
+		},
+		{
+			name: "malformed pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(map[string]string{"10.0.1.1": podInfo, "10.0.1.2": "redis-1"}, nil)),
+		},
+		{
+			name: "adding pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(map[string]string{"10.0.1.1": podInfo, "10.0.1.2": "redis_redis-1_node01_" + now}, nil)),
+			allowed: true,
+		},
+		{
+			name: "adding JSON pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(map[string]string{"10.0.1.1": podInfo,
+					"10.0.1.2": `{"namespace":"redis","name":"redis-1","node":"node01","reserved":"2022-11-24T06:00:00Z"}`}, nil)),
+			allowed: true,
+		},
+		{
+			name: "malformed JSON pod info",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(map[string]string{"10.0.1.1": podInfo,
+					"10.0.1.2": `{"namespace":"redis","name":"redis-1","node":"node01","reserved":"yesterday"}`}, nil)),
+		},
+		{
+			name: "removing pod info with break-glass",
+			req: newStateRequest(admissionv1.Update, "configmaps", "admin",
+				stored, newPodIPMap(nil, map[string]string{cons.BreakGlassAnnotation: "true"})),
+			allowed: true,
+		},
+		{
+			name: "deleting the pod info ConfigMap",
+			req:  newStateRequest(admissionv1.Delete, "configmaps", "admin", stored, nil),
+		},
+		{
+			name: "other ConfigMaps",
+			req: newStateRequest(admissionv1.Delete, "configmaps", "admin",
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "redis", Name: "redis"}}, nil),
+			allowed: true,
+		},
+		{
+			name: "removing an IP reserved by capo",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				newIPReservation(cons.SystemReserveIP, "10.0.1.1"), newIPReservation(cons.SystemReserveIP)),
+		},
+		{
+			name: "removing the system reserved IP",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				newIPReservation(cons.SystemReserveIP, "10.0.1.1"), newIPReservation("10.0.1.1")),
+		},
+		{
+			name: "removing an aggregate compacted by capo",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				withCompacted(newIPReservation(cons.SystemReserveIP, "10.0.4.0/30"), "10.0.4.0/30"),
+				withCompacted(newIPReservation(cons.SystemReserveIP), "10.0.4.0/30")),
+		},
+		{
+			name: "removing the compacted annotation",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				withCompacted(newIPReservation(cons.SystemReserveIP, "10.0.4.0/30"), "10.0.4.0/30"),
+				newIPReservation(cons.SystemReserveIP, "10.0.4.0/30")),
+		},
+		{
+			name: "removing a manually reserved range and IP",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				newIPReservation(cons.SystemReserveIP, "10.0.1.1", "10.0.2.0/24", "10.0.3.1"),
+				newIPReservation(cons.SystemReserveIP, "10.0.1.1")),
+			allowed: true,
+		},
+		{
+			name: "malformed reserved CIDR",
+			req: newStateRequest(admissionv1.Update, "ipreservations", "admin",
+				newIPReservation(cons.SystemReserveIP), newIPReservation(cons.SystemReserveIP, "10.0.1.300")),
+		},
+		{
+			name: "deleting the IPReservation with break-glass",
+			req: newStateRequest(admissionv1.Delete, "ipreservations", "admin", &v3.IPReservation{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        handler.IPReservationKey().Name,
+					Annotations: map[string]string{cons.BreakGlassAnnotation: "true"},
+				},
+			}, nil),
+			allowed: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.allowed, validator.Handle(ctx, c.req).Allowed)
+		})
+	}
+}
@@ -19,12 +19,14 @@ package e2e
 import (
 	"context"
 	"fmt"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
 	v3 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
 	cons "github.com/xdfdotcn/capo/pkg/constants"
+	"github.com/xdfdotcn/capo/pkg/utils"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -213,8 +215,14 @@ func assertIPCount(t *testing.T, cfg *envconf.Config, testIPCount int) {
 	err := e2ewait.For(conditions.New(cfg.Client().Resources()).ResourceMatch(ipr, func(object k8s.Object) bool {
 		ip := object.(*v3.IPReservation)
 		t.Logf("cr len is %d, ips: %v\n ", len(ip.Spec.ReservedCIDRs), ip.Spec.ReservedCIDRs)
-		// exclude systemIP: 1.1.1.1
-		return len(ip.Spec.ReservedCIDRs)-1 == testIPCount
+		// consecutive IPs are compacted into CIDRs, exclude systemIP: 1.1.1.1
+		count := int64(0)
+		for _, cidr := range ip.Spec.ReservedCIDRs {
+			if cidr != cons.SystemReserveIP {
+				count += utils.IPRangeSize(utils.ParseCidr(cidr)).Int64()
+			}
+		}
+		return count == int64(testIPCount)
 	}), e2ewait.WithTimeout(time.Second*40))
 	if err != nil {
 		t.Logf("wait for the ip reserve cr ip count to: %d error", testIPCount)
@@ -233,13 +241,17 @@ func assertIPCount(t *testing.T, cfg *envconf.Config, testIPCount int) {
 		t.Fatal(err)
 	}
 
-	// ipReserve ip should be included in the config map
-	for _, ip := range ipr.Spec.ReservedCIDRs {
-		if ip == cons.SystemReserveIP {
-			continue
+	// the config map ips should be reserved
+	for ip := range cm.Data {
+		covered := false
+		for _, cidr := range ipr.Spec.ReservedCIDRs {
+			if ipNet := utils.ParseCidr(cidr); ipNet != nil && ipNet.Contains(net.ParseIP(ip)) {
+				covered = true
+				break
+			}
 		}
-		if _, ok := cm.Data[ip]; !ok {
-			t.Fatalf("ipReserve ip should be included in the config map, cr IP: %v \n configmaps: %v\n", ipr.Spec.ReservedCIDRs, cm.Data)
+		if !covered {
+			t.Fatalf("config map ip should be reserved, cr IP: %v \n configmaps: %v\n", ipr.Spec.ReservedCIDRs, cm.Data)
 		}
 	}
 }
@@ -19,6 +19,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
 	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -132,6 +133,7 @@ var _ = Describe("Webhook", func() {
 
 	var (
 		keeper            *handler.IPKeeper
+		clock             *clocktesting.FakeClock
 		testIPConfigMaps  = &v1.ConfigMap{}
 		testIPReservation = &v3.IPReservation{}
 	)
@@ -149,6 +151,8 @@ var _ = Describe("Webhook", func() {
 		keeper, err = handler.NewIPKeeper(fakeClient, ctrlConfig)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(keeper).NotTo(BeNil())
+		clock = clocktesting.NewFakeClock(time.Date(2022, 6, 6, 10, 0, 0, 0, time.UTC))
+		keeper.SetClock(clock)
 		validator = webhook.NewPodValidator(fakeClient, keeper)
 	})
 
@@ -235,6 +239,24 @@ var _ = Describe("Webhook", func() {
 		Expect(err).NotTo(HaveOccurred())
 		Expect(testIPConfigMaps.Data).To(HaveKey(podIP))
 		Expect(testIPConfigMaps.Data).To(HaveLen(1))
+
+		// released once held the reserve time
+		clock.Step(ctrlConfig.IPReserveTime.Duration)
+		err = keeper.IpRelease(context.TODO(), utils.CreateLogger(false, true))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = fakeClient.Get(context.TODO(), types.NamespacedName{
+			Name: cons.IPReservationName,
+		}, testIPReservation)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testIPReservation.Spec.ReservedCIDRs).To(Equal([]string{cons.SystemReserveIP}))
+
+		err = fakeClient.Get(context.TODO(), types.NamespacedName{
+			Name:      cons.IPReservationName,
+			Namespace: cons.IPReserveKey,
+		}, testIPConfigMaps)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testIPConfigMaps.Data).To(BeEmpty())
 	})
 })
 